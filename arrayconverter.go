@@ -0,0 +1,191 @@
+package can2mqtt_tuc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// arrayConverter packs several elements of the same type into a frame
+// and publishes them as one value, separated by spaces
+type arrayConverter struct {
+	signals []*signal
+	bools   bool
+	kind    numberKind
+	size    int // data bytes needed for the elements
+	length  int // data bytes of encoded frames
+}
+
+// elementTypes maps the element types of the convert-mode array to
+// the length in bits and the type of a field
+var elementTypes = map[string]struct {
+	bits int
+	typ  string
+}{
+	"bool":    {1, "unsigned"},
+	"uint8":   {8, "unsigned"},
+	"int8":    {8, "signed"},
+	"uint16":  {16, "unsigned"},
+	"int16":   {16, "signed"},
+	"uint32":  {32, "unsigned"},
+	"int32":   {32, "signed"},
+	"uint64":  {64, "unsigned"},
+	"int64":   {64, "signed"},
+	"float16": {16, "float"},
+	"float32": {32, "float"},
+	"float64": {64, "float"},
+}
+
+func init() {
+	modes := map[string]map[string]string{
+		"16bool2ascii":  {"type": "bool", "count": "16"},
+		"4uint162ascii": {"type": "uint16", "count": "4"},
+		"4int162ascii":  {"type": "int16", "count": "4"},
+		"4uint82ascii":  {"type": "uint8", "count": "4", "stride": "2"},
+		"8uint82ascii":  {"type": "uint8", "count": "8"},
+		"int82ascii":    {"type": "int8"},
+		"int162ascii":   {"type": "int16"},
+		"int642ascii":   {"type": "int64"},
+		"float162ascii": {"type": "float16"},
+		"float642ascii": {"type": "float64"},
+	}
+	for mode, params := range modes {
+		params := params
+		err := RegisterConverter(mode, func(conf ConverterConfig) (Converter, error) {
+			endian, ok := conf.Params["endian"]
+			if !ok {
+				return newArrayConverter(params)
+			}
+			// the byte order is the only param of these modes
+			withEndian := map[string]string{"endian": endian}
+			for k, v := range params {
+				withEndian[k] = v
+			}
+			return newArrayConverter(withEndian)
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+	err := RegisterConverter("array", func(conf ConverterConfig) (Converter, error) {
+		return newArrayConverter(conf.Params)
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// newArrayConverter creates an array converter from the params type,
+// count (default: 1), stride (distance of the elements in bytes, in
+// bits for bool, default: the size of the element) and endian (little
+// or big). Besides the elementTypes the fixed-point types q<m>.<n> and
+// uq<m>.<n> can be used.
+func newArrayConverter(params map[string]string) (*arrayConverter, error) {
+	et, ok := elementTypes[params["type"]]
+	fixed := false
+	if !ok {
+		_, m, n, isQ := parseQFormat(params["type"])
+		if !isQ {
+			return nil, fmt.Errorf("invalid element type %q", params["type"])
+		}
+		et.bits, et.typ, fixed = m+n, params["type"], true
+	}
+	count := 1
+	if c, ok := params["count"]; ok {
+		n, err := strconv.Atoi(c)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid count %q", c)
+		}
+		count = n
+	}
+	stride := et.bits // in bits
+	if s, ok := params["stride"]; ok {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid stride %q", s)
+		}
+		stride = n
+		if et.bits > 1 {
+			stride *= 8
+		}
+	}
+	if stride < et.bits {
+		return nil, fmt.Errorf("stride is smaller than the elements")
+	}
+	c := &arrayConverter{bools: et.bits == 1, kind: integers}
+	if et.typ == "float" || fixed {
+		c.kind = floats
+	} else if c.bools {
+		c.kind = noNumbers
+	}
+	for i := 0; i < count; i++ {
+		f := Field{
+			Name:   "element" + strconv.Itoa(i+1),
+			Byte:   i * stride / 8,
+			Bit:    i * stride % 8,
+			Length: et.bits,
+			Type:   et.typ,
+			Endian: params["endian"],
+		}
+		sig, err := f.signal(i)
+		if err != nil {
+			return nil, err
+		}
+		c.signals = append(c.signals, sig)
+		if end := (i*stride + et.bits + 7) / 8; end > c.size {
+			c.size = end
+		}
+	}
+	c.length = (count*stride + 7) / 8
+	if (c.length > 8 && c.size <= 8) || c.length > 64 {
+		// the gap after the last element doesn't need a CAN FD frame
+		c.length = c.size
+	}
+	if c.size > 64 {
+		return nil, fmt.Errorf("the elements need %d bytes, a CAN FD frame has 64", c.size)
+	}
+	return c, nil
+}
+
+func (c *arrayConverter) Values() int { return 1 }
+
+func (c *arrayConverter) dataLength() int { return c.length }
+
+func (c *arrayConverter) numbers() numberKind { return c.kind }
+
+func (c *arrayConverter) Decode(data []byte) ([]string, error) {
+	if len(data) < c.size {
+		return nil, fmt.Errorf("frame has %d data bytes, %d needed", len(data), c.size)
+	}
+	elements := make([]string, len(c.signals))
+	for i, sig := range c.signals {
+		elements[i] = sig.decode(data)
+	}
+	return []string{strings.Join(elements, " ")}, nil
+}
+
+func (c *arrayConverter) Encode(values []string) ([]byte, error) {
+	if len(values) != 1 {
+		return nil, fmt.Errorf("expected 1 value, got %d", len(values))
+	}
+	elements := strings.Fields(values[0])
+	if len(elements) != len(c.signals) {
+		return nil, fmt.Errorf("expected %d numbers separated by spaces, got %d", len(c.signals), len(elements))
+	}
+	data := make([]byte, c.length)
+	for i, sig := range c.signals {
+		e := elements[i]
+		if c.bools {
+			switch strings.ToLower(e) {
+			case "true":
+				e = "1"
+			case "false":
+				e = "0"
+			}
+		}
+		if err := sig.encode(data, e); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,101 @@
+package can2mqtt_tuc
+
+import (
+	"bytes"
+	"testing"
+)
+
+// each documented array mode has to encode the payload into the
+// frame and decode the frame back into the same payload
+func TestArrayModesRoundTrip(t *testing.T) {
+	tests := []struct {
+		mode    string
+		payload string
+		data    []byte
+	}{
+		{"16bool2ascii", "1 0 0 0 0 0 0 1 0 1 0 0 0 0 0 0",
+			[]byte{0x81, 0x02}},
+		{"4uint162ascii", "1 513 0 65535",
+			[]byte{0x01, 0x00, 0x01, 0x02, 0x00, 0x00, 0xff, 0xff}},
+		{"4int162ascii", "-1 256 -32768 32767",
+			[]byte{0xff, 0xff, 0x00, 0x01, 0x00, 0x80, 0xff, 0x7f}},
+		{"4uint82ascii", "1 2 3 255",
+			[]byte{0x01, 0x00, 0x02, 0x00, 0x03, 0x00, 0xff, 0x00}},
+		{"8uint82ascii", "0 1 2 3 4 5 6 255",
+			[]byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0xff}},
+	}
+	for _, tt := range tests {
+		conv, err := newConverter(ConverterConfig{Mode: tt.mode})
+		if err != nil {
+			t.Fatalf("%s: %s", tt.mode, err)
+		}
+		data, err := conv.Encode([]string{tt.payload})
+		if err != nil {
+			t.Errorf("%s: encoding %q: %s", tt.mode, tt.payload, err)
+			continue
+		}
+		if !bytes.Equal(data, tt.data) {
+			t.Errorf("%s: %q encoded as % X, want % X", tt.mode, tt.payload, data, tt.data)
+		}
+		values, err := conv.Decode(data)
+		if err != nil {
+			t.Errorf("%s: decoding % X: %s", tt.mode, data, err)
+			continue
+		}
+		if len(values) != 1 || values[0] != tt.payload {
+			t.Errorf("%s: % X decoded as %q, want %q", tt.mode, data, values, tt.payload)
+		}
+	}
+}
+
+func TestArrayModesReject(t *testing.T) {
+	tests := []struct {
+		mode    string
+		payload string
+	}{
+		{"16bool2ascii", "1 0"},
+		{"16bool2ascii", "2 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0"},
+		{"4uint162ascii", "1 2 3 65536"},
+		{"4int162ascii", "1 2 3 -32769"},
+		{"4uint82ascii", "1 2 3 4 5"},
+		{"8uint82ascii", "0 1 2 3 4 5 6 x"},
+	}
+	for _, tt := range tests {
+		conv, err := newConverter(ConverterConfig{Mode: tt.mode})
+		if err != nil {
+			t.Fatalf("%s: %s", tt.mode, err)
+		}
+		if data, err := conv.Encode([]string{tt.payload}); err == nil {
+			t.Errorf("%s: %q encoded as % X, want an error", tt.mode, tt.payload, data)
+		}
+	}
+}
+
+func TestArrayParams(t *testing.T) {
+	conv, err := newConverter(ConverterConfig{Mode: "array", Params: map[string]string{
+		"type": "int16", "count": "2", "stride": "3", "endian": "big",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := conv.Encode([]string{"-2 258"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0xff, 0xfe, 0x00, 0x01, 0x02, 0x00}; !bytes.Equal(data, want) {
+		t.Errorf("encoded as % X, want % X", data, want)
+	}
+	if _, err := conv.Decode(data[:4]); err == nil {
+		t.Error("decoding a short frame must fail")
+	}
+	for _, params := range []map[string]string{
+		{"type": "int12", "count": "2"},
+		{"type": "uint8", "count": "0"},
+		{"type": "uint16", "count": "2", "stride": "1"},
+		{"type": "uint32", "count": "17"},
+	} {
+		if _, err := newConverter(ConverterConfig{Mode: "array", Params: params}); err == nil {
+			t.Errorf("params %v must be rejected", params)
+		}
+	}
+}
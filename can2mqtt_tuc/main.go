@@ -2,48 +2,202 @@
 package main
 
 import (
-	"fmt" // printfoo
-	"os"  // args
+	"context"   // stop the bridge
+	"fmt"       // printfoo
+	"log"       // fatal errors
+	"os"        // args
+	"os/signal" // SIGINT / SIGTERM
+	"strconv"   // parse qos
+	"syscall"   // signal numbers
+	"time"      // watch interval
 
 	C2M "github.com/Schollie1000/can2mqtt_tuc"
 )
 
 // Parses commandline arguments
 func main() {
-	conf := true
-	for i := 1; i < len(os.Args); i++ {
-		switch os.Args[i] {
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		check(os.Args[2:])
+		return
+	}
+	c, set, ok := parseArgs(os.Args[1:])
+	if !ok {
+		return
+	}
+	if C2M.IsYAMLFile(c.MappingFile) {
+		// settings from the config file, the commandline wins
+		fc, err := C2M.LoadConfig(c.MappingFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c = overrideConfig(fc, c, set)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	bridge := C2M.NewBridge(c)
+	// SIGHUP reloads the mapping file
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := bridge.Reload(); err != nil {
+				fmt.Println("reload failed, keeping the old mappings:", err)
+			}
+		}
+	}()
+	if err := bridge.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// parseArgs parses the commandline arguments (without the program
+// name) and returns the settings, the flags that were given and false
+// if only the help was printed
+func parseArgs(args []string) (C2M.Config, map[string]bool, bool) {
+	var c C2M.Config
+	set := make(map[string]bool) // flags given on the commandline
+	for i := 0; i < len(args); i++ {
+		set[args[i]] = true
+		if needsValue[args[i]] && i+1 >= len(args) {
+			usageError(fmt.Sprintf("error: %s needs a value", args[i]))
+		}
+		switch args[i] {
 		case "-v":
-			C2M.SetDbg(true)
+			c.Debug = true
 		case "-c":
 			i++
-			C2M.SetCi(os.Args[i])
+			c.CANInterface = args[i]
 		case "-m":
 			i++
-			C2M.SetCs(os.Args[i])
+			c.MQTTConnect = args[i]
+		case "-e":
+			i++
+			c.ErrorTopic = args[i]
+		case "-s":
+			i++
+			c.StatusTopic = args[i]
 		case "-f":
 			i++
-			C2M.SetC2mf(os.Args[i])
+			c.MappingFile = args[i]
+		case "-w":
+			i++
+			w, err := time.ParseDuration(args[i])
+			if err != nil || w < 0 {
+				usageError(fmt.Sprintf("error: got invalid watch interval (%s), e.g. 5s", args[i]))
+			}
+			c.WatchInterval = w
+		case "-q":
+			i++
+			q, err := strconv.ParseUint(args[i], 10, 8)
+			if err != nil || q > 2 {
+				usageError(fmt.Sprintf("error: got invalid qos (%s). Valid values are 0, 1 and 2", args[i]))
+			}
+			c.QoS = byte(q)
+		case "-r":
+			c.Retain = true
 		case "-d":
 			i++
-			C2M.SetConfDirMode(os.Args[i])
+			d, err := C2M.ParseDirMode(args[i])
+			if err != nil {
+				usageError(err.Error())
+			}
+			c.DirMode = d
+		case "-o":
+			i++
+			o, err := C2M.ParseOverflowPolicy(args[i])
+			if err != nil {
+				usageError(err.Error())
+			}
+			c.Overflow = o
 		default:
-			i = len(os.Args)
-			conf = false
 			printHelp()
+			return c, set, false
 		}
 	}
-	if conf {
-		C2M.Start()
+	return c, set, true
+}
+
+// overrideConfig returns the settings fc of a config file with the
+// ones of the commandline c, set tells which flags were given
+func overrideConfig(fc, c C2M.Config, set map[string]bool) C2M.Config {
+	fc.Debug = fc.Debug || c.Debug
+	if set["-c"] {
+		fc.CANInterface = c.CANInterface
+	}
+	if set["-e"] {
+		fc.ErrorTopic = c.ErrorTopic
+	}
+	if set["-s"] {
+		fc.StatusTopic = c.StatusTopic
 	}
+	if set["-m"] {
+		fc.MQTTConnect = c.MQTTConnect
+	}
+	if set["-d"] {
+		fc.DirMode = c.DirMode
+	}
+	if set["-q"] {
+		fc.QoS = c.QoS
+	}
+	fc.Retain = fc.Retain || c.Retain
+	if set["-w"] {
+		fc.WatchInterval = c.WatchInterval
+	}
+	if set["-o"] {
+		fc.Overflow = c.Overflow
+	}
+	return fc
+}
+
+// check validates a mapping file without starting the bridge:
+// can2mqtt check -f <file>
+func check(args []string) {
+	file := "can2mqtt.csv"
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-f":
+			i++
+			if i >= len(args) {
+				usageError("error: -f needs a value")
+			}
+			file = args[i]
+		default:
+			printHelp()
+			os.Exit(2)
+		}
+	}
+	if err := C2M.CheckMappingFile(file); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: ok\n", file)
+}
+
+// flags that are followed by a value
+var needsValue = map[string]bool{"-c": true, "-m": true, "-e": true, "-s": true, "-f": true, "-w": true, "-q": true, "-d": true, "-o": true}
+
+// usageError prints what is wrong with the commandline and the usage,
+// then exits
+func usageError(msg string) {
+	fmt.Println(msg)
+	printHelp()
+	os.Exit(2)
 }
 
 // help function (obvious...)
 func printHelp() {
 	fmt.Printf("Test Drillbotics ")
 	fmt.Printf("welcome to the CAN2MQTT Drillbotics edit bridge!\n\n")
-	fmt.Printf("Usage: can2mqtt [-f <file>] [-c <CAN-Interface>] [-m <MQTT-Connect>] [-v] [-h]\n")
-	fmt.Printf("<file>: a can2mqtt.csv file\n")
+	fmt.Printf("Usage: can2mqtt [-f <file>] [-c <CAN-Interface>] [-m <MQTT-Connect>] [-e <error-topic>] [-s <status-topic>] [-d <dirMode>] [-q <qos>] [-r] [-w <interval>] [-o <overflow>] [-v] [-h]\n")
+	fmt.Printf("       can2mqtt check [-f <file>]\n")
+	fmt.Printf("<file>: a can2mqtt.csv file, a YAML config file (*.yaml, *.yml) or a DBC file (*.dbc)\n")
 	fmt.Printf("<CAN-Interface>: a CAN-Interface e.g. can0\n")
 	fmt.Printf("<MQTT-Connect>: connectstring for MQTT. e.g.: tcp://[user:pass@]localhost:1883\n")
+	fmt.Printf("<error-topic>: frames that can't be converted are reported on this topic\n")
+	fmt.Printf("<status-topic>: the state of the CAN-Interface (up or down) is published retained on this topic\n")
+	fmt.Printf("<dirMode>: 0 (bidirectional, default), 1 (can2mqtt only) or 2 (mqtt2can only)\n")
+	fmt.Printf("<qos>: MQTT QoS 0 (default), 1 or 2 for mappings without own qos, -r retains their messages\n")
+	fmt.Printf("<interval>: reload <file> when it changed, checked every <interval> e.g. 5s\n")
+	fmt.Printf("<overflow>: when MQTT is slower than the bus: block (default, stop reading the bus), drop-newest or drop-oldest\n")
+	fmt.Printf("The mappings of <file> are also reloaded on SIGHUP.\n")
 }
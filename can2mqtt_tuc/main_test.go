@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	C2M "github.com/Schollie1000/can2mqtt_tuc"
+)
+
+// the flags given on the commandline win over the config file, even
+// with the default value, the others keep the value of the file
+func TestOverrideConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "can2mqtt.yaml")
+	err := os.WriteFile(file, []byte(`
+can: {interface: vcan1}
+mqtt: {connect: "tcp://broker:1883", error_topic: test/errors, status_topic: test/status, qos: 2}
+pipeline: {overflow: drop-oldest}
+direction: can2mqtt
+watch: 5s
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, set, ok := parseArgs([]string{"-f", file, "-c", "vcan9", "-q", "0", "-d", "both", "-s", "test/link", "-r", "-v"})
+	if !ok {
+		t.Fatal("the flags weren't accepted")
+	}
+	fc, err := C2M.LoadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := overrideConfig(fc, c, set)
+	want := C2M.Config{
+		Debug:         true,
+		CANInterface:  "vcan9",
+		MQTTConnect:   "tcp://broker:1883",
+		ErrorTopic:    "test/errors",
+		StatusTopic:   "test/link",
+		MappingFile:   file,
+		DirMode:       C2M.DirBidirectional,
+		QoS:           0,
+		Retain:        true,
+		WatchInterval: 5 * time.Second,
+		Overflow:      C2M.OverflowDropOldest,
+	}
+	if got != want {
+		t.Errorf("got %+v,\nwant %+v", got, want)
+	}
+
+	// without flags everything comes from the file
+	c, set, _ = parseArgs([]string{"-f", file})
+	if got := overrideConfig(fc, c, set); got != fc {
+		t.Errorf("got %+v,\nwant %+v", got, fc)
+	}
+}
@@ -0,0 +1,237 @@
+package can2mqtt_tuc
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// CANBackend is the CAN side of a Bridge. The bridge subscribes its
+// frame handler once, then calls Open, Listen and Close for every Run,
+// so a backend has to be reusable after Close. If Listen fails while
+// the bridge runs, it calls Close and tries Open until the bus is back.
+type CANBackend interface {
+	// Open connects to the bus.
+	Open() error
+	// Subscribe registers a handler that is called for every received frame.
+	Subscribe(handler func(Frame))
+	// Listen reads frames and hands them to the subscribed handlers. It
+	// blocks until the backend is closed or reading from the bus fails.
+	Listen() error
+	// Publish sends a frame to the bus.
+	Publish(frame Frame) error
+	// Close disconnects from the bus and makes Listen return.
+	Close() error
+}
+
+// ErrCANClosed is returned by backends that are used while not open.
+var ErrCANClosed = errors.New("canbackend: bus is not open")
+
+//######################################################################
+//#				SOCKETCAN			       #
+//######################################################################
+
+// SocketCAN is the CANBackend for a SocketCAN interface like can0 or
+// vcan0 (Linux only). It receives classic and CAN FD frames, CAN FD
+// frames are sent if the interface is in CAN FD mode.
+type SocketCAN struct {
+	iface    string
+	handlers []func(Frame)
+	mu       sync.Mutex // protects sock, it changes when the interface is reopened
+	sock     *canSocket
+}
+
+// NewSocketCAN returns a backend for the SocketCAN interface with the
+// given name.
+func NewSocketCAN(iface string) *SocketCAN {
+	return &SocketCAN{iface: iface}
+}
+
+// Open opens the SocketCAN interface.
+func (s *SocketCAN) Open() error {
+	sock, err := openCANSocket(s.iface)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.sock = sock
+	s.mu.Unlock()
+	return nil
+}
+
+// Subscribe registers a frame handler.
+func (s *SocketCAN) Subscribe(handler func(Frame)) {
+	s.handlers = append(s.handlers, handler)
+}
+
+// Listen reads frames from the interface until it is closed. An
+// interface that goes down or disappears (e.g. an unplugged USB
+// adapter) makes it return the error of the socket.
+func (s *SocketCAN) Listen() error {
+	s.mu.Lock()
+	sock := s.sock
+	s.mu.Unlock()
+	if sock == nil {
+		return ErrCANClosed
+	}
+	for {
+		var frame Frame
+		err := sock.readFrame(&frame)
+		if err == io.EOF {
+			return nil // closed
+		}
+		if err != nil {
+			return err
+		}
+		for _, h := range s.handlers {
+			h(frame)
+		}
+	}
+}
+
+// Publish writes a frame to the interface.
+func (s *SocketCAN) Publish(frame Frame) error {
+	s.mu.Lock()
+	sock := s.sock
+	s.mu.Unlock()
+	if sock == nil {
+		return ErrCANClosed
+	}
+	return sock.writeFrame(frame)
+}
+
+// Close closes the interface.
+func (s *SocketCAN) Close() error {
+	s.mu.Lock()
+	sock := s.sock
+	s.sock = nil
+	s.mu.Unlock()
+	if sock == nil {
+		return nil
+	}
+	return sock.close()
+}
+
+//######################################################################
+//#				VIRTUAL BUS			       #
+//######################################################################
+
+// VirtualBus is an in-process CAN bus. Every frame published by one of
+// its nodes is received by all other open nodes, just like on a real
+// bus. It allows running bridges in tests or on machines without vcan.
+// It carries classic and CAN FD frames.
+type VirtualBus struct {
+	mu    sync.Mutex
+	nodes []*virtualNode
+}
+
+// NewVirtualBus returns an empty virtual bus.
+func NewVirtualBus() *VirtualBus {
+	return &VirtualBus{}
+}
+
+// Node returns a new CANBackend connected to the virtual bus.
+func (v *VirtualBus) Node() CANBackend {
+	n := &virtualNode{bus: v}
+	v.mu.Lock()
+	v.nodes = append(v.nodes, n)
+	v.mu.Unlock()
+	return n
+}
+
+// deliver hands a frame to every open node except the sender
+func (v *VirtualBus) deliver(from *virtualNode, frame Frame) {
+	v.mu.Lock()
+	nodes := make([]*virtualNode, len(v.nodes))
+	copy(nodes, v.nodes)
+	v.mu.Unlock()
+	for _, n := range nodes {
+		if n != from {
+			n.receive(frame)
+		}
+	}
+}
+
+// virtualNode is one participant of a VirtualBus
+type virtualNode struct {
+	bus      *VirtualBus
+	mu       sync.Mutex
+	handlers []func(Frame)
+	frames   chan Frame
+	closed   chan struct{}
+}
+
+func (n *virtualNode) Open() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.frames = make(chan Frame, 64)
+	n.closed = make(chan struct{})
+	return nil
+}
+
+func (n *virtualNode) Subscribe(handler func(Frame)) {
+	n.mu.Lock()
+	n.handlers = append(n.handlers, handler)
+	n.mu.Unlock()
+}
+
+func (n *virtualNode) Listen() error {
+	n.mu.Lock()
+	frames, closed := n.frames, n.closed
+	n.mu.Unlock()
+	if frames == nil {
+		return ErrCANClosed
+	}
+	for {
+		select {
+		case <-closed:
+			return nil
+		case frame := <-frames:
+			n.mu.Lock()
+			handlers := n.handlers
+			n.mu.Unlock()
+			for _, h := range handlers {
+				h(frame)
+			}
+		}
+	}
+}
+
+func (n *virtualNode) Publish(frame Frame) error {
+	n.mu.Lock()
+	open := n.frames != nil
+	n.mu.Unlock()
+	if !open {
+		return ErrCANClosed
+	}
+	if err := frame.check(); err != nil {
+		return err
+	}
+	n.bus.deliver(n, frame)
+	return nil
+}
+
+// receive queues a frame for Listen, frames for closed nodes are lost
+// like on a real bus
+func (n *virtualNode) receive(frame Frame) {
+	n.mu.Lock()
+	frames, closed := n.frames, n.closed
+	n.mu.Unlock()
+	if frames == nil {
+		return
+	}
+	select {
+	case frames <- frame:
+	case <-closed:
+	}
+}
+
+func (n *virtualNode) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.frames != nil {
+		close(n.closed)
+		n.frames = nil
+	}
+	return nil
+}
@@ -3,85 +3,190 @@
 package can2mqtt_tuc
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
-	"sync"
-)
+	"sync/atomic"
+	"syscall"
+	"time"
 
-var csi []uint32       // subscribed IDs slice
-var csiLock sync.Mutex // CAN subscribed IDs Mutex
-var bus *can.Bus       // CAN-Bus pointer
+	"github.com/brutella/can"
+)
 
-// initializes the CANBus Interface and enters an infinite
-// loop that reads CAN-frames after that.
-func canStart(canInterface string) {
+// backoff of reopening a failed CAN-Bus interface and of retrying a
+// frame that couldn't be sent, vars for the tests
+var (
+	canReopenMin = 500 * time.Millisecond
+	canReopenMax = 30 * time.Second
+	canStable    = 10 * time.Second // an interface that worked this long starts again at canReopenMin
+	canSendTries = 5
+	canSendWait  = 2 * time.Millisecond // doubled after every try
+)
 
-	var err error
-	if dbg {
+// initializes the CANBus Interface. Reading CAN-frames is
+// started by Run after that. An interface that can't be opened is
+// reported as down, canListen opens it as soon as it is there.
+func (b *Bridge) canStart(canInterface string) bool {
+	if b.conf.Debug {
 		fmt.Printf("canbushandler: initializing CAN-Bus interface %s\n", canInterface)
 	}
-	bus, err = can.NewBusForInterfaceWithName(canInterface)
-	if err != nil {
-		if dbg {
-			fmt.Printf("canbushandler: error while activating CAN-Bus interface: %s\n", canInterface)
+	if err := b.bus.Open(); err != nil {
+		b.canDown(err)
+		return false
+	}
+	b.canUp()
+	return true
+}
+
+// canListen reads frames until ctx is cancelled. When reading fails,
+// e.g. because the USB-CAN adapter was unplugged, the interface is
+// closed and reopened with growing pauses until it is back. The pause
+// only starts small again after the interface worked: it received a
+// frame or didn't fail for canStable. An interface that fails right
+// after every open is not reopened every canReopenMin.
+func (b *Bridge) canListen(ctx context.Context, up bool) {
+	wait := canReopenMin
+	grow := func() {
+		if wait *= 2; wait > canReopenMax {
+			wait = canReopenMax
 		}
-		log.Fatal(err)
 	}
-	bus.SubscribeFunc(handleCANFrame)
-	err = bus.ConnectAndPublish()
-	if err != nil {
-		if dbg {
-			fmt.Printf("canbushandler: error while activating CAN-Bus interface: %s\n", canInterface)
+	for {
+		if up {
+			opened, frames := time.Now(), b.link.received()
+			canErr := make(chan error, 1)
+			go func() {
+				canErr <- b.bus.Listen() // epic parallel shit ;-)
+			}()
+			select {
+			case <-ctx.Done():
+				return // canStop ends the read loop
+			case err := <-canErr:
+				if err == nil {
+					err = ErrCANClosed
+				}
+				b.canStop()
+				b.canDown(err)
+				up = false
+				if time.Since(opened) >= canStable || b.link.received() != frames {
+					wait = canReopenMin
+				} else {
+					grow()
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
 		}
-		log.Fatal(err)
+		if err := b.bus.Open(); err != nil {
+			if b.conf.Debug {
+				fmt.Printf("canbushandler: CAN-Bus interface %s still not available: %s\n", b.conf.CANInterface, err)
+			}
+			grow()
+			continue
+		}
+		b.canUp()
+		up = true
 	}
 }
 
-func handleCANFrame(frame can.Frame) {
-	frame.ID &= 0x1FFFFFFF // discard flags, we are only interested in the ID
-	var idSub = false      // indicates, whether the id was subscribed or not
-	for _, i := range csi {
-		if i == frame.ID {
-			if dbg {
-				fmt.Printf("canbushandler: ID %d is in subscribed list, calling receivehadler.\n", frame.ID)
-			}
-			go handleCAN(frame)
-			idSub = true
-			break
-		}
+// closes the CANBus Interface, this also ends the read loop
+func (b *Bridge) canStop() {
+	if err := b.bus.Close(); err != nil && b.conf.Debug {
+		fmt.Printf("canbushandler: error while closing CAN-Bus interface %s: %s\n", b.conf.CANInterface, err)
+	}
+}
+
+func (b *Bridge) handleCANFrame(frame Frame) {
+	atomic.AddUint64(&b.link.frames, 1)
+	if frame.ID&can.MaskErr != 0 {
+		return // error frames are no data
+	}
+	frame.ID = frameIDOf(frame)        // discard RTR flag, standard and extended IDs are different IDs
+	idSub := b.canSubscribed(frame.ID) // indicates, whether the id was subscribed or not
+	if b.isotpFrame(frame, idSub) {
+		return
 	}
-	if !idSub {
-		if dbg {
-			fmt.Printf("canbushandler: ID:%d was not subscribed. /dev/nulled that frame...\n", frame.ID)
+	if idSub {
+		if b.conf.Debug {
+			fmt.Printf("canbushandler: ID %d is in subscribed list, calling receivehadler.\n", frame.ID&can.MaskIDEff)
+		}
+		if !b.work.submit(frame.ID, func() { b.handleCAN(frame) }) && b.conf.Debug {
+			fmt.Printf("canbushandler: queue of ID %d is full, frame dropped\n", frame.ID&can.MaskIDEff)
+		}
+	} else {
+		if b.conf.Debug {
+			fmt.Printf("canbushandler: ID:%d was not subscribed. /dev/nulled that frame...\n", frame.ID&can.MaskIDEff)
 		}
 	}
 }
 
-// Unsubscribe a CAN-ID
-func canSubscribe(id uint32) {
-	csiLock.Lock()
-	csi = append(csi, id)
-	csiLock.Unlock()
-	if dbg {
-		fmt.Printf("canbushandler: mutex lock+unlock successful. subscribed to ID:%d\n", id)
+// canSubscribed tells whether frames with the frame ID id are mapped
+func (b *Bridge) canSubscribed(id uint32) bool {
+	b.csiLock.RLock()
+	defer b.csiLock.RUnlock()
+	return b.csi[id] > 0
+}
+
+// Subscribe a CAN-ID, id is a frame ID (see frameID). The mappings of
+// a multiplexed frame subscribe its ID once each.
+func (b *Bridge) canSubscribe(id uint32) {
+	b.csiLock.Lock()
+	if b.csi == nil {
+		b.csi = make(map[uint32]int)
+	}
+	b.csi[id]++
+	b.csiLock.Unlock()
+	if b.conf.Debug {
+		fmt.Printf("canbushandler: mutex lock+unlock successful. subscribed to ID:%d\n", id&can.MaskIDEff)
 	}
 }
 
-// expects a CANFrame and sends it
-func canPublish(frame can.Frame) {
-	if dbg {
-		fmt.Println("canbushandler: sending CAN-Frame: ", frame)
+// Unsubscribe a CAN-ID, id is a frame ID (see frameID)
+func (b *Bridge) canUnsubscribe(id uint32) {
+	b.csiLock.Lock()
+	if b.csi[id] > 1 {
+		b.csi[id]--
+	} else {
+		delete(b.csi, id)
 	}
-	// Check if ID is using more than 11-Bits:
-	if frame.ID >= 0x800 {
-		// if so, enable extended frame format
-		frame.ID |= 0x80000000
+	b.csiLock.Unlock()
+	if b.conf.Debug {
+		fmt.Printf("canbushandler: mutex lock+unlock successful. unsubscribed ID:%d\n", id&can.MaskIDEff)
 	}
-	err := bus.Publish(frame)
-	if err != nil {
-		if dbg {
-			fmt.Printf("canbushandler: error while transmitting the CAN-Frame.\n")
+}
+
+// expects a CANFrame and sends it, the frame format is taken from
+// the extended frame format flag of the ID (see frameID). A full
+// transmit queue is retried a few times, other errors are returned.
+func (b *Bridge) canPublish(frame Frame) error {
+	if b.conf.Debug {
+		fmt.Println("canbushandler: sending CAN-Frame: ", frame)
+	}
+	wait := canSendWait
+	for try := 1; ; try++ {
+		err := b.bus.Publish(frame)
+		if err == nil {
+			return nil
 		}
-		log.Fatal(err)
+		if !transientCANError(err) || try == canSendTries {
+			if b.conf.Debug {
+				fmt.Printf("canbushandler: error while transmitting the CAN-Frame: %s\n", err)
+			}
+			if errors.Is(err, ErrCANClosed) || !b.CANLinkUp() {
+				return fmt.Errorf("canbushandler: CAN-Bus interface %s is down", b.conf.CANInterface)
+			}
+			return fmt.Errorf("canbushandler: error while transmitting the CAN-Frame: %w", err)
+		}
+		time.Sleep(wait)
+		wait *= 2
 	}
 }
+
+// transientCANError tells whether sending a frame may work if it is
+// tried again a bit later
+func transientCANError(err error) bool {
+	return errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR)
+}
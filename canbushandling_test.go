@@ -0,0 +1,257 @@
+package can2mqtt_tuc
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fastReopen shortens the backoff of reopening the interface
+func fastReopen(t *testing.T, min, max time.Duration) {
+	t.Helper()
+	oldMin, oldMax, oldStable := canReopenMin, canReopenMax, canStable
+	canReopenMin, canReopenMax, canStable = min, max, time.Hour
+	t.Cleanup(func() { canReopenMin, canReopenMax, canStable = oldMin, oldMax, oldStable })
+}
+
+// flakyNode is a node of a virtual bus that fails on command
+type flakyNode struct {
+	CANBackend
+	mu    sync.Mutex
+	down  error // Open fails with it
+	flap  error // Listen fails with it right after Open
+	opens []time.Time
+	fail  chan error // makes a running Listen fail
+}
+
+func newFlakyNode(vbus *VirtualBus) *flakyNode {
+	return &flakyNode{CANBackend: vbus.Node(), fail: make(chan error)}
+}
+
+func (n *flakyNode) set(down, flap error) {
+	n.mu.Lock()
+	n.down, n.flap = down, flap
+	n.mu.Unlock()
+}
+
+func (n *flakyNode) Open() error {
+	n.mu.Lock()
+	n.opens = append(n.opens, time.Now())
+	down := n.down
+	n.mu.Unlock()
+	if down != nil {
+		return down
+	}
+	return n.CANBackend.Open()
+}
+
+func (n *flakyNode) Listen() error {
+	n.mu.Lock()
+	flap := n.flap
+	n.mu.Unlock()
+	if flap != nil {
+		return flap
+	}
+	done := make(chan error, 1)
+	go func() { done <- n.CANBackend.Listen() }()
+	select {
+	case err := <-done:
+		return err
+	case err := <-n.fail:
+		n.CANBackend.Close()
+		<-done
+		return err
+	}
+}
+
+// openTimes returns when the interface was opened so far
+func (n *flakyNode) openTimes() []time.Time {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]time.Time(nil), n.opens...)
+}
+
+// waitOpens waits until the interface was opened count times
+func (n *flakyNode) waitOpens(t *testing.T, count int) []time.Time {
+	t.Helper()
+	for deadline := time.Now().Add(testTimeout); ; time.Sleep(time.Millisecond) {
+		if opens := n.openTimes(); len(opens) >= count {
+			return opens
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the interface wasn't opened %d times", count)
+		}
+	}
+}
+
+// waitStatus waits until the last message on the status topic has the
+// given state and returns it
+func (f *fakeClient) waitStatus(t *testing.T, state string) linkStatus {
+	t.Helper()
+	var ls linkStatus
+	f.waitFor(t, "status "+state, func() bool {
+		for i := len(f.pubs) - 1; i >= 0; i-- {
+			if f.pubs[i].topic == "test/status" {
+				if !f.pubs[i].retained {
+					t.Error("status message is not retained")
+				}
+				ls = linkStatus{}
+				return json.Unmarshal(f.pubs[i].payload, &ls) == nil && ls.State == state
+			}
+		}
+		return false
+	})
+	return ls
+}
+
+func linkBridge(t *testing.T, node *flakyNode) *fakeClient {
+	t.Helper()
+	file := writeFile(t, "can2mqtt.csv", "0x100,uint162ascii,test/speed\n")
+	_, client := startBridge(t, Config{MappingFile: file, CANBackend: node,
+		StatusTopic: "test/status", ErrorTopic: "test/errors"})
+	client.waitSubscribed(t, "test/speed")
+	return client
+}
+
+func TestCANLinkLossAndReopen(t *testing.T) {
+	fastReopen(t, 10*time.Millisecond, 40*time.Millisecond)
+	vbus := NewVirtualBus()
+	board := newTestNode(t, vbus)
+	node := newFlakyNode(vbus)
+	client := linkBridge(t, node)
+	if ls := client.waitStatus(t, "up"); ls.Interface != "can0" || ls.Since == "" {
+		t.Errorf("status %+v", ls)
+	}
+
+	// unplugged: reading fails and it can't be opened again
+	node.set(errors.New("no such device"), nil)
+	node.fail <- errors.New("network is down")
+	if ls := client.waitStatus(t, "down"); ls.Reason != "network is down" {
+		t.Errorf("status %+v, want the reason network is down", ls)
+	}
+	client.deliver(t, "test/speed", "1")
+	client.waitError(t, 1, "is down")
+
+	// reopened with growing pauses up to canReopenMax
+	opens := node.waitOpens(t, 5)
+	for i := 2; i < len(opens); i++ {
+		gap := opens[i].Sub(opens[i-1])
+		if gap < canReopenMin || (i >= 3 && gap < canReopenMax) {
+			t.Errorf("reopened %s after the last try", gap)
+		}
+	}
+	if got := len(node.openTimes()); got > 12 {
+		t.Errorf("opened %d times within %s", got, time.Since(opens[0]))
+	}
+
+	// plugged in again
+	node.set(nil, nil)
+	client.waitStatus(t, "up")
+	if err := board.Publish(Frame{ID: 0x100, Length: 2, Data: [64]byte{0x34, 0x12}}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := client.waitPublished(t, "test/speed", 1); string(msg.payload) != "4660" {
+		t.Errorf("published %q after the interface is back", msg.payload)
+	}
+}
+
+// an interface that opens, but fails right away (e.g. it is down) is
+// not reopened every canReopenMin, once it works the pauses are short
+// again
+func TestCANLinkFlapBackoff(t *testing.T) {
+	fastReopen(t, 10*time.Millisecond, 200*time.Millisecond)
+	vbus := NewVirtualBus()
+	board := newTestNode(t, vbus)
+	node := newFlakyNode(vbus)
+	node.set(nil, errors.New("network is down"))
+	client := linkBridge(t, node)
+
+	time.Sleep(400 * time.Millisecond) // 0, 20, 60, 140, 300ms with backoff
+	if n := len(node.openTimes()); n < 3 || n > 8 {
+		t.Errorf("opened %d times within 400ms, want about 5", n)
+	}
+
+	node.set(nil, nil)
+	client.waitStatus(t, "up")
+	if err := board.Publish(Frame{ID: 0x100, Length: 2, Data: [64]byte{0x34, 0x12}}); err != nil {
+		t.Fatal(err)
+	}
+	client.waitPublished(t, "test/speed", 1)
+	opened := len(node.openTimes())
+	failed := time.Now()
+	node.fail <- errors.New("network is down")
+	opens := node.waitOpens(t, opened+1)
+	if gap := opens[opened].Sub(failed); gap >= canReopenMax/2 {
+		t.Errorf("reopened %s after a failure of a working interface, want about %s", gap, canReopenMin)
+	}
+	client.waitStatus(t, "up")
+}
+
+// sendNode fails sending with the given errors, one per try
+type sendNode struct {
+	CANBackend
+	errs  []error
+	tries int
+}
+
+func (n *sendNode) Publish(frame Frame) error {
+	n.tries++
+	if len(n.errs) > 0 {
+		err := n.errs[0]
+		n.errs = n.errs[1:]
+		return err
+	}
+	return n.CANBackend.Publish(frame)
+}
+
+func TestCANPublishRetry(t *testing.T) {
+	repeat := func(err error, n int) []error {
+		errs := make([]error, n)
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	tests := []struct {
+		name   string
+		errs   []error
+		tries  int
+		reason string // "": sent
+	}{
+		{"full queue", repeat(syscall.ENOBUFS, 3), 4, ""},
+		{"interrupted", []error{syscall.EINTR, syscall.EAGAIN}, 3, ""},
+		{"full queue for too long", repeat(syscall.ENOBUFS, 10), canSendTries, "no buffer space available"},
+		{"invalid frame", []error{syscall.EINVAL}, 1, "error while transmitting"},
+		{"closed", []error{ErrCANClosed}, 1, "is down"},
+	}
+	for _, tt := range tests {
+		vbus := NewVirtualBus()
+		board := newTestNode(t, vbus)
+		node := &sendNode{CANBackend: vbus.Node(), errs: tt.errs}
+		b := NewBridge(Config{CANBackend: node})
+		if err := node.Open(); err != nil {
+			t.Fatal(err)
+		}
+		b.canUp()
+		err := b.canPublish(Frame{ID: 0x100, Length: 1, Data: [64]byte{42}})
+		switch {
+		case tt.reason == "" && err != nil:
+			t.Errorf("%s: %s", tt.name, err)
+		case tt.reason != "" && (err == nil || !strings.Contains(err.Error(), tt.reason)):
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.reason)
+		}
+		if node.tries != tt.tries {
+			t.Errorf("%s: tried %d times, want %d", tt.name, node.tries, tt.tries)
+		}
+		if tt.reason == "" {
+			if f := board.next(t); f.Data[0] != 42 {
+				t.Errorf("%s: sent %s", tt.name, f)
+			}
+		}
+		node.Close()
+	}
+}
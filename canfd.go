@@ -0,0 +1,155 @@
+package can2mqtt_tuc
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/brutella/can"
+)
+
+// Frame is a CAN-frame as it is passed between the bridge and its
+// CANBackend. Classic frames carry up to 8 data bytes, CAN FD frames
+// (Flags has FrameFD) up to 64. The ID has the flags of can.MaskEff,
+// can.MaskRtr and can.MaskErr, just like the frames of SocketCAN.
+type Frame struct {
+	ID     uint32
+	Length uint8 // number of data bytes, not the DLC code
+	Flags  uint8 // FrameFD, FrameBRS, FrameESI
+	Data   [64]byte
+}
+
+// Flags of a Frame, the values are the ones of struct canfd_frame of
+// SocketCAN.
+const (
+	FrameBRS = 0x01 // bit rate switch: data bytes sent with the data bit rate
+	FrameESI = 0x02 // error state indicator of the transmitting node
+	FrameFD  = 0x04 // CAN FD frame
+)
+
+// the data lengths of the DLC codes 0 to 15 of CAN FD frames, classic
+// frames have 8 bytes for the codes 9 to 15
+var fdLengths = [16]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 12, 16, 20, 24, 32, 48, 64}
+
+// DLCToLength returns the number of data bytes of a DLC code.
+func DLCToLength(dlc uint8, fd bool) int {
+	dlc &= 0x0F
+	if !fd && dlc > 8 {
+		return 8
+	}
+	return fdLengths[dlc]
+}
+
+// LengthToDLC returns the smallest DLC code for n data bytes. Frames
+// with a length between the lengths of CAN FD (e.g. 10) are padded up
+// to the next one (12).
+func LengthToDLC(n int) uint8 {
+	for dlc, l := range fdLengths {
+		if l >= n {
+			return uint8(dlc)
+		}
+	}
+	return 15
+}
+
+// validLength tells whether a frame may have n data bytes
+func validLength(n int, fd bool) bool {
+	if !fd {
+		return n >= 0 && n <= 8
+	}
+	return n >= 0 && n <= 64 && fdLengths[LengthToDLC(n)] == n
+}
+
+// IsFD tells whether f is a CAN FD frame.
+func (f Frame) IsFD() bool {
+	return f.Flags&FrameFD != 0
+}
+
+// DLC returns the DLC code of the frame.
+func (f Frame) DLC() uint8 {
+	return LengthToDLC(int(f.Length))
+}
+
+// Payload returns the data bytes of the frame.
+func (f *Frame) Payload() []byte {
+	if int(f.Length) > len(f.Data) {
+		return f.Data[:]
+	}
+	return f.Data[:f.Length]
+}
+
+// check returns an error for frames no bus can carry
+func (f Frame) check() error {
+	if !validLength(int(f.Length), f.IsFD()) {
+		if f.IsFD() {
+			return fmt.Errorf("canbackend: invalid length %d of a CAN FD frame", f.Length)
+		}
+		return fmt.Errorf("canbackend: invalid length %d of a CAN-frame", f.Length)
+	}
+	if !f.IsFD() && f.Flags&(FrameBRS|FrameESI) != 0 {
+		return fmt.Errorf("canbackend: BRS and ESI are only used with CAN FD frames")
+	}
+	return nil
+}
+
+func (f Frame) String() string {
+	var flags []string
+	if f.IsFD() {
+		flags = append(flags, "FD")
+	}
+	if f.Flags&FrameBRS != 0 {
+		flags = append(flags, "BRS")
+	}
+	if f.Flags&FrameESI != 0 {
+		flags = append(flags, "ESI")
+	}
+	if f.ID&can.MaskEff != 0 {
+		flags = append(flags, "EFF")
+	}
+	if f.ID&can.MaskRtr != 0 {
+		flags = append(flags, "RTR")
+	}
+	s := fmt.Sprintf("ID: %d [%d] %X", f.ID&can.MaskIDEff, f.Length, f.Payload())
+	if len(flags) > 0 {
+		s += " (" + strings.Join(flags, " ") + ")"
+	}
+	return s
+}
+
+// frameOf builds the frame of a mapping with the given data bytes.
+// CAN FD frames are padded with zeros up to the next valid length.
+func (c2mp *can2mqtt) frameOf(data []byte) (Frame, error) {
+	if !c2mp.fd && len(data) > 8 {
+		return Frame{}, fmt.Errorf("%d data bytes don't fit into a CAN-frame, use fd for CAN FD frames", len(data))
+	}
+	if len(data) > 64 {
+		return Frame{}, fmt.Errorf("%d data bytes don't fit into a CAN FD frame", len(data))
+	}
+	f := Frame{ID: c2mp.frameID(), Length: uint8(len(data))}
+	copy(f.Data[:], data)
+	if c2mp.fd {
+		f.Flags = FrameFD
+		if c2mp.brs {
+			f.Flags |= FrameBRS
+		}
+		f.Length = uint8(fdLengths[LengthToDLC(len(data))])
+	}
+	return f, nil
+}
+
+// sizer is implemented by converters whose frames have a fixed number
+// of data bytes
+type sizer interface {
+	dataLength() int
+}
+
+// resolveFD makes sure that the frames of a classic mapping have at
+// most 8 data bytes
+func resolveFD(c2mp *can2mqtt) error {
+	if c2mp.brs && !c2mp.fd {
+		return fmt.Errorf("brs is only used with fd")
+	}
+	if s, ok := c2mp.conv.(sizer); ok && !c2mp.fd && s.dataLength() > 8 {
+		return fmt.Errorf("convert-mode %s needs %d data bytes, a CAN-frame has 8, use fd for CAN FD frames", c2mp.convMethod, s.dataLength())
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package can2mqtt_tuc
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/brutella/can"
+)
+
+func TestDLC(t *testing.T) {
+	tests := []struct {
+		dlc     uint8
+		fd      int // data bytes of a CAN FD frame
+		classic int
+	}{
+		{0, 0, 0}, {1, 1, 1}, {7, 7, 7}, {8, 8, 8},
+		{9, 12, 8}, {10, 16, 8}, {11, 20, 8}, {12, 24, 8},
+		{13, 32, 8}, {14, 48, 8}, {15, 64, 8},
+	}
+	for _, tt := range tests {
+		if n := DLCToLength(tt.dlc, true); n != tt.fd {
+			t.Errorf("DLC %d of CAN FD: %d bytes, want %d", tt.dlc, n, tt.fd)
+		}
+		if n := DLCToLength(tt.dlc, false); n != tt.classic {
+			t.Errorf("DLC %d of classic CAN: %d bytes, want %d", tt.dlc, n, tt.classic)
+		}
+		if dlc := LengthToDLC(tt.fd); dlc != tt.dlc {
+			t.Errorf("%d bytes: DLC %d, want %d", tt.fd, dlc, tt.dlc)
+		}
+	}
+	// in between lengths take the next DLC
+	for n, dlc := range map[int]uint8{9: 9, 10: 9, 13: 10, 21: 12, 25: 13, 33: 14, 49: 15} {
+		if got := LengthToDLC(n); got != dlc {
+			t.Errorf("%d bytes: DLC %d, want %d", n, got, dlc)
+		}
+	}
+}
+
+func TestValidLength(t *testing.T) {
+	tests := []struct {
+		n           int
+		classic, fd bool
+	}{
+		{0, true, true}, {8, true, true}, {9, false, false}, {12, false, true},
+		{20, false, true}, {30, false, false}, {48, false, true}, {64, false, true},
+		{65, false, false}, {-1, false, false},
+	}
+	for _, tt := range tests {
+		if got := validLength(tt.n, false); got != tt.classic {
+			t.Errorf("%d bytes of classic CAN: %t, want %t", tt.n, got, tt.classic)
+		}
+		if got := validLength(tt.n, true); got != tt.fd {
+			t.Errorf("%d bytes of CAN FD: %t, want %t", tt.n, got, tt.fd)
+		}
+	}
+}
+
+func TestFrameOf(t *testing.T) {
+	tests := []struct {
+		c2mp   can2mqtt
+		data   int // number of data bytes 1, 2, ...
+		length uint8
+		flags  uint8
+		reason string // "": no error
+	}{
+		{can2mqtt{canId: 0x100}, 3, 3, 0, ""},
+		{can2mqtt{canId: 0x100}, 8, 8, 0, ""},
+		{can2mqtt{canId: 0x100}, 9, 0, 0, "use fd for CAN FD frames"},
+		{can2mqtt{canId: 0x100, fd: true}, 3, 3, FrameFD, ""},
+		{can2mqtt{canId: 0x100, fd: true}, 9, 12, FrameFD, ""},
+		{can2mqtt{canId: 0x100, fd: true, brs: true}, 17, 20, FrameFD | FrameBRS, ""},
+		{can2mqtt{canId: 0x100, fd: true}, 33, 48, FrameFD, ""},
+		{can2mqtt{canId: 0x100, fd: true}, 64, 64, FrameFD, ""},
+		{can2mqtt{canId: 0x100, fd: true}, 65, 0, 0, "don't fit into a CAN FD frame"},
+		{can2mqtt{canId: 0x12345, extended: true, fd: true}, 10, 12, FrameFD, ""},
+	}
+	for _, tt := range tests {
+		data := make([]byte, tt.data)
+		for i := range data {
+			data[i] = byte(i + 1)
+		}
+		f, err := tt.c2mp.frameOf(data)
+		if tt.reason != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.reason) {
+				t.Errorf("%d bytes: got error %v, want %q", tt.data, err, tt.reason)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d bytes: %s", tt.data, err)
+			continue
+		}
+		if f.Length != tt.length || f.Flags != tt.flags {
+			t.Errorf("%d bytes: %s, want %d bytes with flags %d", tt.data, f, tt.length, tt.flags)
+		}
+		// the data followed by the zeros of the padding
+		want := append(data, make([]byte, int(tt.length)-tt.data)...)
+		if !bytes.Equal(f.Payload(), want) {
+			t.Errorf("%d bytes: sent % X, want % X", tt.data, f.Payload(), want)
+		}
+		if f.ID != tt.c2mp.frameID() || (tt.c2mp.extended && f.ID&can.MaskEff == 0) {
+			t.Errorf("%d bytes: ID %X", tt.data, f.ID)
+		}
+		if err := f.check(); err != nil {
+			t.Errorf("%d bytes: %s", tt.data, err)
+		}
+	}
+}
+
+func TestFrameCheck(t *testing.T) {
+	tests := []struct {
+		f      Frame
+		reason string
+	}{
+		{Frame{Length: 8}, ""},
+		{Frame{Length: 12}, "invalid length 12 of a CAN-frame"},
+		{Frame{Length: 12, Flags: FrameFD}, ""},
+		{Frame{Length: 13, Flags: FrameFD}, "invalid length 13 of a CAN FD frame"},
+		{Frame{Length: 8, Flags: FrameBRS}, "only used with CAN FD frames"},
+		{Frame{Length: 8, Flags: FrameFD | FrameBRS | FrameESI}, ""},
+	}
+	for _, tt := range tests {
+		err := tt.f.check()
+		if (tt.reason == "" && err != nil) || (tt.reason != "" && (err == nil || !strings.Contains(err.Error(), tt.reason))) {
+			t.Errorf("%s: got error %v, want %q", tt.f, err, tt.reason)
+		}
+	}
+}
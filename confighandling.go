@@ -0,0 +1,373 @@
+package can2mqtt_tuc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/brutella/can"
+	"gopkg.in/yaml.v3"
+)
+
+// configFile is the layout of a YAML configuration file. It holds the
+// bridge settings and the list of mappings, which replaces the lines
+// of a can2mqtt.csv.
+type configFile struct {
+	Debug bool `yaml:"debug"`
+	CAN   struct {
+		Interface string `yaml:"interface"`
+	} `yaml:"can"`
+	MQTT struct {
+		Connect  string `yaml:"connect"`
+		ClientID string `yaml:"client_id"`
+		Errors   string `yaml:"error_topic"`
+		Status   string `yaml:"status_topic"`
+		QoS      byte   `yaml:"qos"`    // default of the mappings
+		Retain   bool   `yaml:"retain"` // default of the mappings
+	} `yaml:"mqtt"`
+	Pipeline struct {
+		Workers  int    `yaml:"workers"`
+		Queue    int    `yaml:"queue"`    // frames per worker
+		Overflow string `yaml:"overflow"` // block, drop-newest or drop-oldest
+	} `yaml:"pipeline"`
+	Direction string          `yaml:"direction"`
+	Watch     string          `yaml:"watch"`
+	Mappings  []mappingConfig `yaml:"mappings"`
+	DBC       []dbcConfig     `yaml:"dbc"`
+}
+
+// dbcConfig imports the messages of a DBC file as mappings. The file
+// is relative to the configuration file.
+type dbcConfig struct {
+	File        string   `yaml:"file"`
+	TopicPrefix string   `yaml:"topic_prefix"`
+	Format      string   `yaml:"format"` // text (default) or json
+	Writable    []string `yaml:"writable"`
+}
+
+// mappingConfig is one entry of the mappings list in a YAML
+// configuration file.
+type mappingConfig struct {
+	ID          string            `yaml:"id"`
+	Mode        string            `yaml:"mode"`
+	Topic       string            `yaml:"topic"`
+	Topics      []string          `yaml:"topics"`
+	CmdTopic    string            `yaml:"command_topic"`
+	Direction   string            `yaml:"direction"`
+	QoS         *byte             `yaml:"qos"`
+	Retain      *bool             `yaml:"retain"`
+	Extended    *bool             `yaml:"extended"`
+	FD          bool              `yaml:"fd"`
+	BRS         bool              `yaml:"brs"`
+	Description string            `yaml:"description"`
+	Unit        string            `yaml:"unit"`
+	Scale       *float64          `yaml:"scale"`
+	Offset      *float64          `yaml:"offset"`
+	Precision   *int              `yaml:"precision"`
+	Values      map[int64]string  `yaml:"values"` // raw value -> label
+	Flags       map[int]string    `yaml:"flags"`  // bit -> name
+	Params      map[string]string `yaml:"params"`
+	Fields      []Field           `yaml:"fields"`
+	Format      string            `yaml:"format"`
+	Names       []string          `yaml:"names"`
+	Multiplexer *Field            `yaml:"multiplexer"`
+	Multiplexed []muxConfig       `yaml:"multiplexed"`
+	ISOTP       *isotpConfig      `yaml:"isotp"`
+
+	line int // line of the mapping in the file
+}
+
+// UnmarshalYAML remembers the line of a mapping for error messages.
+func (mc *mappingConfig) UnmarshalYAML(node *yaml.Node) error {
+	type plain mappingConfig // without this method
+	if err := checkKeys(node, reflect.TypeOf(plain{})); err != nil {
+		return err
+	}
+	if err := node.Decode((*plain)(mc)); err != nil {
+		return err
+	}
+	mc.line = node.Line
+	return nil
+}
+
+// checkKeys makes sure that every key of a YAML mapping is a field of
+// the struct type t, so that a typo like retian: isn't ignored. The
+// decoder of readConfigFile does this itself, but not for the nodes
+// handed to UnmarshalYAML.
+func checkKeys(node *yaml.Node, t reflect.Type) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case node.Kind == yaml.AliasNode:
+		return checkKeys(node.Alias, t)
+	case node.Kind == yaml.SequenceNode && t.Kind() == reflect.Slice:
+		for _, n := range node.Content {
+			if err := checkKeys(n, t.Elem()); err != nil {
+				return err
+			}
+		}
+	case node.Kind == yaml.MappingNode && t.Kind() == reflect.Struct:
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			if name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ","); name != "" {
+				fields[name] = t.Field(i).Type
+			}
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			ft, ok := fields[key.Value]
+			if !ok {
+				// like the errors of the decoder, with the line
+				return &yaml.TypeError{Errors: []string{fmt.Sprintf("line %d: field %s not found in type %s", key.Line, key.Value, t)}}
+			}
+			if err := checkKeys(node.Content[i+1], ft); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// IsYAMLFile decides by the file extension whether a mapping file is
+// a YAML configuration file (*.yaml, *.yml) or a can2mqtt.csv
+func IsYAMLFile(filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// readConfigFile opens and parses a YAML configuration file
+func readConfigFile(filename string) (*configFile, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var cf configFile
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cf); err != nil && err != io.EOF { // EOF: empty file
+		return nil, fmt.Errorf("config: %s: %w", filename, err)
+	}
+	return &cf, nil
+}
+
+// LoadConfig reads the bridge settings of a YAML configuration file.
+// The file itself becomes the MappingFile of the returned Config, so
+// its mappings are loaded when the bridge is started.
+func LoadConfig(filename string) (Config, error) {
+	conf := Config{MappingFile: filename}
+	cf, err := readConfigFile(filename)
+	if err != nil {
+		return conf, err
+	}
+	if err := cf.settings(&conf); err != nil {
+		return conf, fmt.Errorf("config: %s: %w", filename, err)
+	}
+	return conf, nil
+}
+
+// settings copies the bridge settings of the file into conf
+func (cf *configFile) settings(conf *Config) error {
+	var err error
+	conf.Debug = cf.Debug
+	conf.CANInterface = cf.CAN.Interface
+	conf.MQTTConnect = cf.MQTT.Connect
+	conf.MQTTClientID = cf.MQTT.ClientID
+	conf.ErrorTopic = cf.MQTT.Errors
+	conf.StatusTopic = cf.MQTT.Status
+	if cf.MQTT.QoS > 2 {
+		return fmt.Errorf("invalid qos %d, valid values are 0, 1 and 2", cf.MQTT.QoS)
+	}
+	conf.QoS = cf.MQTT.QoS
+	conf.Retain = cf.MQTT.Retain
+	if cf.Direction != "" {
+		if conf.DirMode, err = ParseDirMode(cf.Direction); err != nil {
+			return err
+		}
+	}
+	if cf.Pipeline.Workers < 0 || cf.Pipeline.Queue < 0 {
+		return fmt.Errorf("workers and queue of the pipeline can't be negative")
+	}
+	conf.Workers = cf.Pipeline.Workers
+	conf.QueueSize = cf.Pipeline.Queue
+	if cf.Pipeline.Overflow != "" {
+		if conf.Overflow, err = ParseOverflowPolicy(cf.Pipeline.Overflow); err != nil {
+			return err
+		}
+	}
+	if cf.Watch != "" {
+		if conf.WatchInterval, err = time.ParseDuration(cf.Watch); err != nil {
+			return fmt.Errorf("invalid watch interval: %w", err)
+		}
+	}
+	return nil
+}
+
+// unknownKey matches the error of the decoder for a key that isn't
+// part of the configuration file
+var unknownKey = regexp.MustCompile(`^field (\S+) not found in type `)
+
+// readMappingsFromYAML extracts the mappings of a YAML configuration
+// file, mappings with problems are skipped
+func readMappingsFromYAML(filename string, ps *problems) []*can2mqtt {
+	cf, err := readConfigFile(filename)
+	var terr *yaml.TypeError
+	if errors.As(err, &terr) {
+		// wrong types and unknown keys, each with its line
+		for _, e := range terr.Errors {
+			line, msg := 0, e
+			if _, err := fmt.Sscanf(e, "line %d:", &line); err == nil {
+				_, msg, _ = strings.Cut(e, ": ")
+			}
+			if m := unknownKey.FindStringSubmatch(msg); m != nil {
+				msg = fmt.Sprintf("unknown key %q", m[1])
+			}
+			ps.add(filename, line, "%s", msg)
+		}
+		return nil
+	}
+	if err != nil {
+		ps.add(filename, 0, "%s", err)
+		return nil
+	}
+	var pairs []*can2mqtt
+	for _, mc := range cf.Mappings {
+		pairs = append(pairs, mc.toPairs(filename, ps)...)
+	}
+	for _, dc := range cf.DBC {
+		file := dc.File
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(filename), file)
+		}
+		if dc.Format != "" && dc.Format != formatText && dc.Format != formatJSON {
+			ps.add(filename, 0, "dbc %s: invalid format %q, valid formats are text and json", dc.File, dc.Format)
+		}
+		pairs = append(pairs, dbcMappings(file, dc.TopicPrefix, dc.Format, dc.Writable, ps)...)
+	}
+	return pairs
+}
+
+// toPair converts a mapping of the configuration file into the
+// internal representation. All problems of the mapping are added to
+// ps. nil is returned if the mapping has no usable ID or topic,
+// otherwise it is returned for the checks of validateMappings.
+func (mc mappingConfig) toPair(file string, ps *problems) *can2mqtt {
+	usable := true
+	topics := mc.Topics
+	if mc.Topic != "" {
+		topics = append([]string{mc.Topic}, topics...)
+	}
+	if fieldTopics := countFieldTopics(mc.Fields); fieldTopics > 0 {
+		// the fields bring their own topics
+		if fieldTopics < len(mc.Fields) {
+			ps.add(file, mc.line, "either all fields or none of them need a topic")
+		} else if len(topics) > 0 {
+			ps.add(file, mc.line, "topic and topics can't be used together with topics of the fields")
+		}
+		topics = nil
+		for _, f := range mc.Fields {
+			if f.Topic != "" {
+				topics = append(topics, f.Topic)
+			}
+		}
+	}
+	id, err := parseCANID(mc.ID)
+	if err != nil {
+		ps.add(file, mc.line, "%s", err)
+		usable = false
+	}
+	// without explicit format IDs above 11 bit are extended
+	extended := id > can.MaskIDSff
+	if mc.Extended != nil {
+		extended = *mc.Extended
+	}
+	if len(topics) == 0 {
+		ps.add(file, mc.line, "no MQTT-topic given for ID %s", mc.ID)
+		usable = false
+	}
+	mode := mc.Mode
+	if mode == "" && len(mc.Fields) > 0 {
+		mode = "layout"
+	} else if mode == "" {
+		mode = "none"
+	}
+	dir := DirBidirectional
+	if mc.Direction != "" {
+		if dir, err = ParseDirMode(mc.Direction); err != nil {
+			ps.add(file, mc.line, "%s", err)
+		}
+	}
+	format := formatText
+	switch mc.Format {
+	case "", formatText:
+	case formatJSON:
+		format = formatJSON
+	default:
+		ps.add(file, mc.line, "invalid format %q, valid formats are text and json", mc.Format)
+	}
+	if len(mc.Names) > 0 && format != formatJSON {
+		ps.add(file, mc.line, "names are only used with format json")
+	}
+	scaled, err := newScaling(mc.Scale, mc.Offset, mc.Precision)
+	if err != nil {
+		ps.add(file, mc.line, "%s", err)
+	}
+	table, err := newValueTable(mc.Values, mc.Flags)
+	if err != nil {
+		ps.add(file, mc.line, "%s", err)
+	}
+	tp, err := mc.ISOTP.toISOTP(extended)
+	if err != nil {
+		ps.add(file, mc.line, "%s", err)
+	}
+	if tp != nil && mc.FD {
+		ps.add(file, mc.line, "isotp is only supported with classic CAN-frames")
+	}
+	if mc.QoS != nil && *mc.QoS > 2 {
+		ps.add(file, mc.line, "invalid qos %d, valid values are 0, 1 and 2", *mc.QoS)
+	}
+	if !usable {
+		return nil
+	}
+	return &can2mqtt{
+		canId:       int(id),
+		convMethod:  mode,
+		mqttTopic:   topics,
+		cmdTopic:    mc.CmdTopic,
+		direction:   dir,
+		qos:         mc.QoS,
+		retain:      mc.Retain,
+		extended:    extended,
+		fd:          mc.FD,
+		brs:         mc.BRS,
+		description: mc.Description,
+		unit:        mc.Unit,
+		scaling:     scaled,
+		table:       table,
+		isotp:       tp,
+		params:      mc.Params,
+		fields:      mc.Fields,
+		format:      format,
+		names:       mc.Names,
+		file:        file,
+		line:        mc.line,
+	}
+}
+
+// countFieldTopics returns how many fields of a layout have a topic
+func countFieldTopics(fields []Field) int {
+	n := 0
+	for _, f := range fields {
+		if f.Topic != "" {
+			n++
+		}
+	}
+	return n
+}
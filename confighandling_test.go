@@ -0,0 +1,87 @@
+package can2mqtt_tuc
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	file := writeFile(t, "can2mqtt.yaml", `
+debug: true
+can:
+  interface: vcan1
+mqtt:
+  connect: tcp://broker:1883
+  client_id: bridge1
+  error_topic: test/errors
+  status_topic: test/status
+  qos: 2
+  retain: true
+pipeline:
+  workers: 2
+  queue: 16
+  overflow: drop-oldest
+direction: can2mqtt
+watch: 5s
+mappings:
+  - {id: 0x100, mode: uint82ascii, topic: test/a}
+`)
+	conf, err := LoadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Config{
+		Debug:         true,
+		CANInterface:  "vcan1",
+		MQTTConnect:   "tcp://broker:1883",
+		MQTTClientID:  "bridge1",
+		ErrorTopic:    "test/errors",
+		StatusTopic:   "test/status",
+		MappingFile:   file,
+		DirMode:       DirCAN2MQTT,
+		QoS:           2,
+		Retain:        true,
+		WatchInterval: 5 * time.Second,
+		Workers:       2,
+		QueueSize:     16,
+		Overflow:      OverflowDropOldest,
+	}
+	if conf != want {
+		t.Errorf("got %+v,\nwant %+v", conf, want)
+	}
+
+	// without settings everything stays at its default
+	file = writeFile(t, "can2mqtt.yaml", "mappings:\n  - {id: 0x100, mode: uint82ascii, topic: test/a}\n")
+	if conf, err = LoadConfig(file); err != nil {
+		t.Fatal(err)
+	} else if want := (Config{MappingFile: file}); conf != want {
+		t.Errorf("got %+v, want %+v", conf, want)
+	}
+}
+
+func TestLoadConfigRejected(t *testing.T) {
+	tests := []struct {
+		settings string
+		reason   string
+	}{
+		{"mqtt: {qos: 3}", "invalid qos 3"},
+		{"mqtt: {qos: high}", "cannot unmarshal !!str `high`"},
+		{"direction: sideways", "got invalid direction (sideways)"},
+		{"direction: 3", "got invalid direction (3)"},
+		{"pipeline: {workers: -1}", "can't be negative"},
+		{"pipeline: {queue: -1}", "can't be negative"},
+		{"pipeline: {overflow: drop}", "got invalid overflow policy (drop)"},
+		{"watch: 5", "invalid watch interval"},
+		{"watch: soon", "invalid watch interval"},
+		{"retian: true", "field retian not found"},
+		{"mqtt: {conect: tcp://broker:1883}", "field conect not found"},
+		{"can: vcan1", "cannot unmarshal"},
+	}
+	for _, tt := range tests {
+		file := writeFile(t, "can2mqtt.yaml", tt.settings+"\n")
+		if _, err := LoadConfig(file); err == nil || !strings.Contains(err.Error(), tt.reason) {
+			t.Errorf("%s: got %v, want %q", tt.settings, err, tt.reason)
+		}
+	}
+}
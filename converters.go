@@ -0,0 +1,267 @@
+package can2mqtt_tuc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Converter converts between the data bytes of a CAN-frame and the
+// values of a mapping, one value per MQTT-topic. Both directions are
+// implemented by the same type, so they can't get out of sync. A
+// Converter is used by several goroutines at once.
+type Converter interface {
+	// Values returns how many values Decode returns and Encode
+	// expects, the mapping needs as many MQTT-topics
+	Values() int
+	// Decode converts the data bytes of a received frame into values
+	Decode(data []byte) ([]string, error)
+	// Encode converts values received from MQTT into the data bytes
+	// of a frame
+	Encode(values []string) ([]byte, error)
+}
+
+// NamedConverter is a Converter whose values have names. Their MQTT
+// payloads may set single values by name, e.g. "speed=100 torque=5".
+// Values that are not given are passed to Encode as empty strings.
+type NamedConverter interface {
+	Converter
+	Names() []string
+}
+
+// ConverterConfig describes the mapping a Converter is created for.
+type ConverterConfig struct {
+	Mode   string            // convert-mode of the mapping
+	Topics []string          // MQTT-topics of the mapping
+	Params map[string]string // params of the mapping (YAML only)
+	Fields []Field           // fields of the mapping (YAML only)
+}
+
+// ConverterFactory creates the Converter of a mapping. It is called
+// once for each mapping when the mapping file is loaded, an error
+// marks the mapping as invalid.
+type ConverterFactory func(conf ConverterConfig) (Converter, error)
+
+var (
+	converters     = make(map[string]ConverterFactory) // convert-mode -> factory
+	convertersLock sync.RWMutex
+)
+
+// RegisterConverter makes a convert-mode available to all mapping
+// files. Register your own modes before the bridge loads its
+// mappings. The names of existing modes can't be registered again.
+func RegisterConverter(mode string, factory ConverterFactory) error {
+	convertersLock.Lock()
+	defer convertersLock.Unlock()
+	if mode == "" || factory == nil {
+		return fmt.Errorf("convertfunctions: convert-mode needs a name and a factory")
+	}
+	if _, ok := converters[mode]; ok {
+		return fmt.Errorf("convertfunctions: convert-mode %s is already registered", mode)
+	}
+	converters[mode] = factory
+	return nil
+}
+
+// ConvertModes returns the names of all registered convert-modes.
+func ConvertModes() []string {
+	convertersLock.RLock()
+	defer convertersLock.RUnlock()
+	modes := make([]string, 0, len(converters))
+	for mode := range converters {
+		modes = append(modes, mode)
+	}
+	sort.Strings(modes)
+	return modes
+}
+
+// newConverter creates the Converter for a mapping
+func newConverter(conf ConverterConfig) (Converter, error) {
+	convertersLock.RLock()
+	factory, ok := converters[conf.Mode]
+	convertersLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown convert-mode %q", conf.Mode)
+	}
+	conv, err := factory(conf)
+	if err != nil {
+		return nil, fmt.Errorf("convert-mode %s: %w", conf.Mode, err)
+	}
+	return conv, nil
+}
+
+// resolveConverters creates the converters of the mappings once, so
+// handling a frame or message is only a call of the mapping's
+// Converter. DBC mappings already have one.
+func resolveConverters(pairs []*can2mqtt, ps *problems) {
+	for _, c2mp := range pairs {
+		if c2mp.conv == nil {
+			conv, err := newConverter(ConverterConfig{
+				Mode:   c2mp.convMethod,
+				Topics: c2mp.mqttTopic,
+				Params: c2mp.params,
+				Fields: c2mp.fields,
+			})
+			if err != nil {
+				ps.add(c2mp.file, c2mp.line, "%s", err)
+				continue
+			}
+			c2mp.conv = conv
+		}
+		if err := resolveScaling(c2mp); err != nil {
+			ps.add(c2mp.file, c2mp.line, "%s", err)
+		}
+		if err := resolveValueTable(c2mp); err != nil {
+			ps.add(c2mp.file, c2mp.line, "%s", err)
+		}
+		if err := resolveMux(c2mp); err != nil {
+			ps.add(c2mp.file, c2mp.line, "%s", err)
+		}
+		if err := resolveFD(c2mp); err != nil {
+			ps.add(c2mp.file, c2mp.line, "%s", err)
+		}
+		if c2mp.format == formatJSON {
+			if err := resolveNames(c2mp); err != nil {
+				ps.add(c2mp.file, c2mp.line, "%s", err)
+			}
+			if len(c2mp.mqttTopic) != 1 {
+				ps.add(c2mp.file, c2mp.line, "format json publishes all values to one topic, got %d", len(c2mp.mqttTopic))
+			}
+		} else if n := c2mp.conv.Values(); n != len(c2mp.mqttTopic) {
+			ps.add(c2mp.file, c2mp.line, "convert-mode %s needs %d topic(s), got %d", c2mp.convMethod, n, len(c2mp.mqttTopic))
+		}
+	}
+}
+
+// payloadValues splits a MQTT payload into the values of the
+// converter: the whole payload for one value, otherwise values
+// separated by spaces or, for a NamedConverter, name=value pairs
+func payloadValues(conv Converter, payload string) ([]string, error) {
+	n := conv.Values()
+	fields := strings.Fields(payload)
+	if named, ok := conv.(NamedConverter); ok && len(fields) > 0 && strings.Contains(fields[0], "=") {
+		names := named.Names()
+		values := make([]string, n)
+		for _, f := range fields {
+			name, value, found := strings.Cut(f, "=")
+			if !found {
+				return nil, fmt.Errorf("expected name=value, got %q", f)
+			}
+			i := indexOf(names, name)
+			if i < 0 {
+				return nil, fmt.Errorf("unknown value %s, valid names are %s", name, strings.Join(names, ", "))
+			}
+			values[i] = value
+		}
+		return values, nil
+	}
+	if n == 1 {
+		return []string{payload}, nil
+	}
+	if len(fields) != n {
+		return nil, fmt.Errorf("expected %d values separated by spaces, got %d", n, len(fields))
+	}
+	return fields, nil
+}
+
+func indexOf(list []string, s string) int {
+	for i, e := range list {
+		if e == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// funcConverter is a Converter made of two functions, used for the
+// built-in convert-modes
+type funcConverter struct {
+	values int
+	size   int              // minimum number of data bytes Decode needs
+	order  binary.ByteOrder // nil if the mode has no byte order
+	decode func(data []byte, order binary.ByteOrder) ([]string, error)
+	encode func(values []string, order binary.ByteOrder) ([]byte, error)
+	kind   numberKind // whether the values can be scaled
+}
+
+func (c *funcConverter) numbers() numberKind { return c.kind }
+
+func (c *funcConverter) Values() int { return c.values }
+
+func (c *funcConverter) Decode(data []byte) ([]string, error) {
+	if len(data) < c.size {
+		return nil, fmt.Errorf("frame has %d data bytes, %d needed", len(data), c.size)
+	}
+	return c.decode(data, c.order)
+}
+
+func (c *funcConverter) Encode(values []string) ([]byte, error) {
+	if len(values) != c.values {
+		return nil, fmt.Errorf("expected %d values, got %d", c.values, len(values))
+	}
+	return c.encode(values, c.order)
+}
+
+// builtin registers a built-in convert-mode. Its only parameter is
+// endian, which overrides the default byte order.
+func builtin(mode string, values, size int, order binary.ByteOrder,
+	decode func([]byte, binary.ByteOrder) ([]string, error), encode func([]string, binary.ByteOrder) ([]byte, error)) {
+	proto := funcConverter{values: values, size: size, order: order, decode: decode, encode: encode, kind: numberKinds[mode]}
+	err := RegisterConverter(mode, func(conf ConverterConfig) (Converter, error) {
+		conv := proto
+		if endian, ok := conf.Params["endian"]; ok {
+			if order == nil {
+				return nil, fmt.Errorf("has no byte order, endian can't be used")
+			}
+			var err error
+			if conv.order, err = parseByteOrder(endian); err != nil {
+				return nil, err
+			}
+		}
+		return &conv, nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// parseByteOrder parses the param endian
+func parseByteOrder(s string) (binary.ByteOrder, error) {
+	switch s {
+	case "little":
+		return binary.LittleEndian, nil
+	case "big":
+		return binary.BigEndian, nil
+	}
+	return nil, fmt.Errorf("invalid endian %q, valid values are little and big", s)
+}
+
+// dbcConverter encodes and decodes the signals of a DBC message
+type dbcConverter struct {
+	msg *dbcMessage
+}
+
+func (c *dbcConverter) Values() int { return len(c.msg.signals) }
+
+func (c *dbcConverter) dataLength() int { return c.msg.dlc }
+
+func (c *dbcConverter) Names() []string {
+	names := make([]string, len(c.msg.signals))
+	for i, sig := range c.msg.signals {
+		names[i] = sig.name
+	}
+	return names
+}
+
+func (c *dbcConverter) Decode(data []byte) ([]string, error) {
+	if len(data) < c.msg.dlc {
+		return nil, fmt.Errorf("frame has %d data bytes, DBC message %s has %d", len(data), c.msg.name, c.msg.dlc)
+	}
+	return dbc2ascii(c.msg, data), nil
+}
+
+func (c *dbcConverter) Encode(values []string) ([]byte, error) {
+	return ascii2dbc(c.msg, values)
+}
@@ -0,0 +1,220 @@
+package can2mqtt_tuc
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// every built-in mode with numbers encodes and decodes the same values
+// with both byte orders, and the byte order really changes the frame
+func TestBuiltinByteOrderRoundTrip(t *testing.T) {
+	// the float32 modes publish 5 digits after the decimal point
+	tests := []struct {
+		mode   string
+		values []string
+		bytes1 bool // only one byte per number, endian changes nothing
+	}{
+		{"uint82ascii", []string{"200"}, true},
+		{"int82ascii", []string{"-100"}, true},
+		{"4uint82ascii", []string{"1 2 3 255"}, true},
+		{"8uint82ascii", []string{"0 1 2 3 4 5 6 255"}, true},
+		{"uint162ascii", []string{"4660"}, false},
+		{"int162ascii", []string{"-2"}, false},
+		{"uint322ascii", []string{"305419896"}, false},
+		{"int322ascii", []string{"-305419896"}, false},
+		{"2int322ascii", []string{"-1", "2147483646"}, false},
+		{"uint642ascii", []string{"1311768467463790320"}, false},
+		{"int642ascii", []string{"-2"}, false},
+		{"2uint322ascii", []string{"1 4294967294"}, false},
+		{"float162ascii", []string{"1.5"}, false},
+		{"float2ascii", []string{"-1.50000"}, false},
+		{"float642ascii", []string{"-2.5"}, false},
+		{"2float2ascii", []string{"0.25000", "-3.00000"}, false},
+		{"setup2floats", []string{"1.50000 -2.25000"}, false},
+		{"int32int16", []string{"-70000 1234"}, false},
+		{"setup2motor", []string{"100 -200 300"}, false},
+		{"motor2ascii", []string{"-100", "200", "7"}, false},
+		{"clock2ascii", []string{"12:34"}, false},
+		{"4uint162ascii", []string{"1 513 0 65534"}, false},
+		{"4int162ascii", []string{"-2 256 -32768 32767"}, false},
+	}
+	for _, tt := range tests {
+		orders := []string{"little", "big"}
+		if tt.bytes1 {
+			orders = []string{""} // the default, endian isn't accepted by all of them
+		}
+		frames := make(map[string][]byte)
+		for _, order := range orders {
+			name := tt.mode + " " + order
+			conf := ConverterConfig{Mode: tt.mode}
+			if order != "" {
+				conf.Params = map[string]string{"endian": order}
+			}
+			conv, err := newConverter(conf)
+			if err != nil {
+				t.Errorf("%s: %s", name, err)
+				continue
+			}
+			data, err := conv.Encode(tt.values)
+			if err != nil {
+				t.Errorf("%s: encoding %q: %s", name, tt.values, err)
+				continue
+			}
+			values, err := conv.Decode(data)
+			if err != nil {
+				t.Errorf("%s: decoding % X: %s", name, data, err)
+				continue
+			}
+			if strings.Join(values, "|") != strings.Join(tt.values, "|") {
+				t.Errorf("%s: %q encoded as % X and decoded as %q", name, tt.values, data, values)
+			}
+			frames[order] = data
+		}
+		if !tt.bytes1 && frames["little"] != nil && bytes.Equal(frames["little"], frames["big"]) {
+			t.Errorf("%s: little and big endian are both % X", tt.mode, frames["little"])
+		}
+	}
+}
+
+func TestParseByteOrder(t *testing.T) {
+	for _, s := range []string{"little", "big"} {
+		if _, err := parseByteOrder(s); err != nil {
+			t.Errorf("%s: %s", s, err)
+		}
+	}
+	for _, s := range []string{"", "Big", "network"} {
+		if _, err := parseByteOrder(s); err == nil {
+			t.Errorf("endian %q must be rejected", s)
+		}
+	}
+	if _, err := newConverter(ConverterConfig{Mode: "uint82ascii", Params: map[string]string{"endian": "big"}}); err == nil {
+		t.Error("uint82ascii has no byte order, endian must be rejected")
+	}
+}
+
+// percentConverter is a convert-mode of a user: one byte in percent of
+// the param max
+type percentConverter struct{ max int }
+
+func (c percentConverter) Values() int { return 1 }
+
+func (c percentConverter) Decode(data []byte) ([]string, error) {
+	if len(data) != 1 {
+		return nil, fmt.Errorf("want 1 data byte, got %d", len(data))
+	}
+	return []string{strconv.Itoa(int(data[0]) * 100 / c.max)}, nil
+}
+
+func (c percentConverter) Encode(values []string) ([]byte, error) {
+	p, err := strconv.Atoi(values[0])
+	if err != nil || p < 0 || p > 100 {
+		return nil, fmt.Errorf("%q is not a percentage", values[0])
+	}
+	return []byte{byte(p * c.max / 100)}, nil
+}
+
+// registerPercent registers percentConverter as mode until the test
+// ends and returns the configs it was created with
+func registerPercent(t *testing.T, mode string) *[]ConverterConfig {
+	t.Helper()
+	var confs []ConverterConfig
+	err := RegisterConverter(mode, func(conf ConverterConfig) (Converter, error) {
+		confs = append(confs, conf)
+		max := 255
+		if s, ok := conf.Params["max"]; ok {
+			var err error
+			if max, err = strconv.Atoi(s); err != nil || max < 1 || max > 255 {
+				return nil, fmt.Errorf("invalid max %q", s)
+			}
+		}
+		return percentConverter{max: max}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		convertersLock.Lock()
+		delete(converters, mode)
+		convertersLock.Unlock()
+	})
+	return &confs
+}
+
+func TestRegisterConverter(t *testing.T) {
+	confs := registerPercent(t, "percent")
+	found := false
+	for _, mode := range ConvertModes() {
+		found = found || mode == "percent"
+	}
+	if !found {
+		t.Errorf("percent is missing in %q", ConvertModes())
+	}
+
+	factory := func(ConverterConfig) (Converter, error) { return percentConverter{max: 1}, nil }
+	for _, mode := range []string{"percent", "uint82ascii", "array", "layout"} {
+		if err := RegisterConverter(mode, factory); err == nil {
+			t.Errorf("%s was registered again", mode)
+		}
+	}
+	if err := RegisterConverter("", factory); err == nil {
+		t.Error("a mode without name was registered")
+	}
+	if err := RegisterConverter("nofactory", nil); err == nil {
+		t.Error("a mode without factory was registered")
+	}
+
+	conv, err := newConverter(ConverterConfig{Mode: "percent"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values, err := conv.Decode([]byte{255}); err != nil || len(values) != 1 || values[0] != "100" {
+		t.Errorf("decoded FF as %q, %v", values, err)
+	}
+	if len(*confs) != 1 || (*confs)[0].Mode != "percent" {
+		t.Errorf("factory called with %+v", *confs)
+	}
+}
+
+// a registered mode works in mapping files like a built-in one
+func TestRegisteredConverterInMappingFile(t *testing.T) {
+	confs := registerPercent(t, "percent")
+	tests := []struct {
+		name    string
+		content string
+		topics  []string
+		params  map[string]string
+		data    byte // of 50 percent
+	}{
+		{"can2mqtt.csv", "0x100,percent,test/level\n", []string{"test/level"}, nil, 127},
+		{"can2mqtt.yaml", "mappings:\n  - {id: 0x100, mode: percent, topic: test/level, params: {max: 200}}\n",
+			[]string{"test/level"}, map[string]string{"max": "200"}, 100},
+	}
+	for _, tt := range tests {
+		*confs = nil
+		pairs, err := readMappings(writeFile(t, tt.name, tt.content))
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if len(pairs) != 1 || len(*confs) != 1 {
+			t.Fatalf("%s: %d mappings from %d converters", tt.name, len(pairs), len(*confs))
+		}
+		conf := (*confs)[0]
+		if strings.Join(conf.Topics, " ") != strings.Join(tt.topics, " ") || fmt.Sprint(conf.Params) != fmt.Sprint(tt.params) {
+			t.Errorf("%s: factory called with %+v", tt.name, conf)
+		}
+		data, err := pairs[0].conv.Encode([]string{"50"})
+		if err != nil || len(data) != 1 || data[0] != tt.data {
+			t.Errorf("%s: 50 encoded as % X, %v, want %02X", tt.name, data, err, tt.data)
+		}
+	}
+
+	// params are checked by the factory, the problem has the line
+	_, err := readMappings(writeFile(t, "can2mqtt.yaml",
+		"mappings:\n  - {id: 0x100, mode: percent, topic: test/level, params: {max: 0}}\n"))
+	if err == nil || !strings.Contains(err.Error(), `can2mqtt.yaml:2: convert-mode percent: invalid max "0"`) {
+		t.Errorf("got %v, want the invalid max in line 2", err)
+	}
+}
@@ -3,313 +3,353 @@ package can2mqtt_tuc
 import (
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"math"
 	"strconv"
 	"strings"
 )
 
+// the numbers of the built-in convert-modes, modes that aren't listed
+// publish text and can't be scaled
+var numberKinds = map[string]numberKind{
+	"uint82ascii":   integers,
+	"uint162ascii":  integers,
+	"uint322ascii":  integers,
+	"int322ascii":   integers,
+	"2int322ascii":  integers,
+	"uint642ascii":  integers,
+	"2uint322ascii": integers,
+	"float2ascii":   floats,
+	"2float2ascii":  floats,
+	"setup2floats":  floats,
+	"int32int16":    integers,
+	"setup2motor":   integers,
+	"motor2ascii":   integers,
+}
+
+// the built-in convert-modes, each with the number of values
+// (MQTT-topics), the number of data bytes it reads, the default byte
+// order (nil for modes without numbers of more than one byte) and
+// both directions. The byte order can be changed with the param
+// endian of a mapping.
+func init() {
+	le, be := binary.LittleEndian, binary.BigEndian
+	builtin("none", 1, 0, nil,
+		func(data []byte, _ binary.ByteOrder) ([]string, error) { return []string{string(data)}, nil },
+		func(v []string, _ binary.ByteOrder) ([]byte, error) { return ascii2bytes(v[0]) })
+	builtin("empty", 1, 0, nil,
+		func(data []byte, _ binary.ByteOrder) ([]string, error) { return []string{string(data)}, nil },
+		func(v []string, _ binary.ByteOrder) ([]byte, error) { return make([]byte, 8), nil })
+	builtin("uint82ascii", 1, 1, nil,
+		func(data []byte, _ binary.ByteOrder) ([]string, error) {
+			return decoded().add(uint82ascii(data[0])).values()
+		},
+		func(v []string, _ binary.ByteOrder) ([]byte, error) { return encoded().add(ascii2uint8(v[0])).padded() })
+	builtin("uint162ascii", 1, 2, le,
+		func(data []byte, o binary.ByteOrder) ([]string, error) {
+			return decoded().add(uint162ascii(data[0:2], o)).values()
+		},
+		func(v []string, o binary.ByteOrder) ([]byte, error) {
+			return encoded().add(ascii2uint16(v[0], o)).padded()
+		})
+	builtin("uint322ascii", 1, 4, le,
+		func(data []byte, o binary.ByteOrder) ([]string, error) {
+			return decoded().add(uint322ascii(data[0:4], o)).values()
+		},
+		func(v []string, o binary.ByteOrder) ([]byte, error) {
+			return encoded().add(ascii2uint32(v[0], o)).padded()
+		})
+	builtin("int322ascii", 1, 4, be,
+		func(data []byte, o binary.ByteOrder) ([]string, error) {
+			return decoded().add(int322ascii(data[0:4], o)).values()
+		},
+		func(v []string, o binary.ByteOrder) ([]byte, error) {
+			return encoded().add(ascii2int32(v[0], o)).padded()
+		})
+	builtin("2int322ascii", 2, 8, be,
+		func(data []byte, o binary.ByteOrder) ([]string, error) {
+			return decoded().add(int322ascii(data[0:4], o)).add(int322ascii(data[4:8], o)).values()
+		},
+		func(v []string, o binary.ByteOrder) ([]byte, error) {
+			return encoded().add(ascii2int32(v[0], o)).add(ascii2int32(v[1], o)).bytes()
+		})
+	builtin("uint642ascii", 1, 8, le,
+		func(data []byte, o binary.ByteOrder) ([]string, error) {
+			return decoded().add(uint642ascii(data[0:8], o)).values()
+		},
+		func(v []string, o binary.ByteOrder) ([]byte, error) {
+			return encoded().add(ascii2uint64(v[0], o)).bytes()
+		})
+	builtin("2uint322ascii", 1, 8, le,
+		func(data []byte, o binary.ByteOrder) ([]string, error) {
+			return decoded().add(uint322ascii(data[0:4], o)).add(uint322ascii(data[4:8], o)).joined(" ")
+		},
+		func(v []string, o binary.ByteOrder) ([]byte, error) {
+			nums, err := splitValues(v[0], " ", 2)
+			if err != nil {
+				return nil, err
+			}
+			return encoded().add(ascii2uint32(nums[0], o)).add(ascii2uint32(nums[1], o)).bytes()
+		})
+	builtin("float2ascii", 1, 4, le,
+		func(data []byte, o binary.ByteOrder) ([]string, error) {
+			return decoded().add(dfloat2ascii(data[0:4], o)).values()
+		},
+		func(v []string, o binary.ByteOrder) ([]byte, error) {
+			return encoded().add(ascii2dfloat(v[0], o)).padded()
+		})
+	builtin("2float2ascii", 2, 8, le,
+		func(data []byte, o binary.ByteOrder) ([]string, error) {
+			return decoded().add(dfloat2ascii(data[0:4], o)).add(dfloat2ascii(data[4:8], o)).values()
+		},
+		func(v []string, o binary.ByteOrder) ([]byte, error) {
+			return encoded().add(ascii2dfloat(v[0], o)).add(ascii2dfloat(v[1], o)).bytes()
+		})
+	builtin("setup2floats", 1, 8, le,
+		func(data []byte, o binary.ByteOrder) ([]string, error) {
+			return decoded().add(dfloat2ascii(data[0:4], o)).add(dfloat2ascii(data[4:8], o)).joined(" ")
+		},
+		func(v []string, o binary.ByteOrder) ([]byte, error) {
+			nums, err := splitValues(v[0], " ", 2)
+			if err != nil {
+				return nil, err
+			}
+			return encoded().add(ascii2dfloat(nums[0], o)).add(ascii2dfloat(nums[1], o)).bytes()
+		})
+	builtin("int32int16", 1, 6, be,
+		func(data []byte, o binary.ByteOrder) ([]string, error) {
+			return decoded().add(int322ascii(data[0:4], o)).add(int162ascii(data[4:6], o)).joined(" ")
+		},
+		func(v []string, o binary.ByteOrder) ([]byte, error) {
+			nums, err := splitValues(v[0], " ", 2)
+			if err != nil {
+				return nil, err
+			}
+			return encoded().add(ascii2int32(nums[0], o)).add(ascii2int16(nums[1], o)).padded()
+		})
+	builtin("setup2motor", 1, 6, be,
+		func(data []byte, o binary.ByteOrder) ([]string, error) {
+			return decoded().add(int162ascii(data[0:2], o)).add(int162ascii(data[2:4], o)).add(int162ascii(data[4:6], o)).joined(" ")
+		},
+		func(v []string, o binary.ByteOrder) ([]byte, error) {
+			nums, err := splitValues(v[0], " ", 3)
+			if err != nil {
+				return nil, err
+			}
+			return encoded().add(ascii2int16(nums[0], o)).add(ascii2int16(nums[1], o)).add(ascii2int16(nums[2], o)).padded()
+		})
+	builtin("motor2ascii", 3, 6, le,
+		func(data []byte, o binary.ByteOrder) ([]string, error) {
+			return decoded().add(int162ascii(data[0:2], o)).add(int162ascii(data[2:4], o)).add(uint82ascii(data[5])).values()
+		},
+		func(v []string, o binary.ByteOrder) ([]byte, error) {
+			return encoded().add(ascii2int16(v[0], o)).add(ascii2int16(v[1], o)).add([]byte{0}, nil).add(ascii2uint8(v[2])).padded()
+		})
+	builtin("clock2ascii", 1, 8, le,
+		func(data []byte, o binary.ByteOrder) ([]string, error) {
+			return decoded().add(uint322ascii(data[0:4], o)).add(uint322ascii(data[4:8], o)).joined(":")
+		},
+		func(v []string, o binary.ByteOrder) ([]byte, error) {
+			nums, err := splitValues(v[0], ":", 2)
+			if err != nil {
+				return nil, err
+			}
+			return encoded().add(ascii2uint32(nums[0], o)).add(ascii2uint32(nums[1], o)).bytes()
+		})
+	builtin("pixelbin2ascii", 1, 4, nil,
+		func(data []byte, _ binary.ByteOrder) ([]string, error) {
+			return decoded().add(uint82ascii(data[0])).add(bytecolor2colorcode(data[1:4])).joined(" ")
+		},
+		func(v []string, _ binary.ByteOrder) ([]byte, error) {
+			num_and_color, err := splitValues(v[0], " ", 2)
+			if err != nil {
+				return nil, err
+			}
+			return encoded().add(ascii2uint8(num_and_color[0])).add(colorcode2bytecolor(num_and_color[1])).bytes()
+		})
+	builtin("bytecolor2colorcode", 1, 3, nil,
+		func(data []byte, _ binary.ByteOrder) ([]string, error) {
+			return decoded().add(bytecolor2colorcode(data[0:3])).values()
+		},
+		func(v []string, _ binary.ByteOrder) ([]byte, error) { return colorcode2bytecolor(v[0]) })
+}
+
 // convert2CAN does the following:
-// 1. receive topic and payload
-// 2. use topic to examine corresponding convertmode and CAN-ID
+// 1. receive mapping and payload
+// 2. split the payload into the values of the converter
 // 3. execute conversion
-// 4. build CANFrame
+// 4. build CANFrame (classic or CAN FD)
 // 5. returning the CANFrame
-func convert2CAN(topic, payload string) can.Frame {
-	convertMethod := getConvModeFromTopic(topic)
-	var Id = uint32(getIdFromTopic(topic))
-	var data [8]byte
-	var length uint8
-	if convertMethod == "none" {
-		if dbg {
-			fmt.Printf("convertfunctions: using convertmode none (reverse of %s)\n", convertMethod)
-		}
-		data, len = ascii2bytes(payload)
-	} else if convertMethod == "empty" {
-		if dbg {
-			fmt.Printf("convertfunctions: using convertmode ascii2uint8 (reverse of %s)\n", convertMethod)
-		}
-		data[0] = 0
-		data[1] = 0
-		data[2] = 0
-		data[3] = 0
-		data[4] = 0
-		data[5] = 0
-		data[6] = 0
-		data[7] = 0
-
-		len = 8
-	} else if convertMethod == "uint82ascii" {
-		if dbg {
-			fmt.Printf("convertfunctions: using convertmode ascii2uint8 (reverse of %s)\n", convertMethod)
-		}
-		data[0] = ascii2uint8(payload)
-		len = 8
-	} else if convertMethod == "uint162ascii" {
-		if dbg {
-			fmt.Printf("convertfunctions: using convertmode ascii2uint16(reverse of %s)\n", convertMethod)
-		}
-		tmp := ascii2uint16(payload)
-		data[0] = tmp[0]
-		data[1] = tmp[1]
-		len = 8
-	} else if convertMethod == "uint322ascii" {
-		if dbg {
-			fmt.Printf("convertfunctions: using convertmode ascii2uint32(reverse of %s)\n", convertMethod)
-		}
-		tmp := ascii2uint32(payload)
-		data[0] = tmp[0]
-		data[1] = tmp[1]
-		data[2] = tmp[2]
-		data[3] = tmp[3]
-	} else if convertMethod == "int322ascii" {
-		if dbg {
-			fmt.Printf("convertfunctions: using convertmode ascii2int32(reverse of %s)\n", convertMethod)
-		}
-		tmp := ascii2int32(payload)
-		data[0] = tmp[0]
-		data[1] = tmp[1]
-		data[2] = tmp[2]
-		data[3] = tmp[3]
-		len = 8
-	} else if convertMethod == "uint642ascii" {
-		if dbg {
-			fmt.Printf("convertfunctions: using convertmode ascii2uint64(reverse of %s)\n", convertMethod)
-		}
-		tmp := ascii2uint64(payload)
-		data[0] = tmp[0]
-		data[1] = tmp[1]
-		data[2] = tmp[2]
-		data[3] = tmp[3]
-		data[4] = tmp[4]
-		data[5] = tmp[5]
-		data[6] = tmp[6]
-		data[7] = tmp[7]
-		len = 8
-
-	} else if convertMethod == "setup2floats" {
-		if dbg {
-			fmt.Printf("convertfunctions: using convertmode setup2floats %s)\n", convertMethod)
-		}
-		tmp := setup2floats(payload)
-		data[0] = tmp[0]
-		data[1] = tmp[1]
-		data[2] = tmp[2]
-		data[3] = tmp[3]
-		data[4] = tmp[4]
-		data[5] = tmp[5]
-		data[6] = tmp[6]
-		data[7] = tmp[7]
-		len = 8
-
-	} else if convertMethod == "int32int16" {
-		if dbg {
-			fmt.Printf("convertfunctions: using convertmode int32int16 %s)\n", convertMethod)
-		}
-		nums := strings.Split(payload, " ")
-		tmp := ascii2int32(nums[0])
-		data[0] = tmp[0]
-		data[1] = tmp[1]
-		data[2] = tmp[2]
-		data[3] = tmp[3]
-		tmp = ascii2int16(nums[1])
-		data[4] = tmp[0]
-		data[5] = tmp[1]
-		len = 8
-
-	} else if convertMethod == "setup2motor" {
-		if dbg {
-			fmt.Printf("convertfunctions: using convertmode motor einstellung %s)\n", convertMethod)
-		}
-		nums := strings.Split(payload, " ")
-		tmp := ascii2int16(nums[0])
-		data[0] = tmp[0]
-		data[1] = tmp[1]
-		tmp = ascii2int16(nums[1])
-		data[2] = tmp[0]
-		data[3] = tmp[1]
-		tmp = ascii2int16(nums[2])
-		data[4] = tmp[0]
-		data[5] = tmp[1]
-		len = 8
-
-	} else if convertMethod == "2uint322ascii" {
-		if dbg {
-			fmt.Printf("convertfunctions: using convertmode ascii22uint32(reverse of %s)\n", convertMethod)
-		}
-		nums := strings.Split(payload, " ")
-		tmp := ascii2uint32(nums[0])
-		data[0] = tmp[0]
-		data[1] = tmp[1]
-		data[2] = tmp[2]
-		data[3] = tmp[3]
-		tmp = ascii2uint32(nums[1])
-		data[4] = tmp[0]
-		data[5] = tmp[1]
-		data[6] = tmp[2]
-		data[7] = tmp[3]
-		len = 8
-
-	} else if convertMethod == "float2ascii" {
-		if dbg {
-			fmt.Printf("convertfunctions: using convertmode ascii22uint32(reverse of %s)\n", convertMethod)
-		}
-		//nums := strings.Split(payload, " ")
-		tmp := ascii2dfloat(payload)
-		data[0] = tmp[0]
-		data[1] = tmp[1]
-		data[2] = tmp[2]
-		len = 3
-	} else if convertMethod == "pixelbin2ascii" {
-		if dbg {
-			fmt.Printf("convertfunctions: using convertmode ascii2pixelbin(reverse of %s)\n", convertMethod)
-		}
-		num_and_color := strings.Split(payload, " ")
-		bin_num := ascii2uint8(num_and_color[0])
-		tmp := colorcode2bytecolor(num_and_color[1])
-		data[0] = byte(bin_num)
-		data[1] = tmp[0]
-		data[2] = tmp[1]
-		data[3] = tmp[2]
-		len = 4
+// An error is returned if the payload can not be converted, nothing
+// must be sent in that case.
+func (b *Bridge) convert2CAN(c2mp *can2mqtt, payload string) (Frame, error) {
+	data, err := b.encodePayload(c2mp, payload)
+	if err != nil {
+		return Frame{}, err
+	}
+	myFrame, err := c2mp.frameOf(data)
+	if err != nil {
+		return Frame{}, fmt.Errorf("convertfunctions: %s: %w", c2mp.convMethod, err)
+	}
+	return myFrame, nil
+}
+
+// encodePayload converts a MQTT payload into the data bytes of its
+// mapping, without limiting their length
+func (b *Bridge) encodePayload(c2mp *can2mqtt, payload string) ([]byte, error) {
+	if b.conf.Debug {
+		fmt.Printf("convertfunctions: using convertmode %s (reverse)\n", c2mp.convMethod)
+	}
+	var values []string
+	var err error
+	if c2mp.format == formatJSON {
+		values, err = c2mp.json2values(payload)
 	} else {
-		if dbg {
-			fmt.Printf("convertfunctions: convertmode %s not found. using fallback none\n", convertMethod)
-		}
-		data, length = ascii2bytes(payload)
+		values, err = payloadValues(c2mp.conv, payload)
+	}
+	if err == nil {
+		values, err = c2mp.table.encode(values)
+	}
+	if err == nil {
+		values, err = c2mp.scaling.encode(values)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("convertfunctions: %s: %w", c2mp.convMethod, err)
+	}
+	data, err := c2mp.conv.Encode(values)
+	if err != nil {
+		return nil, fmt.Errorf("convertfunctions: %s: %w", c2mp.convMethod, err)
 	}
-	myFrame := can.Frame{ID: Id, Length: length, Data: data}
-	return myFrame
+	return c2mp.mux.set(data), nil
 }
 
 // convert2MQTT does the following
-// 1. receive ID and payload
-// 2. lookup the correct convertmode
-// 3. executing conversion
-// 4. building a string
-// 5. return
-func convert2MQTT(id int, length int, payload [8]byte) []string {
-	convertMethod := getConvId(id)
-	retstr := []string{}
-
-	if convertMethod == "none" {
-		if dbg {
-			fmt.Printf("convertfunctions: using convertmode none\n")
-		}
-		retstr = append(retstr, bytes2ascii(uint32(length), payload))
-		return retstr
-	} else if convertMethod == "uint82ascii" {
-		if dbg {
-			fmt.Printf("convertfunctions: using convertmode uint82ascii\n")
-		}
-		retstr = append(retstr, uint82ascii(payload[0]))
-		return retstr
-	} else if convertMethod == "uint162ascii" {
-		if dbg {
-			fmt.Printf("convertfunctions: using convertmode uint162ascii\n")
-		}
-		retstr = append(retstr, uint162ascii(payload[0:2]))
-		return retstr
-	} else if convertMethod == "uint322ascii" {
-		if dbg {
-			fmt.Printf("convertfunctions: using convertmode uint322ascii\n")
-		}
-		retstr = append(retstr, uint322ascii(payload[0:4]))
-		return retstr
-	} else if convertMethod == "int322ascii" {
-		if dbg {
-			fmt.Printf("convertfunctions: db int32  \n")
-		}
-		retstr = append(retstr, int322ascii(payload[0:4]))
-		return retstr
-	} else if convertMethod == "2int322ascii" {
-		if dbg {
-			fmt.Printf("convertfunctions: db 2 int32  \n")
-		}
-		retstr = append(retstr, int322ascii(payload[0:4]))
-		retstr = append(retstr, int322ascii(payload[4:8]))
-		return retstr
-	} else if convertMethod == "float2ascii" {
-		if dbg {
-			fmt.Printf("convertfunctions: db float  \n")
-		}
-		retstr = append(retstr, dfloat2ascii(payload[0:4]))
-		return retstr
-	} else if convertMethod == "2float2ascii" {
-		if dbg {
-			fmt.Printf("convertfunctions: db two float  \n")
-		}
-		retstr = append(retstr, dfloat2ascii(payload[0:4]))
-		retstr = append(retstr, dfloat2ascii(payload[4:8]))
-		return retstr
-	} else if convertMethod == "uint642ascii" {
-		if dbg {
-			fmt.Printf("convertfunctions: using convertmode uint642ascii\n")
-		}
-		retstr = append(retstr, uint642ascii(payload[0:8]))
-		return retstr
-	} else if convertMethod == "2uint322ascii" {
-		if dbg {
-			fmt.Printf("convertfunctions: using convertmode 2uint322ascii\n")
-		}
-		retstr = append(retstr, uint322ascii(payload[0:4])+" "+uint322ascii(payload[4:8]))
-		return retstr
-	} else if convertMethod == "clock2ascii" {
-		if dbg {
-			fmt.Printf("convertfunctions: Clock pulse\n")
-		}
-		retstr = append(retstr, uint322ascii(payload[0:4])+":"+uint322ascii(payload[4:8]))
-		return retstr
-	} else if convertMethod == "motor2ascii" {
-		if dbg {
-			fmt.Printf("convertfunctions: motor msg pulk \n")
-		}
-		retstr = append(retstr, int162ascii(payload[0:2]))
-		retstr = append(retstr, int162ascii(payload[2:4]))
-		retstr = append(retstr, uint82ascii(payload[5]))
-		return retstr
-	} else if convertMethod == "setup2motor" {
-		if dbg {
-			fmt.Printf("convertfunctions: using convertmode setup2motor\n")
-		}
-		retstr = append(retstr, int162ascii(payload[0:2])+" "+int162ascii(payload[2:4])+" "+int162ascii(payload[4:6]))
-		return retstr
-	} else if convertMethod == "pixelbin2ascii" {
-		if dbg {
-			fmt.Printf("convertfunctions: using convertmode pixelbin2ascii\n")
-		}
-		retstr = append(retstr, uint82ascii(payload[0])+" "+bytecolor2colorcode(payload[1:4]))
-		return retstr
-	} else if convertMethod == "bytecolor2colorcode" {
-		if dbg {
-			fmt.Printf("convertfunctions: using convertmode bytecolor2colorcode\n")
+// 1. receive mapping and data bytes
+// 2. executing conversion
+// 3. return one string per MQTT-topic
+// The error of a frame that can't be converted says why.
+func (b *Bridge) convert2MQTT(c2mp *can2mqtt, data []byte) ([]string, error) {
+	if b.conf.Debug {
+		fmt.Printf("convertfunctions: using convertmode %s\n", c2mp.convMethod)
+	}
+	values, err := c2mp.conv.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != c2mp.conv.Values() {
+		return nil, fmt.Errorf("converter returned %d values instead of %d", len(values), c2mp.conv.Values())
+	}
+	if values, err = c2mp.table.decode(values); err != nil {
+		return nil, err
+	}
+	if values, err = c2mp.scaling.decode(values); err != nil {
+		return nil, err
+	}
+	if c2mp.format == formatJSON {
+		obj, err := c2mp.values2json(values)
+		if err != nil {
+			return nil, err
 		}
-		retstr = append(retstr, bytecolor2colorcode(payload[0:2]))
-		return retstr
+		return []string{obj}, nil
+	}
+	return values, nil
+}
+
+// decodeResult collects the results of the decode helpers, the
+// first error wins
+type decodeResult struct {
+	list []string
+	err  error
+}
+
+func decoded() *decodeResult { return &decodeResult{} }
+
+func (d *decodeResult) add(s string, err error) *decodeResult {
+	if d.err == nil {
+		d.err = err
+	}
+	d.list = append(d.list, s)
+	return d
+}
+
+// values returns one value per helper
+func (d *decodeResult) values() ([]string, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	return d.list, nil
+}
+
+// joined returns the results of the helpers as one value
+func (d *decodeResult) joined(sep string) ([]string, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	return []string{strings.Join(d.list, sep)}, nil
+}
+
+// splitValues splits a payload that carries several numbers, there
+// have to be exactly n of them
+func splitValues(payload, sep string, n int) ([]string, error) {
+	var nums []string
+	if sep == " " {
+		nums = strings.Fields(payload)
 	} else {
-		if dbg {
-			fmt.Printf("convertfunctions: convertmode %s not found. using fallback none\n", convertMethod)
-		}
-		retstr = append(retstr, bytes2ascii(uint32(length), payload))
-		return retstr
+		nums = strings.Split(payload, sep)
+	}
+	if len(nums) != n {
+		return nil, fmt.Errorf("expected %d numbers separated by %q, got %d", n, sep, len(nums))
 	}
+	return nums, nil
 }
 
-//######################################################################
-//#				NONE				       #
-//######################################################################
+// encodeResult collects the bytes of the encode helpers, the first
+// error wins
+type encodeResult struct {
+	data []byte
+	err  error
+}
+
+func encoded() *encodeResult { return &encodeResult{} }
+
+func (e *encodeResult) add(data []byte, err error) *encodeResult {
+	if e.err == nil {
+		e.err = err
+	}
+	e.data = append(e.data, data...)
+	return e
+}
 
-func bytes2ascii(length uint32, payload [8]byte) string {
-	return string(payload[:length])
+func (e *encodeResult) bytes() ([]byte, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	return e.data, nil
 }
 
-func ascii2bytes(payload string) ([8]byte, uint8) {
-	var returner [8]byte
-	var i uint8 = 0
-	for ; int(i) < len(payload) && i < 8; i++ {
-		returner[i] = payload[i]
+// padded returns the bytes filled up to 8 bytes
+func (e *encodeResult) padded() ([]byte, error) {
+	if e.err != nil {
+		return nil, e.err
 	}
-	return returner, i
+	return pad8(e.data), nil
+}
+
+// pad8 fills up data bytes to the 8 bytes of a CAN-frame
+func pad8(data []byte) []byte {
+	a := make([]byte, 8)
+	copy(a, data)
+	return a
+}
+
+//######################################################################
+//#				NONE				       #
+//######################################################################
+
+// the length is checked by convert2CAN, ISO-TP messages can be longer
+func ascii2bytes(payload string) ([]byte, error) {
+	return []byte(payload), nil
 }
 
 // ######################################################################
@@ -317,206 +357,177 @@ func ascii2bytes(payload string) ([8]byte, uint8) {
 // ######################################################################
 // uint82ascii takes exactly one byte and returns a string with a
 // numeric decimal interpretation of the found data
-func uint82ascii(payload byte) string {
-	return strconv.FormatInt(int64(payload), 10)
+func uint82ascii(payload byte) (string, error) {
+	return strconv.FormatInt(int64(payload), 10), nil
 }
 
-func ascii2uint8(payload string) byte {
-	return ascii2uint16(payload)[0]
+func ascii2uint8(payload string) ([]byte, error) {
+	tmp, err := parseUint(payload, 8)
+	return []byte{byte(tmp)}, err
 }
 
 // ######################################################################
-// #			UINT162ASCII				       #
-// ######################################################################
-// ######################################################################
-// #			UINT162ASCII				       #
+// #			UINT162ASCII / INT162ASCII		       #
 // ######################################################################
 // uint162ascii takes 2 bytes and returns a string with a numeric
 // decimal interpretation of the found data as ascii-string
-func uint162ascii(payload []byte) string {
+func uint162ascii(payload []byte, order binary.ByteOrder) (string, error) {
 	if len(payload) != 2 {
-		return "Err in CAN-Frame, data must be 2 bytes."
+		return "", fmt.Errorf("data must be 2 bytes, got %d", len(payload))
 	}
-	data := binary.LittleEndian.Uint16(payload)
-	return strconv.FormatUint(uint64(data), 10)
+	data := order.Uint16(payload)
+	return strconv.FormatUint(uint64(data), 10), nil
 }
 
-func ascii2uint16(payload string) []byte {
-	tmp, _ := strconv.Atoi(payload)
-	number := uint16(tmp)
+func ascii2uint16(payload string, order binary.ByteOrder) ([]byte, error) {
+	tmp, err := parseUint(payload, 16)
 	a := make([]byte, 2)
-	binary.LittleEndian.PutUint16(a, number)
-	return a
+	order.PutUint16(a, uint16(tmp))
+	return a, err
+}
+
+func int162ascii(payload []byte, order binary.ByteOrder) (string, error) {
+	if len(payload) != 2 {
+		return "", fmt.Errorf("data must be 2 bytes, got %d", len(payload))
+	}
+	data := int16(order.Uint16(payload))
+	return strconv.FormatInt(int64(data), 10), nil
+}
+
+func ascii2int16(payload string, order binary.ByteOrder) ([]byte, error) {
+	tmp, err := parseInt(payload, 16)
+	a := make([]byte, 2)
+	order.PutUint16(a, uint16(tmp))
+	return a, err
 }
 
-// ########################################################################
 // ######################################################################
-// #			UINT322ASCII				       #
+// #			UINT322ASCII / INT322ASCII		       #
 // ######################################################################
 // uint322ascii takes 4 bytes and returns a string with a numeric
 // decimal interpretation of the found data as ascii-string
-func uint322ascii(payload []byte) string {
+func uint322ascii(payload []byte, order binary.ByteOrder) (string, error) {
 	if len(payload) != 4 {
-		return "Err in CAN-Frame, data must be 4 bytes."
+		return "", fmt.Errorf("data must be 4 bytes, got %d", len(payload))
 	}
-	data := binary.LittleEndian.Uint32(payload)
-	return strconv.FormatUint(uint64(data), 10)
+	data := order.Uint32(payload)
+	return strconv.FormatUint(uint64(data), 10), nil
 }
 
-func ascii2uint32(payload string) []byte {
-	tmp, _ := strconv.Atoi(payload)
-	number := uint32(tmp)
+func ascii2uint32(payload string, order binary.ByteOrder) ([]byte, error) {
+	tmp, err := parseUint(payload, 32)
 	a := make([]byte, 4)
-	binary.LittleEndian.PutUint32(a, number)
-	return a
+	order.PutUint32(a, uint32(tmp))
+	return a, err
 }
 
-// ########################################################################
-// ######################################################################
-// #			INT322ASCII				       #
-// ######################################################################
 // int322ascii takes 4 bytes and returns a string with a numeric
 // decimal interpretation of the found data as ascii-string
-func int322ascii(payload []byte) string {
+func int322ascii(payload []byte, order binary.ByteOrder) (string, error) {
 	if len(payload) != 4 {
-		return "Err in CAN-Frame, data must be 4 bytes."
+		return "", fmt.Errorf("data must be 4 bytes, got %d", len(payload))
 	}
-	data := binary.BigEndian.Uint32(payload)
-	data2 := int32(data)
-	return strconv.FormatInt(int64(data2), 10)
+	data := int32(order.Uint32(payload))
+	return strconv.FormatInt(int64(data), 10), nil
 }
 
-func ascii2int32(payload string) []byte {
-	tmp, _ := strconv.Atoi(payload)
-	number := uint32(tmp)
+func ascii2int32(payload string, order binary.ByteOrder) ([]byte, error) {
+	tmp, err := parseInt(payload, 32)
 	a := make([]byte, 4)
-	binary.BigEndian.PutUint32(a, number)
-	return a
+	order.PutUint32(a, uint32(tmp))
+	return a, err
 }
 
-// ########################################################################
 // ######################################################################
 // #			UINT642ASCII				       #
 // ######################################################################
 // uint642ascii takes 8 bytes and returns a string with a numeric
 // decimal interpretation of the found data as ascii-string
-func uint642ascii(payload []byte) string {
+func uint642ascii(payload []byte, order binary.ByteOrder) (string, error) {
 	if len(payload) != 8 {
-		return "Err in CAN-Frame, data must be 8 bytes."
+		return "", fmt.Errorf("data must be 8 bytes, got %d", len(payload))
 	}
-	data := binary.LittleEndian.Uint64(payload)
-	return strconv.FormatUint(data, 10)
+	data := order.Uint64(payload)
+	return strconv.FormatUint(data, 10), nil
 }
 
-func ascii2uint64(payload string) []byte {
-	tmp, _ := strconv.Atoi(payload)
-	number := uint64(tmp)
+func ascii2uint64(payload string, order binary.ByteOrder) ([]byte, error) {
+	tmp, err := parseUint(payload, 64)
 	a := make([]byte, 8)
-	binary.LittleEndian.PutUint64(a, number)
-	return a
+	order.PutUint64(a, tmp)
+	return a, err
 }
 
-//########################################################################
 //######################################################################
-//#			double Float2ASCII				       #
+//#			Float2ASCII				       #
 //######################################################################
-// Drillbotics double float msg -> two 32bit floats
+// Drillbotics float msg -> 32bit float
 // decimal interpretation of the found data as ascii-string
 
-func dfloat2ascii(payload []byte) string {
+func dfloat2ascii(payload []byte, order binary.ByteOrder) (string, error) {
 	if len(payload) != 4 {
-		return "Err in CAN-Frame, data must be 8 bytes."
+		return "", fmt.Errorf("data must be 4 bytes, got %d", len(payload))
 	}
-	data := binary.LittleEndian.Uint32(payload)
+	data := order.Uint32(payload)
 	float := math.Float32frombits(data)
 
-	return strconv.FormatFloat(float64(float), 'f', 5, 32)
+	return strconv.FormatFloat(float64(float), 'f', 5, 32), nil
 }
 
-func ascii2dfloat(payload string) []byte {
-	tmp, _ := strconv.ParseFloat(payload, 32)
-	tmp2 := float32(tmp)
-	number := math.Float32bits(tmp2)
+func ascii2dfloat(payload string, order binary.ByteOrder) ([]byte, error) {
+	tmp, err := strconv.ParseFloat(strings.TrimSpace(payload), 32)
+	if err != nil || math.IsInf(tmp, 0) || math.IsNaN(tmp) {
+		return nil, fmt.Errorf("%q is not a valid float32", payload)
+	}
+	number := math.Float32bits(float32(tmp))
 	a := make([]byte, 4)
-	binary.LittleEndian.PutUint32(a, number)
-	return a
+	order.PutUint32(a, number)
+	return a, nil
 }
 
-// ########################################################################
 // ######################################################################
 // #             bytecolor2colorcode
 // ######################################################################
 // bytecolor2colorcode is a convertmode that converts between the binary
 // 3 byte representation of a color and a string representation of a color
 // as we know it (for example in html #00ff00 is green)
-func bytecolor2colorcode(payload []byte) string {
+func bytecolor2colorcode(payload []byte) (string, error) {
+	if len(payload) != 3 {
+		return "", fmt.Errorf("color must be 3 bytes, got %d", len(payload))
+	}
 	colorstring := hex.EncodeToString(payload)
-	return "#" + colorstring
+	return "#" + colorstring, nil
 }
 
-func colorcode2bytecolor(payload string) []byte {
-	var a []byte
-	var err error
-	a, err = hex.DecodeString(strings.Replace(payload, "#", "", -1))
-	if err != nil {
-		return []byte{0, 0, 0}
+func colorcode2bytecolor(payload string) ([]byte, error) {
+	a, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(payload), "#"))
+	if err != nil || len(a) != 3 {
+		return nil, fmt.Errorf("%q is not a color code like #00ff00", payload)
 	}
-	return a
+	return a, nil
 }
 
-//########################################################################
-
-// drilllbotics setup 2 floats
-
-func setup2floats(payload string) []byte {
-	nums := strings.Split(payload, " ")
-	tmp_0, _ := strconv.ParseFloat(nums[0], 32)
-	tmp_0f := float32(tmp_0)
-
-	tmp_1, _ := strconv.ParseFloat(nums[1], 32)
-	tmp_1f := float32(tmp_1)
-
-	number_0 := math.Float32bits(tmp_0f)
-	number_1 := math.Float32bits(tmp_1f)
-
-	a_0 := make([]byte, 4)
-	a_1 := make([]byte, 4)
-	a := make([]byte, 8)
-	binary.LittleEndian.PutUint32(a_0, number_0)
-	binary.LittleEndian.PutUint32(a_1, number_1)
-
-	a[0] = a_0[0]
-	a[1] = a_0[1]
-	a[2] = a_0[2]
-	a[3] = a_0[3]
-	a[4] = a_1[0]
-	a[5] = a_1[1]
-	a[6] = a_1[2]
-	a[7] = a_1[3]
-
-	return a
-}
-
-// this really annoyws me ... Little endian  github test
-// test functiondsafsdfasdfsdfgsdfg
-func nutzlos() []byte {
-	null := make([]byte, 4)
-	return null
+// parseUint parses a decimal number that has to fit into bits
+func parseUint(payload string, bits int) (uint64, error) {
+	v, err := strconv.ParseUint(strings.TrimSpace(payload), 10, bits)
+	if err != nil {
+		return 0, numError(payload, "uint", bits, err)
+	}
+	return v, nil
 }
 
-func ascii2int16(payload string) []byte {
-	tmp, _ := strconv.Atoi(payload)
-	number := uint16(tmp)
-	a := make([]byte, 2)
-	binary.BigEndian.PutUint16(a, number)
-	return a
+// parseInt parses a decimal number that has to fit into bits
+func parseInt(payload string, bits int) (int64, error) {
+	v, err := strconv.ParseInt(strings.TrimSpace(payload), 10, bits)
+	if err != nil {
+		return 0, numError(payload, "int", bits, err)
+	}
+	return v, nil
 }
 
-func int162ascii(payload []byte) string {
-	if len(payload) != 2 {
-		return "Err in CAN-Frame, data must be 2 bytes."
+func numError(payload, typ string, bits int, err error) error {
+	if errors.Is(err, strconv.ErrRange) {
+		return fmt.Errorf("%s is out of the range of %s%d", payload, typ, bits)
 	}
-	data := binary.LittleEndian.Uint16(payload)
-	data2 := int16(data)
-	return strconv.FormatInt(int64(data2), 10)
+	return fmt.Errorf("%q is not a valid %s%d", payload, typ, bits)
 }
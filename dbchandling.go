@@ -0,0 +1,254 @@
+package can2mqtt_tuc
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// dbcMessage is a CAN-message (BO_) of a DBC file with its signals
+type dbcMessage struct {
+	id       uint32
+	extended bool
+	name     string
+	dlc      int
+	signals  []*signal
+	writable bool
+	fd       bool // CAN FD frame, by its DLC or the attribute VFrameFormat
+	brs      bool // attribute CANFD_BRS
+	line     int  // line of the BO_ in the DBC file
+
+	mu    sync.Mutex // protects state
+	state [64]byte   // last frame sent, signals not written keep their value
+}
+
+// dbcFile is the content of a DBC file that is relevant for the bridge
+type dbcFile struct {
+	messages []*dbcMessage
+}
+
+var (
+	dbcMessageRe = regexp.MustCompile(`^BO_\s+(\d+)\s+(\w+)\s*:\s*(\d+)\s+\w+`)
+	dbcSignalRe  = regexp.MustCompile(`^SG_\s+(\w+)\s*(M|m\d+)?\s*:\s*(\d+)\|(\d+)@([01])([+-])\s*\(([^,]+),([^)]+)\)\s*\[[^\]]*\]\s*"([^"]*)"`)
+	dbcValuesRe  = regexp.MustCompile(`^VAL_\s+(\d+)\s+(\w+)\s+(.*);`)
+	dbcValueRe   = regexp.MustCompile(`(-?\d+)\s+"([^"]*)"`)
+	dbcAttrRe    = regexp.MustCompile(`^BA_\s+"(VFrameFormat|CANFD_BRS)"\s+BO_\s+(\d+)\s+(\d+)\s*;`)
+)
+
+// readDBC parses the messages, signals and value tables of a DBC file.
+// Multiplexed signals are skipped, so are signals and messages with
+// problems.
+func readDBC(filename string, ps *problems) *dbcFile {
+	file, err := os.Open(filename)
+	if err != nil {
+		ps.add(filename, 0, "%s", err)
+		return nil
+	}
+	defer file.Close()
+
+	dbc := &dbcFile{}
+	byID := make(map[uint32]*dbcMessage)
+	var msg *dbcMessage
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if m := dbcMessageRe.FindStringSubmatch(text); m != nil {
+			id, _ := strconv.ParseUint(m[1], 10, 32)
+			dlc, _ := strconv.Atoi(m[3])
+			if id == 0xC0000000 {
+				// VECTOR__INDEPENDENT_SIG_MSG, not a real message
+				msg = nil
+				continue
+			}
+			if !validLength(dlc, true) {
+				ps.add(filename, line, "message %s: invalid DLC %d, valid lengths are 0 to 8 and 12, 16, 20, 24, 32, 48 or 64 for CAN FD", m[2], dlc)
+				msg = nil
+				continue
+			}
+			msg = &dbcMessage{
+				id:       uint32(id) & 0x1FFFFFFF,
+				extended: id&0x80000000 != 0,
+				name:     m[2],
+				dlc:      dlc,
+				fd:       dlc > 8,
+				line:     line,
+			}
+			dbc.messages = append(dbc.messages, msg)
+			byID[uint32(id)] = msg
+			continue
+		}
+		if m := dbcSignalRe.FindStringSubmatch(text); m != nil {
+			if msg == nil || strings.HasPrefix(m[2], "m") {
+				continue
+			}
+			sig, err := dbcSignal(m)
+			if err != nil {
+				ps.add(filename, line, "message %s: %s", msg.name, err)
+				continue
+			}
+			if err := sig.check(msg.dlc); err != nil {
+				ps.add(filename, line, "message %s: %s", msg.name, err)
+				continue
+			}
+			msg.signals = append(msg.signals, sig)
+			continue
+		}
+		if m := dbcValuesRe.FindStringSubmatch(text); m != nil {
+			id, _ := strconv.ParseUint(m[1], 10, 32)
+			msg, ok := byID[uint32(id)]
+			if !ok {
+				continue
+			}
+			for _, sig := range msg.signals {
+				if sig.name == m[2] {
+					sig.values = make(map[int64]string)
+					for _, v := range dbcValueRe.FindAllStringSubmatch(m[3], -1) {
+						raw, _ := strconv.ParseInt(v[1], 10, 64)
+						sig.values[raw] = v[2]
+					}
+				}
+			}
+			continue
+		}
+		if m := dbcAttrRe.FindStringSubmatch(text); m != nil {
+			id, _ := strconv.ParseUint(m[2], 10, 32)
+			msg, ok := byID[uint32(id)]
+			if !ok {
+				continue
+			}
+			value, _ := strconv.Atoi(m[3])
+			if m[1] == "CANFD_BRS" {
+				msg.brs = value == 1
+			} else if value == 14 || value == 15 {
+				// StandardCAN_FD, ExtendedCAN_FD
+				msg.fd = true
+			}
+			continue
+		}
+		if !strings.HasPrefix(text, "SG_") {
+			msg = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		ps.add(filename, line, "%s", err)
+	}
+	return dbc
+}
+
+// dbcSignal builds a signal out of the submatches of dbcSignalRe
+func dbcSignal(m []string) (*signal, error) {
+	start, _ := strconv.Atoi(m[3])
+	length, _ := strconv.Atoi(m[4])
+	factor, err := strconv.ParseFloat(strings.TrimSpace(m[7]), 64)
+	if err != nil {
+		return nil, fmt.Errorf("signal %s: invalid factor %q", m[1], m[7])
+	}
+	offset, err := strconv.ParseFloat(strings.TrimSpace(m[8]), 64)
+	if err != nil {
+		return nil, fmt.Errorf("signal %s: invalid offset %q", m[1], m[8])
+	}
+	return &signal{
+		name:      m[1],
+		startBit:  start,
+		length:    length,
+		bigEndian: m[5] == "0",
+		signed:    m[6] == "-",
+		factor:    factor,
+		offset:    offset,
+		unit:      m[9],
+	}, nil
+}
+
+// dbcMappings turns the messages of a DBC file into mappings. Each
+// signal is published to <prefix>/<message>/<signal>. Messages whose
+// name is in writable are encoded from <prefix>/<message>/set. With
+// format json all signals are one object on <prefix>/<message>.
+func dbcMappings(filename, prefix, format string, writable []string, ps *problems) []*can2mqtt {
+	dbc := readDBC(filename, ps)
+	if dbc == nil {
+		return nil
+	}
+	w := make(map[string]bool)
+	for _, name := range writable {
+		w[name] = true
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	var pairs []*can2mqtt
+	for _, msg := range dbc.messages {
+		if len(msg.signals) == 0 {
+			continue
+		}
+		msg.writable = w[msg.name]
+		delete(w, msg.name)
+		c2mp := &can2mqtt{
+			canId:       int(msg.id),
+			convMethod:  "dbc",
+			extended:    msg.extended,
+			fd:          msg.fd,
+			brs:         msg.fd && msg.brs,
+			description: "DBC message " + msg.name,
+			dbc:         msg,
+			conv:        &dbcConverter{msg},
+			file:        filename,
+			line:        msg.line,
+		}
+		if format == formatJSON {
+			// all signals in one object
+			c2mp.format = formatJSON
+			c2mp.mqttTopic = []string{prefix + msg.name}
+		} else {
+			for _, sig := range msg.signals {
+				c2mp.mqttTopic = append(c2mp.mqttTopic, prefix+msg.name+"/"+sig.name)
+			}
+		}
+		if msg.writable {
+			c2mp.cmdTopic = prefix + msg.name + "/set"
+		} else {
+			c2mp.direction = DirCAN2MQTT
+		}
+		pairs = append(pairs, c2mp)
+	}
+	for name := range w {
+		ps.add(filename, 0, "writable message %s not found", name)
+	}
+	return pairs
+}
+
+// dbc2ascii decodes every signal of the message
+func dbc2ascii(msg *dbcMessage, payload []byte) []string {
+	retstr := make([]string, 0, len(msg.signals))
+	for _, sig := range msg.signals {
+		retstr = append(retstr, sig.decode(payload))
+	}
+	return retstr
+}
+
+// ascii2dbc encodes the values of the signals into the message, in
+// the order of the signals. Signals with an empty value keep the value
+// they had in the last frame sent.
+func ascii2dbc(msg *dbcMessage, values []string) ([]byte, error) {
+	msg.mu.Lock()
+	defer msg.mu.Unlock()
+	if len(values) != len(msg.signals) {
+		return nil, fmt.Errorf("dbc: message %s has %d signals, got %d values", msg.name, len(msg.signals), len(values))
+	}
+	data := msg.state
+	for i, sig := range msg.signals {
+		if values[i] == "" {
+			continue
+		}
+		if err := sig.encode(data[:], values[i]); err != nil {
+			return nil, fmt.Errorf("dbc: message %s: %w", msg.name, err)
+		}
+	}
+	msg.state = data
+	return data[:msg.dlc], nil
+}
@@ -0,0 +1,191 @@
+package can2mqtt_tuc
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/brutella/can"
+)
+
+const testDBC = `VERSION ""
+
+BU_: RPI MOTOR
+
+BO_ 301 MotorStatus: 8 MOTOR
+ SG_ Speed : 0|16@1- (1,0) [-32768|32767] "rpm" RPI
+ SG_ Torque : 16|16@1- (0.01,0) [-327.68|327.67] "Nm" RPI
+ SG_ State : 40|8@1+ (1,0) [0|255] "" RPI
+ SG_ Temperature : 55|16@0+ (0.1,-40) [-40|6513.5] "degC" RPI
+
+BO_ 302 MotorSetup: 6 RPI
+ SG_ TargetSpeed : 0|16@1- (1,0) [-32768|32767] "rpm" MOTOR
+ SG_ Acceleration : 16|16@1+ (1,0) [0|65535] "rpm/s" MOTOR
+ SG_ CurrentLimit : 32|16@1+ (0.1,0) [0|6553.5] "A" MOTOR
+
+BO_ 2566844926 Engine: 8 MOTOR
+ SG_ Mode M : 0|8@1+ (1,0) [0|255] "" RPI
+ SG_ Load m1 : 8|8@1+ (1,0) [0|255] "%" RPI
+ SG_ Rpm : 16|16@1+ (0.125,0) [0|8191.875] "rpm" RPI
+
+BO_ 400 Trace: 12 MOTOR
+ SG_ Counter : 64|32@1+ (1,0) [0|4294967295] "" RPI
+
+BO_ 3221225472 VECTOR__INDEPENDENT_SIG_MSG: 0 Vector__XXX
+ SG_ Orphan : 0|8@1+ (1,0) [0|255] "" Vector__XXX
+
+BA_ "CANFD_BRS" BO_ 400 1;
+VAL_ 301 State 0 "IDLE" 1 "READY" 2 "RUNNING" 255 "FAULT" ;
+`
+
+// dbcBridge returns a bridge, not running, with the messages of testDBC
+// under the prefix test
+func dbcBridge(t *testing.T, format string) *Bridge {
+	t.Helper()
+	dbc := writeFile(t, "test.dbc", testDBC)
+	file := writeFile(t, "can2mqtt.yaml", `
+dbc:
+  - file: `+dbc+`
+    topic_prefix: test
+    writable: [MotorSetup]
+    format: `+format+`
+`)
+	b := NewBridge(Config{MappingFile: file, CANBackend: NewVirtualBus().Node(), MQTTClient: newFakeClient()})
+	if err := b.readC2MPFromFile(file); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestDBCMappings(t *testing.T) {
+	b := dbcBridge(t, "text")
+	tests := []struct {
+		id        uint32
+		topics    []string
+		cmdTopic  string
+		direction DirMode
+		flags     uint8 // of the frames sent
+	}{
+		{301, []string{"test/MotorStatus/Speed", "test/MotorStatus/Torque", "test/MotorStatus/State", "test/MotorStatus/Temperature"},
+			"", DirCAN2MQTT, 0},
+		{302, []string{"test/MotorSetup/TargetSpeed", "test/MotorSetup/Acceleration", "test/MotorSetup/CurrentLimit"},
+			"test/MotorSetup/set", DirBidirectional, 0},
+		// the multiplexed signal Load is skipped, the multiplexer is a
+		// plain signal
+		{0x18FEF1FE | can.MaskEff, []string{"test/Engine/Mode", "test/Engine/Rpm"}, "", DirCAN2MQTT, 0},
+		{400, []string{"test/Trace/Counter"}, "", DirCAN2MQTT, FrameFD | FrameBRS},
+	}
+	for _, tt := range tests {
+		c2mp, err := b.pairByFrame(Frame{ID: tt.id})
+		if c2mp == nil || err != nil {
+			t.Errorf("%X is not mapped: %v", tt.id, err)
+			continue
+		}
+		if !reflect.DeepEqual(c2mp.mqttTopic, tt.topics) || c2mp.cmdTopic != tt.cmdTopic || c2mp.direction != tt.direction {
+			t.Errorf("%X: topics %q, set %q, direction %s", tt.id, c2mp.mqttTopic, c2mp.cmdTopic, c2mp.direction)
+		}
+		f, err := c2mp.frameOf(make([]byte, c2mp.dbc.dlc))
+		if err != nil || f.ID != tt.id || f.Flags != tt.flags {
+			t.Errorf("%X: sent as %s, %v", tt.id, f, err)
+		}
+	}
+	if n := len(b.pairFromID); n != 4 {
+		t.Errorf("%d messages, want 4 without VECTOR__INDEPENDENT_SIG_MSG", n)
+	}
+}
+
+func TestDBCDecode(t *testing.T) {
+	tests := []struct {
+		format string
+		values []string
+	}{
+		{"text", []string{"-100", "12.34", "RUNNING", "25"}},
+		{"json", []string{`{"Speed":-100,"Torque":12.34,"State":"RUNNING","Temperature":25}`}},
+	}
+	// Temperature is big endian, 650*0.1-40 = 25
+	data := []byte{0x9C, 0xFF, 0xD2, 0x04, 0, 0x02, 0x02, 0x8A}
+	for _, tt := range tests {
+		b := dbcBridge(t, tt.format)
+		c2mp, _ := b.pairByFrame(Frame{ID: 301})
+		values, err := b.convert2MQTT(c2mp, data)
+		if err != nil {
+			t.Errorf("%s: %s", tt.format, err)
+		} else if !reflect.DeepEqual(values, tt.values) {
+			t.Errorf("%s: published %q, want %q", tt.format, values, tt.values)
+		}
+		if _, err := b.convert2MQTT(c2mp, data[:6]); err == nil || !strings.Contains(err.Error(), "has 8") {
+			t.Errorf("%s: short frame: %v", tt.format, err)
+		}
+	}
+}
+
+// signals that are not given keep the value of the last frame
+func TestDBCEncode(t *testing.T) {
+	b := dbcBridge(t, "text")
+	c2mp := b.pairByTopic("test/MotorSetup/set")
+	if c2mp == nil {
+		t.Fatal("test/MotorSetup/set is not mapped")
+	}
+	tests := []struct {
+		payload string
+		data    []byte
+		reason  string // "": no error
+	}{
+		{"TargetSpeed=-1000 CurrentLimit=12.5", []byte{0x18, 0xFC, 0, 0, 0x7D, 0}, ""},
+		{"Acceleration=500", []byte{0x18, 0xFC, 0xF4, 0x01, 0x7D, 0}, ""},
+		{"1 2 3", []byte{1, 0, 2, 0, 30, 0}, ""},
+		{"Acceleration=-1", nil, `"-1" is not a valid uint16`},
+		{"CurrentLimit=6553.6", nil, "out of range"},
+		{"Speed=1", nil, "Speed"},
+		{"CurrentLimit=7", []byte{1, 0, 2, 0, 70, 0}, ""}, // the failed ones changed nothing
+	}
+	for _, tt := range tests {
+		f, err := b.convert2CAN(c2mp, tt.payload)
+		if tt.reason != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.reason) {
+				t.Errorf("%s: got %s, %v, want the error %s", tt.payload, f, err, tt.reason)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.payload, err)
+		} else if f.ID != 302 || !bytes.Equal(f.Payload(), tt.data) {
+			t.Errorf("%s: sent %s, want % X", tt.payload, f, tt.data)
+		}
+	}
+}
+
+func TestDBCProblems(t *testing.T) {
+	dbc := writeFile(t, "bad.dbc", `VERSION ""
+
+BO_ 100 Status: 10 MOTOR
+ SG_ A : 0|8@1+ (1,0) [0|255] "" RPI
+
+BO_ 101 Setup: 8 RPI
+ SG_ B : 60|8@1+ (1,0) [0|255] "" MOTOR
+ SG_ C : 0|8@1+ (x,0) [0|255] "" MOTOR
+ SG_ D : 8|8@1+ (1,0) [0|255] "" MOTOR
+`)
+	file := writeFile(t, "can2mqtt.yaml", "dbc:\n  - {file: "+dbc+", writable: [Setup, Missing]}\n")
+	_, err := readMappings(file)
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("got %v, want a ValidationError", err)
+	}
+	want := []string{
+		dbc + ": writable message Missing not found",
+		dbc + ":3: message Status: invalid DLC 10",
+		dbc + ":7: message Setup: signal B: bit 67 is outside of the 8 data bytes",
+		dbc + `:8: message Setup: signal C: invalid factor "x"`,
+	}
+	if len(verr.Problems) != len(want) {
+		t.Fatalf("got %s", err)
+	}
+	for i, p := range verr.Problems {
+		if !strings.HasPrefix(p.String(), want[i]) {
+			t.Errorf("got %s, want %s", p, want[i])
+		}
+	}
+}
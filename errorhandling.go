@@ -0,0 +1,82 @@
+package can2mqtt_tuc
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/brutella/can"
+)
+
+// frameError is published as JSON to the error topic when a received
+// frame can't be converted, instead of a value
+type frameError struct {
+	ID       uint32 `json:"id"`
+	Extended bool   `json:"extended"`
+	Mode     string `json:"mode"`
+	DLC      int    `json:"dlc"`
+	Length   int    `json:"length"` // data bytes, differs from dlc for CAN FD
+	FD       bool   `json:"fd,omitempty"`
+	Data     string `json:"data"` // raw bytes, hex
+	Reason   string `json:"reason"`
+}
+
+// reportFrameError drops a frame that can't be converted and tells
+// the error topic why
+func (b *Bridge) reportFrameError(c2mp *can2mqtt, cf Frame, reason error) {
+	fe := frameError{
+		ID:       cf.ID & can.MaskIDEff,
+		Extended: cf.ID&can.MaskEff != 0,
+		Mode:     c2mp.convMethod,
+		DLC:      int(cf.DLC()),
+		Length:   len(cf.Payload()),
+		FD:       cf.IsFD(),
+		Data:     fmt.Sprintf("%X", cf.Payload()),
+		Reason:   reason.Error(),
+	}
+	fmt.Printf("receivehandler: frame with ID %d (%s) dropped: %s\n", fe.ID, fe.Mode, fe.Reason)
+	b.publishError(fe)
+}
+
+// rejection is published as JSON to the error topic when a message
+// from MQTT is not sent to the CAN-bus, because its payload is
+// malformed, out of range or has the wrong number of values
+type rejection struct {
+	Topic    string `json:"topic"`
+	Payload  string `json:"payload"`
+	ID       uint32 `json:"id"`
+	Extended bool   `json:"extended"`
+	Mode     string `json:"mode"`
+	Reason   string `json:"reason"`
+}
+
+// reportRejection drops a message from MQTT that can't be converted
+// and tells the error topic why
+func (b *Bridge) reportRejection(c2mp *can2mqtt, topic, payload string, reason error) {
+	rj := rejection{
+		Topic:    topic,
+		Payload:  payload,
+		ID:       uint32(c2mp.canId),
+		Extended: c2mp.extended,
+		Mode:     c2mp.convMethod,
+		Reason:   reason.Error(),
+	}
+	fmt.Printf("receivehandler: message on topic \"%s\" rejected: %s\n", topic, rj.Reason)
+	b.publishError(rj)
+}
+
+// publishError publishes a frameError or rejection on the error topic,
+// if there is one
+func (b *Bridge) publishError(v interface{}) {
+	if b.conf.ErrorTopic == "" {
+		return
+	}
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	token := b.client.Publish(b.conf.ErrorTopic, b.conf.QoS, false, payload)
+	token.Wait()
+	if token.Error() != nil {
+		fmt.Printf("mqtthandler: error while publishing to the error topic %s: %s\n", b.conf.ErrorTopic, token.Error())
+	}
+}
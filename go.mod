@@ -5,11 +5,12 @@ go 1.18
 require (
 	github.com/brutella/can v0.0.2
 	github.com/eclipse/paho.mqtt.golang v1.4.1
+	golang.org/x/sys v0.0.0-20200323222414-85ca7c5b95cd
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/gorilla/websocket v1.4.2 // indirect
 	golang.org/x/net v0.0.0-20200425230154-ff2c4b7c35a0 // indirect
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
-	golang.org/x/sys v0.0.0-20200323222414-85ca7c5b95cd // indirect
 )
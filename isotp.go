@@ -0,0 +1,408 @@
+package can2mqtt_tuc
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/brutella/can"
+)
+
+// ISO 15765-2 (ISO-TP) carries messages of up to 4095 bytes in several
+// frames: a single frame for up to 7 bytes, otherwise a first frame
+// with the length, answered by a flow control frame of the receiver,
+// and consecutive frames with the rest. The first nibble of each frame
+// is its type.
+const (
+	isotpSingle      = 0x0
+	isotpFirst       = 0x1
+	isotpConsecutive = 0x2
+	isotpFlowControl = 0x3
+
+	isotpMaxSize  = 4095
+	isotpMaxWaits = 10 // flow control frames with wait before giving up
+)
+
+// isotpConfig are the ISO-TP settings of a mapping in a YAML
+// configuration file
+type isotpConfig struct {
+	TxID          string `yaml:"tx_id"`
+	FlowControlID string `yaml:"flow_control_id"` // old name of tx_id
+	STmin         string `yaml:"st_min"`
+	BlockSize     int    `yaml:"block_size"`
+	Timeout       string `yaml:"timeout"`
+	Padding       *int   `yaml:"padding"`
+}
+
+// isotp are the ISO-TP settings of a mapping. Like a socket of the
+// Linux can-isotp module it has a pair of IDs (normal addressing): the
+// mapping's CAN-ID is the rx ID, the other side sends its data and the
+// flow control for our data there. On the tx ID we send our data and
+// our flow control for the data of the other side.
+type isotp struct {
+	txID      uint32        // frame ID of our frames (see frameID)
+	stMin     time.Duration // asked from senders, and the minimum between our own consecutive frames
+	blockSize int           // consecutive frames between two flow control frames we send, 0: all
+	timeout   time.Duration // for the next flow control or consecutive frame
+	padding   int           // frames are filled up to 8 bytes with it, -1: no padding
+}
+
+// toISOTP checks the ISO-TP settings of a mapping
+func (ic *isotpConfig) toISOTP(extended bool) (*isotp, error) {
+	if ic == nil {
+		return nil, nil
+	}
+	tx := ic.TxID
+	if tx == "" {
+		tx = ic.FlowControlID
+	} else if ic.FlowControlID != "" {
+		return nil, fmt.Errorf("isotp: flow_control_id is the old name of tx_id, use only tx_id")
+	}
+	if tx == "" {
+		return nil, fmt.Errorf("isotp needs a tx_id")
+	}
+	txID, err := parseCANID(tx)
+	if err != nil {
+		return nil, fmt.Errorf("isotp: %w", err)
+	}
+	if txID < 0 || (extended && txID > can.MaskIDEff) || (!extended && txID > can.MaskIDSff) {
+		return nil, fmt.Errorf("isotp: tx_id %s is out of range", tx)
+	}
+	tp := &isotp{txID: uint32(txID), timeout: time.Second, blockSize: ic.BlockSize, padding: -1}
+	if extended {
+		tp.txID |= can.MaskEff
+	}
+	if ic.STmin != "" {
+		if tp.stMin, err = time.ParseDuration(ic.STmin); err != nil || tp.stMin < 0 || tp.stMin > 127*time.Millisecond {
+			return nil, fmt.Errorf("isotp: invalid st_min %q, valid values are 0 to 127ms", ic.STmin)
+		}
+	}
+	if ic.BlockSize < 0 || ic.BlockSize > 255 {
+		return nil, fmt.Errorf("isotp: invalid block_size %d, valid values are 0 to 255", ic.BlockSize)
+	}
+	if ic.Timeout != "" {
+		if tp.timeout, err = time.ParseDuration(ic.Timeout); err != nil || tp.timeout <= 0 {
+			return nil, fmt.Errorf("isotp: invalid timeout %q", ic.Timeout)
+		}
+	}
+	if ic.Padding != nil {
+		if *ic.Padding < 0 || *ic.Padding > 255 {
+			return nil, fmt.Errorf("isotp: invalid padding %d, valid values are 0 to 255", *ic.Padding)
+		}
+		tp.padding = *ic.Padding
+	}
+	return tp, nil
+}
+
+// frame builds a classic frame with the given ID, padded to 8 bytes
+// if configured
+func (tp *isotp) frame(id uint32, data []byte) Frame {
+	cf := Frame{ID: id, Length: uint8(len(data))}
+	copy(cf.Data[:], data)
+	if tp.padding >= 0 {
+		for i := len(data); i < 8; i++ {
+			cf.Data[i] = byte(tp.padding)
+		}
+		cf.Length = 8
+	}
+	return cf
+}
+
+// stMinByte encodes the separation time for a flow control frame
+func stMinByte(d time.Duration) byte {
+	if d > 0 && d < time.Millisecond {
+		return 0xF0 + byte((d+99*time.Microsecond)/(100*time.Microsecond))
+	}
+	return byte((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+// stMinDuration decodes the separation time of a flow control frame,
+// reserved values mean the longest time
+func stMinDuration(b byte) time.Duration {
+	switch {
+	case b <= 0x7F:
+		return time.Duration(b) * time.Millisecond
+	case b >= 0xF1 && b <= 0xF9:
+		return time.Duration(b-0xF0) * 100 * time.Microsecond
+	}
+	return 127 * time.Millisecond
+}
+
+// isotpState are the running ISO-TP transfers of a bridge
+type isotpState struct {
+	mu      sync.Mutex
+	rx      map[uint32]*isotpRx    // incoming messages, by rx ID
+	fc      map[uint32]chan Frame  // outgoing messages waiting for flow control, by rx ID
+	senders map[uint32]*sync.Mutex // one outgoing message per mapping at a time, by rx ID
+}
+
+// isotpRx is a message that is being received
+type isotpRx struct {
+	c2mp  *can2mqtt
+	first Frame // for error reports
+	data  []byte
+	size  int
+	next  byte // sequence number of the next consecutive frame
+	block int  // consecutive frames since the last flow control
+	timer *time.Timer
+}
+
+// isotpFrame consumes frames that belong to ISO-TP: flow control
+// frames for our own messages, also of mappings that only send, and all
+// frames of mappings with ISO-TP.
+// Complete messages are published to MQTT. It runs in the reader of
+// the bus, so the frames of a message are handled in order.
+func (b *Bridge) isotpFrame(cf Frame, subscribed bool) bool {
+	if b.isotpFlowControlFrame(cf) {
+		return true
+	}
+	if !subscribed {
+		return false
+	}
+	c2mp, _ := b.pairByFrame(cf)
+	if c2mp == nil || c2mp.isotp == nil {
+		return false
+	}
+	b.isotpReceive(c2mp, cf)
+	return true
+}
+
+// isotpFlowControlFrame hands flow control frames to the waiting sender
+func (b *Bridge) isotpFlowControlFrame(cf Frame) bool {
+	b.tp.mu.Lock()
+	ch, ok := b.tp.fc[frameIDOf(cf)]
+	b.tp.mu.Unlock()
+	if !ok || cf.Length < 3 || cf.Data[0]>>4 != isotpFlowControl {
+		return false
+	}
+	select {
+	case ch <- cf:
+	default: // the sender is busy, it is a duplicate anyway
+	}
+	return true
+}
+
+// isotpReceive handles a frame of a mapping with ISO-TP
+func (b *Bridge) isotpReceive(c2mp *can2mqtt, cf Frame) {
+	tp := c2mp.isotp
+	data := cf.Payload()
+	if len(data) == 0 {
+		b.isotpReport(c2mp, cf, fmt.Errorf("isotp: frame without data"))
+		return
+	}
+	switch data[0] >> 4 {
+	case isotpSingle:
+		n := int(data[0] & 0x0F)
+		if n == 0 || n > len(data)-1 {
+			b.isotpReport(c2mp, cf, fmt.Errorf("isotp: invalid single frame length %d", n))
+			return
+		}
+		msg := append([]byte(nil), data[1:1+n]...)
+		b.work.submit(cf.ID, func() { b.publishCAN(c2mp, cf, msg) })
+	case isotpFirst:
+		if len(data) < 8 {
+			b.isotpReport(c2mp, cf, fmt.Errorf("isotp: first frame with %d bytes", len(data)))
+			return
+		}
+		size := int(data[0]&0x0F)<<8 | int(data[1])
+		if size < 8 {
+			b.isotpReport(c2mp, cf, fmt.Errorf("isotp: invalid message length %d", size))
+			return
+		}
+		rx := &isotpRx{c2mp: c2mp, first: cf, size: size, next: 1}
+		rx.data = append(make([]byte, 0, size), data[2:]...)
+		b.isotpStartRx(cf.ID, rx)
+		b.isotpSendFlowControl(tp)
+	case isotpConsecutive:
+		b.isotpConsecutive(c2mp, cf, data)
+	case isotpFlowControl:
+		// no message of ours is waiting for it
+		if b.conf.Debug {
+			fmt.Printf("canbushandler: ISO-TP flow control frame for ID %d without a message to send\n", cf.ID&can.MaskIDEff)
+		}
+	default:
+		b.isotpReport(c2mp, cf, fmt.Errorf("isotp: invalid frame type %d", data[0]>>4))
+	}
+}
+
+// isotpReport reports a broken message through the worker of its ID
+func (b *Bridge) isotpReport(c2mp *can2mqtt, cf Frame, reason error) {
+	b.work.submit(cf.ID, func() { b.reportFrameError(c2mp, cf, reason) })
+}
+
+// isotpStartRx registers an incoming message, a new first frame
+// replaces an unfinished message
+func (b *Bridge) isotpStartRx(id uint32, rx *isotpRx) {
+	b.tp.mu.Lock()
+	defer b.tp.mu.Unlock()
+	if b.tp.rx == nil {
+		b.tp.rx = make(map[uint32]*isotpRx)
+	}
+	if old := b.tp.rx[id]; old != nil {
+		old.timer.Stop()
+	}
+	b.tp.rx[id] = rx
+	rx.timer = time.AfterFunc(rx.c2mp.isotp.timeout, func() {
+		b.tp.mu.Lock()
+		current := b.tp.rx[id] == rx
+		if current {
+			delete(b.tp.rx, id)
+		}
+		b.tp.mu.Unlock()
+		if current {
+			b.isotpReport(rx.c2mp, rx.first, fmt.Errorf("isotp: timeout after %d of %d bytes", len(rx.data), rx.size))
+		}
+	})
+}
+
+// isotpConsecutive adds a consecutive frame to its message
+func (b *Bridge) isotpConsecutive(c2mp *can2mqtt, cf Frame, data []byte) {
+	tp := c2mp.isotp
+	b.tp.mu.Lock()
+	rx := b.tp.rx[cf.ID]
+	if rx == nil {
+		b.tp.mu.Unlock()
+		if b.conf.Debug {
+			fmt.Printf("canbushandler: ISO-TP consecutive frame for ID %d without first frame\n", cf.ID&can.MaskIDEff)
+		}
+		return
+	}
+	if sn := data[0] & 0x0F; sn != rx.next&0x0F {
+		rx.timer.Stop()
+		delete(b.tp.rx, cf.ID)
+		b.tp.mu.Unlock()
+		b.isotpReport(c2mp, cf, fmt.Errorf("isotp: sequence number %d instead of %d", sn, rx.next&0x0F))
+		return
+	}
+	n := rx.size - len(rx.data)
+	if n > len(data)-1 {
+		n = len(data) - 1
+	}
+	rx.data = append(rx.data, data[1:1+n]...)
+	rx.next++
+	rx.block++
+	if len(rx.data) == rx.size {
+		rx.timer.Stop()
+		delete(b.tp.rx, cf.ID)
+		b.tp.mu.Unlock()
+		b.work.submit(cf.ID, func() { b.publishCAN(c2mp, rx.first, rx.data) })
+		return
+	}
+	rx.timer.Reset(tp.timeout)
+	more := tp.blockSize > 0 && rx.block == tp.blockSize
+	if more {
+		rx.block = 0
+	}
+	b.tp.mu.Unlock()
+	if more {
+		b.isotpSendFlowControl(tp)
+	}
+}
+
+// isotpSendFlowControl tells the sender to continue
+func (b *Bridge) isotpSendFlowControl(tp *isotp) {
+	fc := tp.frame(tp.txID, []byte{isotpFlowControl << 4, byte(tp.blockSize), stMinByte(tp.stMin)})
+	if err := b.canPublish(fc); err != nil {
+		fmt.Printf("canbushandler: error while sending an ISO-TP flow control frame: %s\n", err)
+	}
+}
+
+// isotpSend sends data as ISO-TP message on the tx ID, waiting for the
+// flow control of the receiver on the rx ID if it needs more than one
+// frame
+func (b *Bridge) isotpSend(c2mp *can2mqtt, data []byte) error {
+	tp := c2mp.isotp
+	id := tp.txID
+	if len(data) <= 7 {
+		return b.canPublish(tp.frame(id, append([]byte{byte(len(data))}, data...)))
+	}
+	rxID := c2mp.frameID()
+	fc := b.isotpExpectFlowControl(rxID)
+	defer b.isotpForgetFlowControl(rxID)
+	first := append([]byte{isotpFirst<<4 | byte(len(data)>>8), byte(len(data))}, data[:6]...)
+	if err := b.canPublish(tp.frame(id, first)); err != nil {
+		return err
+	}
+	data = data[6:]
+	sn := byte(1)
+	for len(data) > 0 {
+		bs, stMin, err := isotpWaitForFlowControl(fc, tp.timeout)
+		if err != nil {
+			return err
+		}
+		if stMin < tp.stMin {
+			stMin = tp.stMin
+		}
+		for i := 0; len(data) > 0 && (bs == 0 || i < bs); i++ {
+			if i > 0 {
+				time.Sleep(stMin)
+			}
+			n := len(data)
+			if n > 7 {
+				n = 7
+			}
+			if err := b.canPublish(tp.frame(id, append([]byte{isotpConsecutive<<4 | sn&0x0F}, data[:n]...))); err != nil {
+				return err
+			}
+			data = data[n:]
+			sn++
+		}
+	}
+	return nil
+}
+
+// isotpExpectFlowControl waits until no other message of the mapping
+// with the rx ID is sent and registers the channel for the flow
+// control frames
+func (b *Bridge) isotpExpectFlowControl(rxID uint32) chan Frame {
+	b.tp.mu.Lock()
+	if b.tp.senders == nil {
+		b.tp.senders = make(map[uint32]*sync.Mutex)
+		b.tp.fc = make(map[uint32]chan Frame)
+	}
+	lock, ok := b.tp.senders[rxID]
+	if !ok {
+		lock = &sync.Mutex{}
+		b.tp.senders[rxID] = lock
+	}
+	b.tp.mu.Unlock()
+	lock.Lock()
+	ch := make(chan Frame, 1)
+	b.tp.mu.Lock()
+	b.tp.fc[rxID] = ch
+	b.tp.mu.Unlock()
+	return ch
+}
+
+// isotpForgetFlowControl lets the next message of the mapping go
+func (b *Bridge) isotpForgetFlowControl(rxID uint32) {
+	b.tp.mu.Lock()
+	delete(b.tp.fc, rxID)
+	lock := b.tp.senders[rxID]
+	b.tp.mu.Unlock()
+	lock.Unlock()
+}
+
+// isotpWaitForFlowControl returns the block size and separation time of
+// the next flow control frame that allows to continue
+func isotpWaitForFlowControl(fc chan Frame, timeout time.Duration) (int, time.Duration, error) {
+	for waits := 0; ; waits++ {
+		select {
+		case cf := <-fc:
+			switch cf.Data[0] & 0x0F {
+			case 0: // continue to send
+				return int(cf.Data[1]), stMinDuration(cf.Data[2]), nil
+			case 1: // wait
+				if waits >= isotpMaxWaits {
+					return 0, 0, fmt.Errorf("isotp: receiver asked to wait %d times", waits)
+				}
+			case 2:
+				return 0, 0, fmt.Errorf("isotp: message is too long for the receiver")
+			default:
+				return 0, 0, fmt.Errorf("isotp: invalid flow control frame")
+			}
+		case <-time.After(timeout):
+			return 0, 0, fmt.Errorf("isotp: no flow control within %s", timeout)
+		}
+	}
+}
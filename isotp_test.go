@@ -0,0 +1,241 @@
+package can2mqtt_tuc
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the ISO-TP tests run a bridge with a mapping on the rx ID 0x6A0 and
+// the tx ID 0x6A8, the test is the other side of the transfers
+
+const (
+	tpRxID = 0x6A0 // data and flow control of the test
+	tpTxID = 0x6A8 // data and flow control of the bridge
+)
+
+// isotpBridge starts a bridge with the given isotp settings (besides
+// tx_id) and returns the node of the other side
+func isotpBridge(t *testing.T, settings string) (*testNode, *fakeClient) {
+	t.Helper()
+	vbus := NewVirtualBus()
+	peer := newTestNode(t, vbus)
+	file := writeFile(t, "isotp.yaml", `
+mappings:
+  - id: 0x6A0
+    mode: none
+    topic: test/text
+    isotp: {tx_id: 0x6A8, `+settings+`}
+`)
+	_, client := startBridge(t, Config{MappingFile: file, CANBackend: vbus.Node(), ErrorTopic: "test/errors"})
+	client.waitSubscribed(t, "test/text")
+	return peer, client
+}
+
+// tpFrame is a classic frame with the given data
+func tpFrame(id uint32, data ...byte) Frame {
+	f := Frame{ID: id, Length: uint8(len(data))}
+	copy(f.Data[:], data)
+	return f
+}
+
+func (n *testNode) send(t *testing.T, id uint32, data ...byte) {
+	t.Helper()
+	if err := n.Publish(tpFrame(id, data...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expect returns the next frame, which has to have the ID id and start
+// with the bytes of prefix
+func (n *testNode) expect(t *testing.T, id uint32, prefix ...byte) Frame {
+	t.Helper()
+	f := n.next(t)
+	if f.ID != id || !bytes.HasPrefix(f.Payload(), prefix) {
+		t.Fatalf("got %s, want ID %d with % X...", f, id, prefix)
+	}
+	return f
+}
+
+// expectNothing makes sure that no frame comes for a while
+func (n *testNode) expectNothing(t *testing.T) {
+	t.Helper()
+	select {
+	case f := <-n.frames:
+		t.Fatalf("got %s, want nothing", f)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// waitError waits for the n-th report on the error topic and checks
+// its reason
+func (f *fakeClient) waitError(t *testing.T, n int, reason string) {
+	t.Helper()
+	msg := f.waitPublished(t, "test/errors", n)
+	var report struct{ Reason string }
+	if err := json.Unmarshal(msg.payload, &report); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(report.Reason, reason) {
+		t.Errorf("reported %q, want %q", report.Reason, reason)
+	}
+}
+
+// segments splits a message into the frames of an ISO-TP sender
+func segments(msg []byte) [][]byte {
+	frames := [][]byte{append([]byte{0x10 | byte(len(msg)>>8), byte(len(msg))}, msg[:6]...)}
+	for i, sn := 6, byte(1); i < len(msg); i, sn = i+7, sn+1 {
+		end := i + 7
+		if end > len(msg) {
+			end = len(msg)
+		}
+		frames = append(frames, append([]byte{0x20 | sn&0x0F}, msg[i:end]...))
+	}
+	return frames
+}
+
+func TestISOTPReceiveSingleFrame(t *testing.T) {
+	peer, client := isotpBridge(t, "")
+	peer.send(t, tpRxID, 0x03, 'a', 'b', 'c')
+	if msg := client.waitPublished(t, "test/text", 1); string(msg.payload) != "abc" {
+		t.Errorf("published %q, want %q", msg.payload, "abc")
+	}
+}
+
+func TestISOTPReceiveBlocks(t *testing.T) {
+	peer, client := isotpBridge(t, "block_size: 2, st_min: 2ms")
+	msg := []byte("the quick brown fox jumps over the lazy dog") // 43 bytes, 6 frames
+	frames := segments(msg)
+	peer.send(t, tpRxID, frames[0]...)
+	for i, f := range frames[1:] {
+		if i%2 == 0 {
+			// flow control on the tx ID: continue, block size 2, 2ms
+			peer.expect(t, tpTxID, 0x30, 2, 2)
+		}
+		peer.send(t, tpRxID, f...)
+	}
+	if got := client.waitPublished(t, "test/text", 1); string(got.payload) != string(msg) {
+		t.Errorf("published %q, want %q", got.payload, msg)
+	}
+	peer.expectNothing(t)
+}
+
+func TestISOTPReceiveErrors(t *testing.T) {
+	peer, client := isotpBridge(t, "timeout: 50ms")
+	frames := segments([]byte("0123456789abcdefghij"))
+
+	peer.send(t, tpRxID, frames[0]...)
+	peer.expect(t, tpTxID, 0x30, 0, 0)
+	frames[2][0] = 0x22
+	peer.send(t, tpRxID, frames[2]...) // sequence number 2 instead of 1
+	client.waitError(t, 1, "sequence number 2 instead of 1")
+
+	peer.send(t, tpRxID, frames[0]...)
+	peer.expect(t, tpTxID, 0x30)
+	peer.send(t, tpRxID, frames[1]...)
+	client.waitError(t, 2, "timeout after 13 of 20 bytes")
+
+	peer.send(t, tpRxID, 0x09, 1, 2) // single frame longer than the frame
+	client.waitError(t, 3, "invalid single frame length 9")
+	if got := client.published("test/text"); len(got) != 0 {
+		t.Errorf("published %q, want nothing", got)
+	}
+}
+
+func TestISOTPSendSingleFrame(t *testing.T) {
+	peer, client := isotpBridge(t, "padding: 0xCC")
+	client.deliver(t, "test/text", "hi")
+	f := peer.expect(t, tpTxID)
+	if want := []byte{0x02, 'h', 'i', 0xCC, 0xCC, 0xCC, 0xCC, 0xCC}; !bytes.Equal(f.Payload(), want) {
+		t.Errorf("sent % X, want % X", f.Payload(), want)
+	}
+}
+
+func TestISOTPSendBlocks(t *testing.T) {
+	peer, client := isotpBridge(t, "")
+	msg := "the quick brown fox jumps" // 25 bytes: first frame and 3 consecutive frames
+	client.deliver(t, "test/text", msg)
+	want := segments([]byte(msg))
+	var got []byte
+	f := peer.expect(t, tpTxID, want[0]...)
+	got = append(got, f.Payload()[2:]...)
+	peer.expectNothing(t) // waits for the flow control
+
+	// on the rx ID: continue, block size 2, 5ms between the frames
+	start := time.Now()
+	peer.send(t, tpRxID, 0x30, 2, 5)
+	for _, w := range want[1:3] {
+		f := peer.expect(t, tpTxID, w...)
+		got = append(got, f.Payload()[1:]...)
+	}
+	if d := time.Since(start); d < 5*time.Millisecond {
+		t.Errorf("2 consecutive frames within %s, st_min is 5ms", d)
+	}
+	peer.expectNothing(t) // the block is done
+	peer.send(t, tpRxID, 0x30, 0, 0)
+	f = peer.expect(t, tpTxID, want[3]...)
+	got = append(got, f.Payload()[1:]...)
+	if string(got) != msg {
+		t.Errorf("sent %q, want %q", got, msg)
+	}
+	peer.expectNothing(t)
+	if got := client.published("test/errors"); len(got) != 0 {
+		t.Errorf("reported %q", got)
+	}
+}
+
+func TestISOTPSendSequenceNumbersWrap(t *testing.T) {
+	peer, client := isotpBridge(t, "")
+	msg := strings.Repeat("0123456789", 13) // 130 bytes, 18 consecutive frames
+	client.deliver(t, "test/text", msg)
+	want := segments([]byte(msg))
+	peer.expect(t, tpTxID, want[0]...)
+	peer.send(t, tpRxID, 0x30, 0, 0)
+	for _, w := range want[1:] {
+		peer.expect(t, tpTxID, w...)
+	}
+	if want[16][0] != 0x20 || want[17][0] != 0x21 {
+		t.Fatalf("test data: % X", want[16:])
+	}
+}
+
+func TestISOTPSendFlowControlStatus(t *testing.T) {
+	peer, client := isotpBridge(t, "")
+	msg := "0123456789" // first frame and 1 consecutive frame
+
+	// wait, then continue
+	client.deliver(t, "test/text", msg)
+	peer.expect(t, tpTxID, 0x10, 10)
+	peer.send(t, tpRxID, 0x31, 0, 0)
+	peer.expectNothing(t)
+	peer.send(t, tpRxID, 0x30, 0, 0)
+	peer.expect(t, tpTxID, 0x21, '6', '7', '8', '9')
+
+	// overflow
+	client.deliver(t, "test/text", msg)
+	peer.expect(t, tpTxID, 0x10, 10)
+	peer.send(t, tpRxID, 0x32, 0, 0)
+	client.waitError(t, 1, "too long for the receiver")
+
+	// too many waits
+	client.deliver(t, "test/text", msg)
+	peer.expect(t, tpTxID, 0x10, 10)
+	for i := 0; i <= isotpMaxWaits; i++ {
+		peer.send(t, tpRxID, 0x31, 0, 0)
+		time.Sleep(10 * time.Millisecond) // one at a time, the sender keeps only one
+	}
+	client.waitError(t, 2, "asked to wait")
+	peer.expectNothing(t)
+}
+
+func TestISOTPSendTimeout(t *testing.T) {
+	peer, client := isotpBridge(t, "timeout: 50ms")
+	client.deliver(t, "test/text", "0123456789")
+	peer.expect(t, tpTxID, 0x10, 10)
+	client.waitError(t, 1, "no flow control within 50ms")
+	// flow control after the timeout is ignored
+	peer.send(t, tpRxID, 0x30, 0, 0)
+	peer.expectNothing(t)
+}
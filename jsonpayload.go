@@ -0,0 +1,138 @@
+package can2mqtt_tuc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// payload formats of a mapping
+const (
+	formatText = "text" // one value per topic, several numbers separated by spaces
+	formatJSON = "json" // one object with named values on one topic
+)
+
+// resolveNames decides on the names of the values of a mapping with
+// JSON payloads: the names of the mapping, the names of a
+// NamedConverter or "value" for converters with a single value. A
+// converter with one value that holds several numbers separated by
+// spaces (2uint322ascii, setup2motor, ...) gets one name per number.
+func resolveNames(c2mp *can2mqtt) error {
+	n := c2mp.conv.Values()
+	if len(c2mp.names) == 0 {
+		if named, ok := c2mp.conv.(NamedConverter); ok {
+			c2mp.names = named.Names()
+		} else if n == 1 {
+			c2mp.names = []string{"value"}
+		} else {
+			return fmt.Errorf("format json needs the names of the %d values", n)
+		}
+	}
+	if len(c2mp.names) != n && n != 1 {
+		return fmt.Errorf("format json needs %d names, got %d", n, len(c2mp.names))
+	}
+	seen := make(map[string]bool)
+	for _, name := range c2mp.names {
+		if name == "" || seen[name] {
+			return fmt.Errorf("names must not be empty or used twice")
+		}
+		if name == "unit" && c2mp.unit != "" {
+			return fmt.Errorf("the name unit is used for the unit of the mapping")
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// splitsValue tells whether the single value of the converter is
+// split into several named numbers
+func (c2mp *can2mqtt) splitsValue() bool {
+	return c2mp.conv.Values() == 1 && len(c2mp.names) > 1
+}
+
+// values2json builds the JSON object of the decoded values, numbers
+// are published as numbers and everything else as strings. The unit
+// of the mapping is added as "unit".
+func (c2mp *can2mqtt) values2json(values []string) (string, error) {
+	if c2mp.splitsValue() {
+		values = strings.Fields(values[0])
+	}
+	if len(values) != len(c2mp.names) {
+		return "", fmt.Errorf("format json: %d names for %d values", len(c2mp.names), len(values))
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, name := range c2mp.names {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(name)
+		buf.Write(key)
+		buf.WriteByte(':')
+		if json.Unmarshal([]byte(values[i]), new(float64)) == nil {
+			buf.WriteString(values[i])
+		} else {
+			str, _ := json.Marshal(values[i])
+			buf.Write(str)
+		}
+	}
+	if c2mp.unit != "" {
+		unit, _ := json.Marshal(c2mp.unit)
+		buf.WriteString(`,"unit":`)
+		buf.Write(unit)
+	}
+	buf.WriteByte('}')
+	return buf.String(), nil
+}
+
+// json2values extracts the values from a JSON object received from
+// MQTT. Every value of the mapping has to be in the object, a unit sent
+// back is ignored.
+func (c2mp *can2mqtt) json2values(payload string) ([]string, error) {
+	var obj map[string]interface{}
+	d := json.NewDecoder(strings.NewReader(payload))
+	d.UseNumber()
+	if err := d.Decode(&obj); err != nil {
+		return nil, fmt.Errorf("format json: payload is not a JSON object: %w", err)
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return nil, fmt.Errorf("format json: payload has more than one JSON object")
+	}
+	if obj == nil {
+		return nil, fmt.Errorf("format json: payload is not a JSON object")
+	}
+	values := make([]string, len(c2mp.names))
+	for key, v := range obj {
+		if key == "unit" && c2mp.unit != "" {
+			continue
+		}
+		i := indexOf(c2mp.names, key)
+		if i < 0 {
+			return nil, fmt.Errorf("format json: unknown value %s, valid names are %s", key, strings.Join(c2mp.names, ", "))
+		}
+		switch v := v.(type) {
+		case json.Number:
+			values[i] = v.String()
+		case string:
+			values[i] = v
+		case bool:
+			values[i] = "0"
+			if v {
+				values[i] = "1"
+			}
+		default:
+			return nil, fmt.Errorf("format json: value %s must be a number, string or bool", key)
+		}
+	}
+	for _, name := range c2mp.names {
+		if _, ok := obj[name]; !ok {
+			return nil, fmt.Errorf("format json: value %s is missing", name)
+		}
+	}
+	if c2mp.splitsValue() {
+		return []string{strings.Join(values, " ")}, nil
+	}
+	return values, nil
+}
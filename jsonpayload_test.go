@@ -0,0 +1,95 @@
+package can2mqtt_tuc
+
+import (
+	"strings"
+	"testing"
+)
+
+// jsonPair returns a mapping with JSON payloads for the convert-mode
+func jsonPair(t *testing.T, mode string, names []string, unit string) *can2mqtt {
+	t.Helper()
+	conv, err := newConverter(ConverterConfig{Mode: mode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2mp := &can2mqtt{convMethod: mode, conv: conv, names: names, unit: unit, format: formatJSON}
+	if err := resolveNames(c2mp); err != nil {
+		t.Fatal(err)
+	}
+	return c2mp
+}
+
+func TestJSONPayloadRoundTrip(t *testing.T) {
+	tests := []struct {
+		mode    string
+		names   []string
+		unit    string
+		values  []string
+		payload string
+	}{
+		{"uint162ascii", nil, "", []string{"4660"}, `{"value":4660}`},
+		{"uint162ascii", nil, "rpm", []string{"4660"}, `{"value":4660,"unit":"rpm"}`},
+		{"motor2ascii", []string{"speed", "torque", "state"}, "", []string{"-100", "200", "3"},
+			`{"speed":-100,"torque":200,"state":3}`},
+		{"setup2motor", []string{"a", "b", "c"}, "", []string{"1 -2 3"}, `{"a":1,"b":-2,"c":3}`},
+		{"none", nil, "", []string{"hi"}, `{"value":"hi"}`},
+	}
+	for _, tt := range tests {
+		c2mp := jsonPair(t, tt.mode, tt.names, tt.unit)
+		payload, err := c2mp.values2json(tt.values)
+		if err != nil {
+			t.Errorf("%s: %s", tt.mode, err)
+			continue
+		}
+		if payload != tt.payload {
+			t.Errorf("%s: %q published as %s, want %s", tt.mode, tt.values, payload, tt.payload)
+		}
+		values, err := c2mp.json2values(payload)
+		if err != nil {
+			t.Errorf("%s: %s: %s", tt.mode, payload, err)
+			continue
+		}
+		if strings.Join(values, "|") != strings.Join(tt.values, "|") {
+			t.Errorf("%s: %s received as %q, want %q", tt.mode, payload, values, tt.values)
+		}
+	}
+}
+
+func TestJSONPayloadValues(t *testing.T) {
+	c2mp := jsonPair(t, "motor2ascii", []string{"speed", "torque", "state"}, "Nm")
+	// order of the keys, bools and numbers as strings don't matter, the
+	// unit is ignored
+	values, err := c2mp.json2values(` {"state":true,"unit":"Nm","torque":"200","speed":-1.5e2} `)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "-1.5e2|200|1"; strings.Join(values, "|") != want {
+		t.Errorf("got %q, want %s", values, want)
+	}
+}
+
+func TestJSONPayloadReject(t *testing.T) {
+	motor := jsonPair(t, "motor2ascii", []string{"speed", "torque", "state"}, "")
+	none := jsonPair(t, "none", nil, "")
+	split := jsonPair(t, "setup2motor", []string{"a", "b", "c"}, "")
+	tests := []struct {
+		c2mp    *can2mqtt
+		payload string
+	}{
+		{motor, `{"speed":1,"torque":2}`}, // state is missing
+		{motor, `{"speed":1,"torque":2,"state":3,"x":4}`},
+		{motor, `{"speed":1,"torque":2,"state":3,"unit":"Nm"}`}, // no unit
+		{motor, `{"speed":1,"torque":2,"state":[3]}`},
+		{motor, `{"speed":1,"torque":2,"state":3} {"speed":4}`},
+		{motor, `{"speed":1,"torque":2,"state":3}x`},
+		{motor, `[1,2,3]`},
+		{motor, `null`},
+		{none, `{}`},
+		{split, `{"a":1,"c":3}`},
+	}
+	for _, tt := range tests {
+		if values, err := tt.c2mp.json2values(tt.payload); err == nil {
+			t.Errorf("%s: %s received as %q, want an error", tt.c2mp.convMethod, tt.payload, values)
+		}
+	}
+}
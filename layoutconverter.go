@@ -0,0 +1,212 @@
+package can2mqtt_tuc
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Field describes one value of a frame for the convert-mode layout.
+// In a YAML file it is an entry of the fields list of a mapping.
+type Field struct {
+	Name   string  `yaml:"name"`   // name of the value, default: last level of the topic
+	Byte   int     `yaml:"byte"`   // first byte of the field
+	Bit    int     `yaml:"bit"`    // position of the lowest bit in its byte (0-7), default: 0
+	Length int     `yaml:"length"` // length in bits, default: 8
+	Type   string  `yaml:"type"`   // unsigned (default), signed, float, q<m>.<n> or uq<m>.<n>
+	Endian string  `yaml:"endian"` // little (default) or big
+	Scale  float64 `yaml:"scale"`  // the value is raw*scale+offset, default: 1
+	Offset float64 `yaml:"offset"`
+	Topic  string  `yaml:"topic"` // MQTT-topic of the value
+
+	Values map[int64]string `yaml:"values"` // labels of raw values
+}
+
+func init() {
+	if err := RegisterConverter("layout", newLayoutConverter); err != nil {
+		panic(err)
+	}
+}
+
+// layoutConverter decodes and encodes the fields of a mapping, each
+// field is one value
+type layoutConverter struct {
+	signals []*signal
+	size    int // data bytes needed for the fields
+	length  int // data bytes of encoded frames
+}
+
+// newLayoutConverter creates the converter for the fields of a
+// mapping. The frames it encodes are as long as needed for the fields
+// or have the length given by the parameter dlc. The parameter endian
+// is the byte order of fields without own one.
+func newLayoutConverter(conf ConverterConfig) (Converter, error) {
+	if len(conf.Fields) == 0 {
+		return nil, fmt.Errorf("no fields given")
+	}
+	c := &layoutConverter{}
+	names := make(map[string]bool)
+	for i, f := range conf.Fields {
+		if f.Endian == "" {
+			f.Endian = conf.Params["endian"] // default of the mapping
+		}
+		sig, err := f.signal(i)
+		if err != nil {
+			return nil, err
+		}
+		if names[sig.name] {
+			return nil, fmt.Errorf("field name %s is used twice", sig.name)
+		}
+		names[sig.name] = true
+		for _, p := range sig.bitPositions() {
+			if p/8+1 > c.size {
+				c.size = p/8 + 1
+			}
+		}
+		c.signals = append(c.signals, sig)
+	}
+	if c.size > 64 {
+		return nil, fmt.Errorf("the fields need %d bytes, a CAN FD frame has 64", c.size)
+	}
+	c.length = c.size
+	if dlc, ok := conf.Params["dlc"]; ok {
+		n, err := strconv.Atoi(dlc)
+		if err != nil || n < c.size || !validLength(n, true) {
+			return nil, fmt.Errorf("invalid dlc %q, the fields need %d bytes, valid lengths are 0 to 8 and 12, 16, 20, 24, 32, 48 or 64 for CAN FD", dlc, c.size)
+		}
+		c.length = n
+	}
+	return c, nil
+}
+
+// signal converts the field into the description of a DBC signal
+func (f Field) signal(i int) (*signal, error) {
+	sig := &signal{
+		name:   f.Name,
+		length: f.Length,
+		factor: f.Scale,
+		offset: f.Offset,
+		values: f.Values,
+	}
+	if sig.name == "" && f.Topic != "" {
+		sig.name = path.Base(f.Topic)
+	}
+	if sig.name == "" {
+		sig.name = "field" + strconv.Itoa(i+1)
+	}
+	if sig.length == 0 {
+		sig.length = 8
+	}
+	if sig.factor == 0 {
+		sig.factor = 1
+	}
+	switch f.Type {
+	case "", "unsigned":
+	case "signed":
+		sig.signed = true
+	case "float":
+		sig.float = true
+	default:
+		signed, m, n, ok := parseQFormat(f.Type)
+		if !ok {
+			return nil, fmt.Errorf("field %s: invalid type %q, valid types are unsigned, signed, float, q<m>.<n> and uq<m>.<n>", sig.name, f.Type)
+		}
+		if f.Length != 0 && f.Length != m+n {
+			return nil, fmt.Errorf("field %s: type %s has %d bits, not %d", sig.name, f.Type, m+n, f.Length)
+		}
+		sig.length = m + n
+		sig.signed = signed
+		sig.factor *= math.Ldexp(1, -n)
+	}
+	if f.Byte < 0 || f.Bit < 0 || f.Bit > 7 {
+		return nil, fmt.Errorf("field %s: invalid position byte %d bit %d", sig.name, f.Byte, f.Bit)
+	}
+	switch f.Endian {
+	case "", "little":
+		sig.startBit = f.Byte*8 + f.Bit
+	case "big":
+		// the lowest bit is in the last byte of the field, walk up to
+		// the most significant bit, which is the start bit in DBC terms
+		sig.bigEndian = true
+		last := f.Byte + (f.Bit+sig.length-1)/8
+		p := last*8 + f.Bit
+		for i := 1; i < sig.length; i++ {
+			if p%8 == 7 {
+				p -= 15
+			} else {
+				p++
+			}
+		}
+		sig.startBit = p
+	default:
+		return nil, fmt.Errorf("field %s: invalid endian %q, valid values are little and big", sig.name, f.Endian)
+	}
+	if err := sig.check(64); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+func (c *layoutConverter) Values() int { return len(c.signals) }
+
+func (c *layoutConverter) dataLength() int { return c.length }
+
+func (c *layoutConverter) Names() []string {
+	names := make([]string, len(c.signals))
+	for i, sig := range c.signals {
+		names[i] = sig.name
+	}
+	return names
+}
+
+func (c *layoutConverter) Decode(data []byte) ([]string, error) {
+	if len(data) < c.size {
+		return nil, fmt.Errorf("frame has %d data bytes, %d needed", len(data), c.size)
+	}
+	values := make([]string, len(c.signals))
+	for i, sig := range c.signals {
+		values[i] = sig.decode(data)
+	}
+	return values, nil
+}
+
+func (c *layoutConverter) Encode(values []string) ([]byte, error) {
+	if len(values) != len(c.signals) {
+		return nil, fmt.Errorf("expected %d values, got %d", len(c.signals), len(values))
+	}
+	data := make([]byte, c.length)
+	for i, sig := range c.signals {
+		if values[i] == "" {
+			return nil, fmt.Errorf("no value for field %s", sig.name)
+		}
+		if err := sig.encode(data, values[i]); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// parseQFormat parses the fixed-point types q<m>.<n> (signed) and
+// uq<m>.<n> (unsigned) with m integer bits, including the sign bit, and
+// n fractional bits, e.g. q1.15 or uq8.8
+func parseQFormat(t string) (signed bool, m, n int, ok bool) {
+	t = strings.ToLower(t)
+	switch {
+	case strings.HasPrefix(t, "uq"):
+		t = t[2:]
+	case strings.HasPrefix(t, "q"):
+		signed = true
+		t = t[1:]
+	default:
+		return false, 0, 0, false
+	}
+	ms, ns, found := strings.Cut(t, ".")
+	m, err1 := strconv.Atoi(ms)
+	n, err2 := strconv.Atoi(ns)
+	if !found || err1 != nil || err2 != nil || m < 0 || n < 0 || m+n < 1 || m+n > 64 || (signed && m < 1) {
+		return false, 0, 0, false
+	}
+	return signed, m, n, true
+}
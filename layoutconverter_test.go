@@ -0,0 +1,72 @@
+package can2mqtt_tuc
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// the start bits are the ones of a DBC file for the same signal, e.g.
+// 7|16@0+ for the big endian field at byte 0 with 16 bits
+func TestFieldStartBit(t *testing.T) {
+	tests := []struct {
+		field    Field
+		startBit int
+		lsb      int // position of the lowest bit
+		data     []byte
+		raw      int64
+	}{
+		{Field{Byte: 0, Length: 16}, 0, 0, []byte{0x34, 0x12}, 0x1234},
+		{Field{Byte: 1, Bit: 4, Length: 4}, 12, 12, []byte{0, 0xA0}, 0xA},
+		{Field{Byte: 2, Endian: "big"}, 23, 16, []byte{0, 0, 0x5A}, 0x5A},
+		{Field{Byte: 0, Length: 16, Endian: "big"}, 7, 8, []byte{0x12, 0x34}, 0x1234},
+		{Field{Byte: 1, Bit: 2, Length: 4, Endian: "big"}, 13, 10, []byte{0, 0x28}, 0xA},
+		// the lowest 4 bits in the upper half of byte 1
+		{Field{Byte: 0, Bit: 4, Length: 12, Endian: "big"}, 7, 12, []byte{0xAB, 0xC0}, 0xABC},
+		// 2 bits in byte 3, 8 in byte 4
+		{Field{Byte: 3, Length: 10, Endian: "big"}, 25, 32, []byte{0, 0, 0, 0x02, 0xFF}, 0x2FF},
+		{Field{Byte: 0, Length: 32, Endian: "big"}, 7, 24, []byte{0x12, 0x34, 0x56, 0x78}, 0x12345678},
+		{Field{Byte: 1, Length: 16, Type: "signed", Endian: "big"}, 15, 16, []byte{0, 0xFF, 0xFE}, -2},
+	}
+	for _, tt := range tests {
+		sig, err := tt.field.signal(0)
+		if err != nil {
+			t.Errorf("%+v: %s", tt.field, err)
+			continue
+		}
+		if sig.startBit != tt.startBit {
+			t.Errorf("%+v: start bit %d, want %d", tt.field, sig.startBit, tt.startBit)
+		}
+		pos := sig.bitPositions()
+		if pos[len(pos)-1] != tt.lsb {
+			t.Errorf("%+v: lowest bit %d, want %d", tt.field, pos[len(pos)-1], tt.lsb)
+		}
+		if raw := sig.raw(tt.data); raw != tt.raw {
+			t.Errorf("%+v: raw %X of % X, want %X", tt.field, raw, tt.data, tt.raw)
+		}
+		data := make([]byte, len(tt.data))
+		sig.setRaw(data, tt.raw)
+		if !bytes.Equal(data, tt.data) {
+			t.Errorf("%+v: %X packed as % X, want % X", tt.field, tt.raw, data, tt.data)
+		}
+	}
+}
+
+func TestFieldErrors(t *testing.T) {
+	tests := []struct {
+		field   Field
+		problem string
+	}{
+		{Field{Name: "x", Bit: 8}, "invalid position byte 0 bit 8"},
+		{Field{Name: "x", Byte: -1}, "invalid position byte -1"},
+		{Field{Name: "x", Endian: "middle"}, `invalid endian "middle"`},
+		{Field{Name: "x", Type: "int"}, `invalid type "int"`},
+		{Field{Name: "x", Type: "q1.15", Length: 8}, "type q1.15 has 16 bits, not 8"},
+		{Field{Topic: "test/temp", Type: "int"}, "field temp:"},
+	}
+	for _, tt := range tests {
+		if _, err := tt.field.signal(0); err == nil || !strings.Contains(err.Error(), tt.problem) {
+			t.Errorf("%+v: got %v, want %q", tt.field, err, tt.problem)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package can2mqtt_tuc
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// linkState is the state of the CAN-Bus interface of a bridge
+type linkState struct {
+	mu     sync.Mutex
+	up     bool
+	since  time.Time
+	reason string // why it is down
+	frames uint64 // atomic, frames received since the bridge was created
+}
+
+// received returns how many frames were received so far
+func (ls *linkState) received() uint64 {
+	return atomic.LoadUint64(&ls.frames)
+}
+
+// linkStatus is published as JSON to the status topic whenever the
+// CAN-Bus interface goes down or comes back
+type linkStatus struct {
+	Interface string `json:"interface"`
+	State     string `json:"state"` // up or down
+	Since     string `json:"since"` // RFC 3339
+	Reason    string `json:"reason,omitempty"`
+}
+
+// CANLinkUp tells whether the CAN-Bus interface of the bridge is open
+// and working.
+func (b *Bridge) CANLinkUp() bool {
+	b.link.mu.Lock()
+	defer b.link.mu.Unlock()
+	return b.link.up
+}
+
+// canUp marks the interface as working
+func (b *Bridge) canUp() {
+	b.link.mu.Lock()
+	wasDown := !b.link.up && !b.link.since.IsZero()
+	b.link.up, b.link.since, b.link.reason = true, time.Now(), ""
+	b.link.mu.Unlock()
+	if wasDown {
+		fmt.Printf("canbushandler: CAN-Bus interface %s is up again\n", b.conf.CANInterface)
+	}
+	b.publishLinkState()
+}
+
+// canDown marks the interface as failed, frames from MQTT are rejected
+// until it is back
+func (b *Bridge) canDown(reason error) {
+	b.link.mu.Lock()
+	b.link.up, b.link.since, b.link.reason = false, time.Now(), reason.Error()
+	b.link.mu.Unlock()
+	fmt.Printf("canbushandler: CAN-Bus interface %s is down, reopening it: %s\n", b.conf.CANInterface, reason)
+	b.publishLinkState()
+}
+
+// publishLinkState publishes the state of the interface retained on
+// the status topic, if there is one
+func (b *Bridge) publishLinkState() {
+	if b.conf.StatusTopic == "" || b.client == nil {
+		return
+	}
+	b.link.mu.Lock()
+	ls := linkStatus{
+		Interface: b.conf.CANInterface,
+		State:     "down",
+		Since:     b.link.since.Format(time.RFC3339),
+		Reason:    b.link.reason,
+	}
+	if b.link.up {
+		ls.State = "up"
+	}
+	b.link.mu.Unlock()
+	payload, err := json.Marshal(ls)
+	if err != nil {
+		return
+	}
+	token := b.client.Publish(b.conf.StatusTopic, b.conf.QoS, true, payload)
+	token.Wait()
+	if token.Error() != nil {
+		fmt.Printf("mqtthandler: error while publishing to the status topic %s: %s\n", b.conf.StatusTopic, token.Error())
+	}
+}
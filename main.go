@@ -2,210 +2,478 @@ package can2mqtt_tuc
 
 import (
 	"bufio"        // Reader
+	"context"      // lifecycle of a bridge
 	"encoding/csv" // CSV Management
-	"fmt"          // print :)
-	"io"           // EOF const
-	"log"          // error management
-	"os"           // open files
-	"strconv"      // parse strings
+	"errors"
+	"fmt" // print :)
+	"io"  // EOF const
+	"os"  // open files
+	"path/filepath"
+	"strconv" // parse strings
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/brutella/can"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
 )
 
 // can2mqtt is a struct that represents the internal type of
-// one line of the can2mqtt.csv file. It has
-// the same three fields as the can2mqtt.csv file: CAN-ID,
-// conversion method and MQTT-Topic.
+// one line of the can2mqtt.csv file or one mapping of a YAML
+// configuration file. The first three fields are the same as in the
+// can2mqtt.csv file: CAN-ID, conversion method and MQTT-Topic. The
+// others can only be set in a YAML configuration file.
 type can2mqtt struct {
-	canId      int
-	convMethod string
-	mqttTopic  []string
+	canId       int
+	convMethod  string
+	mqttTopic   []string
+	direction   DirMode           // directional mode of this mapping
+	qos         *byte             // MQTT quality of service, nil: Config.QoS
+	retain      *bool             // MQTT retain flag, nil: Config.Retain
+	extended    bool              // CAN extended frame format (29 bit ID)
+	fd          bool              // CAN FD frames, up to 64 data bytes
+	brs         bool              // CAN FD frames with bit rate switch
+	description string            // free text, for humans only
+	unit        string            // engineering unit of the value
+	scaling     *scaling          // raw numbers -> unit, nil: not scaled
+	table       *valueTable       // raw numbers -> labels, nil: none
+	mux         *multiplexer      // multiplexed frames only
+	isotp       *isotp            // ISO-TP transport, nil: single frames
+	params      map[string]string // parameters for the convert-mode
+	fields      []Field           // fields for the convert-mode layout
+	format      string            // payload format: text (default) or json
+	names       []string          // names of the values in JSON payloads
+	cmdTopic    string            // topic for MQTT->CAN if it is not mqttTopic[0]
+	conv        Converter         // resolved convert-mode, see resolveConverters
+	dbc         *dbcMessage       // message of a DBC file (convert-mode dbc)
+	file        string            // where the mapping was defined,
+	line        int               // for error messages
 }
 
-var pairFromID map[int]*can2mqtt       // c2m pair (lookup from ID)
-var pairFromTopic map[string]*can2mqtt // c2m pair (lookup from Topic)
-var dbg = false                        // verbose on off [-v]
-var ci = "can0"                        // the CAN-Interface [-c]
-var cs = "tcp://localhost:1883"        // mqtt-connect-string [-m]
-var c2mf = "can2mqtt.csv"              // path to the can2mqtt.csv [-f]
-var dirMode = 0                        // directional modes: 0=bidirectional 1=can2mqtt only 2=mqtt2can only [-d]
-var wg sync.WaitGroup
+// subTopic returns the topic the mapping receives MQTT messages on
+func (c2mp *can2mqtt) subTopic() string {
+	if c2mp.cmdTopic != "" {
+		return c2mp.cmdTopic
+	}
+	return c2mp.mqttTopic[0]
+}
 
-// SetDbg decides whether there is really verbose output or
-// just standard information output. Default is false.
-func SetDbg(v bool) {
-	dbg = v
+// topics returns every topic of the mapping: the ones it publishes to
+// and its command topic
+func (c2mp *can2mqtt) topics() []string {
+	if c2mp.cmdTopic != "" {
+		return append(c2mp.mqttTopic[:len(c2mp.mqttTopic):len(c2mp.mqttTopic)], c2mp.cmdTopic)
+	}
+	return c2mp.mqttTopic
 }
 
-// SetCi sets the CAN-Interface to use for the CAN side
-// of the bridge. Default is: can0.
-func SetCi(c string) {
-	ci = c
+// frameID returns the ID of the mapping the way it is used in CAN
+// frames: with the extended frame format flag for extended IDs
+func (c2mp *can2mqtt) frameID() uint32 {
+	if c2mp.extended {
+		return uint32(c2mp.canId)&can.MaskIDEff | can.MaskEff
+	}
+	return uint32(c2mp.canId) & can.MaskIDEff
 }
 
-// SetC2mf expects a string which is a path to a can2mqtt.csv file
-// Default is: can2mqtt.csv
-func SetC2mf(f string) {
-	c2mf = f
+// frameIDOf returns the ID of a received frame with the extended
+// frame format flag, but without the RTR and error flags
+func frameIDOf(frame Frame) uint32 {
+	if frame.ID&can.MaskEff != 0 {
+		return frame.ID&can.MaskIDEff | can.MaskEff
+	}
+	return frame.ID & can.MaskIDSff
 }
 
-// SetCs sets the MQTT connect-string which contains: protocol,
-// hostname and port. Default is: tcp://localhost:1883
-func SetCs(s string) {
-	cs = s
+// DirMode selects in which direction(s) the bridge forwards messages.
+type DirMode int
+
+const (
+	DirBidirectional DirMode = iota // CAN <-> MQTT
+	DirCAN2MQTT                     // CAN -> MQTT only
+	DirMQTT2CAN                     // MQTT -> CAN only
+)
+
+// ParseDirMode parses the value of the -d commandline parameter or a
+// direction in a YAML configuration file. Valid values are 0 or both
+// (bidirectional), 1 or can2mqtt (can2mqtt only) and 2 or mqtt2can
+// (mqtt2can only).
+func ParseDirMode(s string) (DirMode, error) {
+	switch s {
+	case "0", "both":
+		return DirBidirectional, nil
+	case "1", "can2mqtt":
+		return DirCAN2MQTT, nil
+	case "2", "mqtt2can":
+		return DirMQTT2CAN, nil
+	}
+	return DirBidirectional, fmt.Errorf("error: got invalid direction (%s). Valid values are 0/both (bidirectional), 1/can2mqtt (can2mqtt only) or 2/mqtt2can (mqtt2can only)", s)
 }
 
-// SetConfDirMode sets the dirMode
-func SetConfDirMode(s string) {
-	if s == "0" {
-		dirMode = 0
-	} else if s == "1" {
-		dirMode = 1
-	} else if s == "2" {
-		dirMode = 2
-	} else {
-		_ = fmt.Errorf("error: got invalid value for -d (%s). Valid values are 0 (bidirectional), 1 (can2mqtt only) or 2 (mqtt2can only)", s)
+func (d DirMode) String() string {
+	switch d {
+	case DirCAN2MQTT:
+		return "can2mqtt"
+	case DirMQTT2CAN:
+		return "mqtt2can"
 	}
+	return "both"
+}
+
+// toMQTT tells whether frames are forwarded from CAN to MQTT
+func (d DirMode) toMQTT() bool {
+	return d != DirMQTT2CAN
+}
+
+// toCAN tells whether messages are forwarded from MQTT to CAN
+func (d DirMode) toCAN() bool {
+	return d != DirCAN2MQTT
 }
 
-// Start is the function that should be called after debug-level
-// connect-string, can interface and can2mqtt file have been set.
-// Start takes care of everything that happens after that.
-// It starts the CAN-Bus connection and the MQTT-Connection. It
-// parses the can2mqtt.csv file and from there everything takes
-// its course...
-func Start() {
+// forwardsToMQTT tells whether the CAN-ID of a mapping is subscribed,
+// both the global and the per mapping direction must allow it
+func (b *Bridge) forwardsToMQTT(c2mp *can2mqtt) bool {
+	return b.conf.DirMode.toMQTT() && c2mp.direction.toMQTT()
+}
+
+// forwardsToCAN tells whether the MQTT-topic of a mapping is
+// subscribed, both the global and the per mapping direction must
+// allow it
+func (b *Bridge) forwardsToCAN(c2mp *can2mqtt) bool {
+	return b.conf.DirMode.toCAN() && c2mp.direction.toCAN()
+}
+
+// qosOf returns the QoS used for subscribing and publishing the
+// topics of a mapping
+func (b *Bridge) qosOf(c2mp *can2mqtt) byte {
+	if c2mp.qos != nil {
+		return *c2mp.qos
+	}
+	return b.conf.QoS
+}
+
+// retainOf tells whether the messages published for a mapping are
+// retained by the broker
+func (b *Bridge) retainOf(c2mp *can2mqtt) bool {
+	if c2mp.retain != nil {
+		return *c2mp.retain
+	}
+	return b.conf.Retain
+}
+
+// Config contains all settings of a Bridge. Empty fields are
+// replaced by the defaults noted next to them.
+type Config struct {
+	Debug        bool    // verbose on off [-v]
+	CANInterface string  // the CAN-Interface [-c], default: can0
+	MQTTConnect  string  // mqtt-connect-string [-m], default: tcp://localhost:1883
+	MQTTClientID string  // client id at the broker, default: CAN2MQTT
+	ErrorTopic   string  // frames that can't be converted are reported here [-e], default: off
+	StatusTopic  string  // state of the CAN-Bus interface, published retained [-s], default: off
+	MappingFile  string  // path to the can2mqtt.csv [-f], default: can2mqtt.csv
+	DirMode      DirMode // directional mode [-d], default: bidirectional
+	QoS          byte    // MQTT QoS of mappings without own setting [-q], default: 0
+	Retain       bool    // MQTT retain flag of mappings without own setting [-r]
+	// WatchInterval enables polling the MappingFile for changes, it is
+	// reloaded if it changed. Default: 0 (off), see also Bridge.Reload
+	WatchInterval time.Duration
+	// CANBackend is the CAN side of the bridge, default: SocketCAN
+	// on CANInterface. See NewVirtualBus for running without hardware.
+	CANBackend CANBackend
+	// MQTTClient is the MQTT side of the bridge, default: a paho
+	// client for MQTTConnect and MQTTClientID. Run connects it if it
+	// isn't connected yet and disconnects it when it returns.
+	MQTTClient MQTT.Client
+	// Workers convert and publish the received frames, the frames of
+	// one ID always by the same worker in the order they were
+	// received. Default: 4
+	Workers int
+	// QueueSize is the number of frames waiting for each worker,
+	// default: 256
+	QueueSize int
+	// Overflow selects what happens to a frame when the queue of its
+	// worker is full [-o], default: OverflowBlock. See Bridge.Dropped.
+	Overflow OverflowPolicy
+}
+
+// Bridge connects one CAN-Interface with one MQTT-Broker. Several
+// bridges can live in the same process, each one is started with Run.
+type Bridge struct {
+	conf          Config
+	pairFromID    map[uint32][]*can2mqtt // c2m pairs (lookup from frame ID), several for multiplexed frames
+	pairFromTopic map[string]*can2mqtt   // c2m pair (lookup from Topic)
+	pairLock      sync.RWMutex           // protects the c2m pair maps
+	reloadLock    sync.Mutex             // only one (re)load at a time
+	csi           map[uint32]int         // subscribed frame IDs -> number of mappings
+	csiLock       sync.RWMutex           // CAN subscribed IDs Mutex
+	tp            isotpState             // running ISO-TP transfers
+	link          linkState              // state of the CAN-Bus interface
+	work          pipeline               // workers for received frames
+	bus           CANBackend             // CAN-Bus backend
+	client        MQTT.Client            // MQTT-Client
+	echoes        map[string]*echoState  // subscribed topics -> own messages, see isEcho
+	echoLock      sync.Mutex             // protects echoes
+	user, pw      string                 // MQTT credentials from the connect-string
+}
+
+// NewBridge returns a Bridge for the given Config. Nothing is
+// connected before Run is called.
+func NewBridge(conf Config) *Bridge {
+	if conf.CANInterface == "" {
+		conf.CANInterface = "can0"
+	}
+	if conf.MQTTConnect == "" {
+		conf.MQTTConnect = "tcp://localhost:1883"
+	}
+	if conf.MQTTClientID == "" {
+		conf.MQTTClientID = "CAN2MQTT"
+	}
+	if conf.MappingFile == "" {
+		conf.MappingFile = "can2mqtt.csv"
+	}
+	if conf.CANBackend == nil {
+		conf.CANBackend = NewSocketCAN(conf.CANInterface)
+	}
+	if conf.Workers <= 0 {
+		conf.Workers = defaultWorkers
+	}
+	if conf.QueueSize <= 0 {
+		conf.QueueSize = defaultQueueSize
+	}
+	b := &Bridge{conf: conf, bus: conf.CANBackend, client: conf.MQTTClient}
+	b.bus.Subscribe(b.handleCANFrame)
+	return b
+}
+
+// Run takes care of everything that happens after the bridge has
+// been configured. It starts the CAN-Bus connection and the
+// MQTT-Connection, parses the can2mqtt.csv file and from there
+// everything takes its course... until ctx is cancelled. While the
+// bridge runs the mappings can be reloaded with Reload. Then the
+// CAN-Bus and the MQTT-Client are shut down and Run returns nil.
+// A CAN-Bus interface that is missing or fails is reopened until it
+// works (see Config.StatusTopic). If anything else goes wrong on the
+// way, Run shuts down whatever was already started and returns the
+// error.
+func (b *Bridge) Run(ctx context.Context) error {
 	fmt.Println("Starting can2mqtt")
 	fmt.Println()
-	fmt.Println("MQTT-Config:  ", cs)
-	fmt.Println("CAN-Config:   ", ci)
-	fmt.Println("can2mqtt.csv: ", c2mf)
+	fmt.Println("MQTT-Config:  ", b.conf.MQTTConnect)
+	fmt.Println("CAN-Config:   ", b.conf.CANInterface)
+	fmt.Println("Mapping-File: ", b.conf.MappingFile)
 	fmt.Print("Debug-Mode:    ")
-	if dbg {
+	if b.conf.Debug {
 		fmt.Println("yes")
 	} else {
 		fmt.Println("no")
 	}
 	fmt.Println()
-	wg.Add(1)
-	go canStart(ci) // epic parallel shit ;-)
-	mqttStart(cs)
-	readC2MPFromFile(c2mf)
-	wg.Wait()
+	if err := b.mqttStart(b.conf.MQTTConnect); err != nil {
+		return err
+	}
+	canUp := b.canStart(b.conf.CANInterface)
+	if err := b.readC2MPFromFile(b.conf.MappingFile); err != nil {
+		b.forgetMappings()
+		b.mqttStop()
+		b.canStop()
+		return err
+	}
+	defer b.forgetMappings()
+	if b.conf.WatchInterval > 0 {
+		watchCtx, stopWatching := context.WithCancel(ctx)
+		defer stopWatching()
+		go b.watchMappingFile(watchCtx, b.conf.WatchInterval)
+	}
+	b.work.start(b.conf.Workers, b.conf.QueueSize, b.conf.Overflow)
+	reportCtx, stopReporting := context.WithCancel(ctx)
+	defer stopReporting()
+	go b.reportDrops(reportCtx)
+	b.canListen(ctx, canUp)
+	// no new frames first, then the workers and MQTT
+	b.canStop()
+	b.work.stop()
+	b.mqttStop()
+	return nil
 }
 
 // this functions opens, parses and extracts information out
-// of the can2mqtt.csv
-func readC2MPFromFile(filename string) {
+// of the mapping file and subscribes all mappings found in it
+func (b *Bridge) readC2MPFromFile(filename string) error {
+	b.pairLock.Lock()
+	b.pairFromID = make(map[uint32][]*can2mqtt)
+	b.pairFromTopic = make(map[string]*can2mqtt)
+	b.pairLock.Unlock()
+	b.csiLock.Lock()
+	b.csi = make(map[uint32]int)
+	b.csiLock.Unlock()
+	return b.loadMappings(filename)
+}
+
+// forgetMappings drops all mappings after the bridge stopped
+func (b *Bridge) forgetMappings() {
+	b.pairLock.Lock()
+	b.pairFromID = nil
+	b.pairFromTopic = nil
+	b.pairLock.Unlock()
+}
+
+// readMappings reads the mappings of a YAML configuration file
+// (*.yaml, *.yml), a DBC file (*.dbc) or of a can2mqtt.csv
+// (everything else). All problems found in the file are returned
+// as *ValidationError.
+func readMappings(filename string) ([]*can2mqtt, error) {
+	var ps problems
+	var pairs []*can2mqtt
+	if IsYAMLFile(filename) {
+		pairs = readMappingsFromYAML(filename, &ps)
+	} else if strings.ToLower(filepath.Ext(filename)) == ".dbc" {
+		pairs = dbcMappings(filename, "", "", nil, &ps)
+	} else {
+		pairs = readMappingsFromCSV(filename, &ps)
+	}
+	resolveConverters(pairs, &ps)
+	validateMappings(pairs, &ps)
+	if err := ps.err(); err != nil {
+		return nil, err
+	}
+	return pairs, nil
+}
 
+// readMappingsFromCSV parses the columns of a can2mqtt.csv: CAN-ID,
+// convert-mode, MQTT-topic and optionally the frame format (std or
+// ext). Lines with problems are skipped, so are blank lines, comments
+// (#) and a header line.
+func readMappingsFromCSV(filename string, ps *problems) []*can2mqtt {
 	file, err := os.Open(filename)
 	if err != nil {
-		log.Fatal(err)
+		ps.add(filename, 0, "%s", err)
+		return nil
 	}
+	defer file.Close()
 
 	r := csv.NewReader(bufio.NewReader(file))
-	pairFromID = make(map[int]*can2mqtt)
-	pairFromTopic = make(map[string]*can2mqtt)
+	r.FieldsPerRecord = -1 // column count is checked per line
+	r.Comment = '#'
+	r.TrimLeadingSpace = true
+	var pairs []*can2mqtt
+	first := true
 	for {
 		record, err := r.Read()
 		// Stop at EOF.
 		if err == io.EOF {
 			break
 		}
-		canID, err := strconv.Atoi(record[0])
-		convMode := record[1]
-		topic := record[2]
-		if isInSlice(canID, topic) {
-			panic("main: each ID and each topic is only allowed once!")
+		if err != nil {
+			var perr *csv.ParseError
+			if errors.As(err, &perr) {
+				ps.add(filename, perr.Line, "%s", perr.Err)
+			} else {
+				ps.add(filename, 0, "%s", err)
+			}
+			break
 		}
-
-		var tmp_can2mqtt can2mqtt //{i, record[1], record[2]}
-
-		tmp_can2mqtt.canId = i
-		tmp_can2mqtt.convMethod = record[1]
-		tmp_can2mqtt.mqttTopic = splitString(record[2])
-
-		can2mqttPairs = append(can2mqttPairs, tmp_can2mqtt)
-		mqttSubscribe(tmp_can2mqtt.mqttTopic[0])
-		canSubscribe(uint32(i))
-	}
-	if dbg {
-		fmt.Printf("main: the following CAN-MQTT pairs have been extracted:\n")
-		fmt.Printf("main: CAN-ID\t\t conversion mode\t\tMQTT-topic\n")
-		for _, c2mp := range pairFromID {
-			fmt.Printf("main: %d\t\t%s\t\t%s\n", c2mp.canId, c2mp.convMethod, c2mp.mqttTopic)
+		line, _ := r.FieldPos(0)
+		if first {
+			first = false
+			if isHeader(record[0]) {
+				continue
+			}
 		}
-	}
-}
-
-func splitString(input string) []string {
-	result := []string{}
-	current := ""
-
-	for _, char := range input {
-		if char == '&' {
-			result = append(result, current)
-			current = ""
-		} else {
-			current += string(char)
+		if len(record) != 3 && len(record) != 4 {
+			ps.add(filename, line, "expected 3 or 4 columns (CAN-ID, convert-mode, MQTT-topic[, std|ext]), got %d", len(record))
+			continue
 		}
+		canID, err := parseCANID(record[0])
+		if err != nil {
+			ps.add(filename, line, "%s", err)
+			continue
+		}
+		extended := canID > can.MaskIDSff
+		if len(record) == 4 {
+			if extended, err = parseFrameFormat(record[3]); err != nil {
+				ps.add(filename, line, "%s", err)
+				continue
+			}
+		}
+		pairs = append(pairs, &can2mqtt{
+			canId:      int(canID),
+			convMethod: record[1],
+			mqttTopic:  strings.Split(record[2], "&"),
+			extended:   extended,
+			file:       filename,
+			line:       line,
+		})
 	}
-
-	if current != "" {
-		result = append(result, current)
-	}
-
-	return result
+	return pairs
 }
 
-// check function to check if a topic or an ID is in the slice
-func isInSlice(canId int, mqttTopic string) bool {
-	for _, c2mp := range can2mqttPairs {
-		if c2mp.canId == canId || c2mp.mqttTopic[0] == mqttTopic {
-			if dbg {
-				fmt.Printf("main: The ID %d or the Topic %s is already in the list!\n", canId, mqttTopic)
-			}
-			return true
-		}
+// isHeader tells whether the first column of the first line of a
+// can2mqtt.csv is a header instead of a CAN-ID
+func isHeader(column string) bool {
+	switch strings.ToLower(strings.TrimSpace(column)) {
+	case "id", "canid", "can-id", "can_id", "can id":
 		return true
 	}
 	return false
 }
 
-// get the corresponding topic for an ID
-func getTopic(canId int) []string {
-	result := []string{"-1"}
-	for _, c2mp := range can2mqttPairs {
-		if c2mp.canId == canId {
-			return c2mp.mqttTopic
-		}
+// parseCANID parses a CAN-ID, either decimal or hexadecimal with a
+// 0x prefix
+func parseCANID(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	var id int64
+	var err error
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		id, err = strconv.ParseInt(s[2:], 16, 64)
+	} else {
+		id, err = strconv.ParseInt(s, 10, 64)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("CAN-ID %q is neither a decimal nor a 0x-prefixed hexadecimal number", s)
 	}
-	// Fehlerfall
-	return result
+	return id, nil
 }
 
-// get the conversion mode for a given topic
-func getConvTopic(topic string) string {
-	for _, c2mp := range can2mqttPairs {
-		if c2mp.mqttTopic[0] == topic {
-			return c2mp.convMethod
-		}
+// parseFrameFormat parses the frame format column of a can2mqtt.csv
+// and returns whether it means extended frame format
+func parseFrameFormat(s string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "std", "standard":
+		return false, nil
+	case "ext", "extended":
+		return true, nil
 	}
-	// Fehlerfall
-	return "-1"
+	return false, fmt.Errorf("invalid frame format %q, valid values are std and ext", s)
 }
 
-// get the correspondig ID for a given topic
-func getId(mqttTopic string) int {
-	for _, c2mp := range can2mqttPairs {
-		if c2mp.mqttTopic[0] == mqttTopic {
-			return c2mp.canId
-		}
+// lookup of the mapping for a frame, for multiplexed frames the one of
+// its multiplexer value. nil if the ID is not mapped. If the frame
+// doesn't select a mapping, the error comes with one of the mappings
+// of the ID for the report.
+func (b *Bridge) pairByFrame(cf Frame) (*can2mqtt, error) {
+	b.pairLock.RLock()
+	defer b.pairLock.RUnlock()
+	pairs := b.pairFromID[cf.ID]
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	if pairs[0].mux == nil {
+		return pairs[0], nil
+	}
+	length := int(cf.Length)
+	if length > len(cf.Data) {
+		length = len(cf.Data)
+	}
+	c2mp, err := pairs[0].mux.pick(pairs, cf.Data[:length])
+	if err != nil {
+		return pairs[0], err
 	}
-	// Fehlerfall
-	return -1
+	return c2mp, nil
 }
 
-// get the corresponding topic for an ID
-func getTopicFromId(canId int) string {
-	return pairFromID[canId].mqttTopic
+// lookup of the mapping for a topic, nil if the topic is not mapped
+func (b *Bridge) pairByTopic(topic string) *can2mqtt {
+	b.pairLock.RLock()
+	defer b.pairLock.RUnlock()
+	return b.pairFromTopic[topic]
 }
@@ -0,0 +1,554 @@
+package can2mqtt_tuc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brutella/can"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// the end-to-end tests run whole bridges with a fake MQTT client and a
+// virtual bus, the helpers are used by the other tests as well
+
+// how long the tests wait for something that should happen
+const testTimeout = 2 * time.Second
+
+// fakeClient is a MQTT client without broker. It records what the
+// bridge publishes and hands messages of deliver to the handlers the
+// bridge subscribed.
+type fakeClient struct {
+	mu       sync.Mutex
+	handlers map[string]MQTT.MessageHandler
+	pubs     []fakeMsg
+	changed  chan struct{} // closed and replaced on every publish and subscribe
+	echo     bool          // send messages on subscribed topics back, like a broker
+	subErr   error         // of every subscribe, a broker that refuses them
+	subs     int
+	unsubs   int
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{handlers: make(map[string]MQTT.MessageHandler), changed: make(chan struct{})}
+}
+
+// fakeMsg is a message published by the bridge or delivered to it
+type fakeMsg struct {
+	topic    string
+	payload  []byte
+	qos      byte
+	retained bool
+}
+
+func (m fakeMsg) Duplicate() bool   { return false }
+func (m fakeMsg) Qos() byte         { return m.qos }
+func (m fakeMsg) Retained() bool    { return m.retained }
+func (m fakeMsg) Topic() string     { return m.topic }
+func (m fakeMsg) MessageID() uint16 { return 0 }
+func (m fakeMsg) Payload() []byte   { return m.payload }
+func (m fakeMsg) Ack()              {}
+
+// fakeToken is the token of a request that is done at once
+type fakeToken struct{ err error }
+
+func (fakeToken) Wait() bool                     { return true }
+func (fakeToken) WaitTimeout(time.Duration) bool { return true }
+func (fakeToken) Done() <-chan struct{}          { return closedChan }
+func (t fakeToken) Error() error                 { return t.err }
+
+var closedChan = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// notify wakes up everybody waiting for the client, f.mu is held
+func (f *fakeClient) notify() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeClient) IsConnected() bool      { return true }
+func (f *fakeClient) IsConnectionOpen() bool { return true }
+func (f *fakeClient) Connect() MQTT.Token    { return fakeToken{} }
+func (f *fakeClient) Disconnect(uint)        {}
+func (f *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) MQTT.Token {
+	msg := fakeMsg{topic: topic, qos: qos, retained: retained}
+	switch p := payload.(type) {
+	case string:
+		msg.payload = []byte(p)
+	case []byte:
+		msg.payload = append([]byte(nil), p...)
+	}
+	f.mu.Lock()
+	f.pubs = append(f.pubs, msg)
+	f.notify()
+	handler := f.handlers[topic]
+	echo := f.echo && handler != nil
+	f.mu.Unlock()
+	if echo {
+		msg.retained = false // a broker only sets it for stored messages
+		go handler(f, msg)
+	}
+	return fakeToken{}
+}
+func (f *fakeClient) Subscribe(topic string, qos byte, handler MQTT.MessageHandler) MQTT.Token {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subs++
+	f.notify()
+	if f.subErr != nil {
+		return fakeToken{f.subErr}
+	}
+	f.handlers[topic] = handler
+	return fakeToken{}
+}
+func (f *fakeClient) SubscribeMultiple(map[string]byte, MQTT.MessageHandler) MQTT.Token {
+	return fakeToken{}
+}
+func (f *fakeClient) Unsubscribe(topics ...string) MQTT.Token {
+	f.mu.Lock()
+	for _, topic := range topics {
+		delete(f.handlers, topic)
+	}
+	f.unsubs += len(topics)
+	f.mu.Unlock()
+	return fakeToken{}
+}
+func (f *fakeClient) AddRoute(string, MQTT.MessageHandler)    {}
+func (f *fakeClient) OptionsReader() MQTT.ClientOptionsReader { return MQTT.ClientOptionsReader{} }
+
+// waitFor waits until cond, called with f.mu held, is true
+func (f *fakeClient) waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	timeout := time.After(testTimeout)
+	for {
+		f.mu.Lock()
+		ok, changed := cond(), f.changed
+		f.mu.Unlock()
+		if ok {
+			return
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			t.Fatalf("timeout while waiting for %s", what)
+		}
+	}
+}
+
+// waitSubscribed waits until the bridge subscribed topic
+func (f *fakeClient) waitSubscribed(t *testing.T, topic string) {
+	t.Helper()
+	f.waitFor(t, "the subscription of "+topic, func() bool { return f.handlers[topic] != nil })
+}
+
+// waitPublished waits for the n-th (from 1) message on topic
+func (f *fakeClient) waitPublished(t *testing.T, topic string, n int) fakeMsg {
+	t.Helper()
+	var msg fakeMsg
+	f.waitFor(t, "a message on "+topic, func() bool {
+		seen := 0
+		for _, m := range f.pubs {
+			if m.topic == topic {
+				if seen++; seen == n {
+					msg = m
+					return true
+				}
+			}
+		}
+		return false
+	})
+	return msg
+}
+
+// published returns the payloads published on topic so far
+func (f *fakeClient) published(topic string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var payloads []string
+	for _, m := range f.pubs {
+		if m.topic == topic {
+			payloads = append(payloads, string(m.payload))
+		}
+	}
+	return payloads
+}
+
+// deliver hands a message from the broker to the bridge
+func (f *fakeClient) deliver(t *testing.T, topic, payload string) {
+	t.Helper()
+	f.mu.Lock()
+	handler := f.handlers[topic]
+	f.mu.Unlock()
+	if handler == nil {
+		t.Fatalf("%s is not subscribed", topic)
+	}
+	handler(f, fakeMsg{topic: topic, payload: []byte(payload)})
+}
+
+// writeFile writes a mapping file with the given name and content into
+// a temporary directory
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// startBridge runs a bridge with conf until the test ends, the MQTT
+// side is the fake client of conf or a new one
+func startBridge(t *testing.T, conf Config) (*Bridge, *fakeClient) {
+	t.Helper()
+	client, ok := conf.MQTTClient.(*fakeClient)
+	if !ok {
+		client = newFakeClient()
+		conf.MQTTClient = client
+	}
+	b := NewBridge(conf)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- b.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Run: %s", err)
+			}
+		case <-time.After(testTimeout):
+			t.Error("Run didn't return after cancel")
+		}
+	})
+	return b, client
+}
+
+// testNode is a node of a virtual bus that keeps what it receives
+type testNode struct {
+	CANBackend
+	frames chan Frame
+}
+
+func newTestNode(t *testing.T, vbus *VirtualBus) *testNode {
+	t.Helper()
+	n := &testNode{CANBackend: vbus.Node(), frames: make(chan Frame, 64)}
+	n.Subscribe(func(f Frame) { n.frames <- f })
+	if err := n.Open(); err != nil {
+		t.Fatal(err)
+	}
+	go n.Listen()
+	t.Cleanup(func() { n.Close() })
+	return n
+}
+
+// next returns the next frame the node received
+func (n *testNode) next(t *testing.T) Frame {
+	t.Helper()
+	select {
+	case f := <-n.frames:
+		return f
+	case <-time.After(testTimeout):
+		t.Fatal("timeout while waiting for a frame")
+	}
+	return Frame{}
+}
+
+// TestBridgeEndToEnd runs a bridge between a virtual bus and a fake
+// broker in both directions
+func TestBridgeEndToEnd(t *testing.T) {
+	vbus := NewVirtualBus()
+	board := newTestNode(t, vbus)
+	file := writeFile(t, "can2mqtt.csv", "0x100,uint162ascii,test/speed\n0x101,int82ascii,test/gear\n")
+	_, client := startBridge(t, Config{MappingFile: file, CANBackend: vbus.Node()})
+	client.waitSubscribed(t, "test/speed")
+	client.waitSubscribed(t, "test/gear")
+
+	// CAN -> MQTT
+	if err := board.Publish(Frame{ID: 0x100, Length: 2, Data: [64]byte{0x34, 0x12}}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := client.waitPublished(t, "test/speed", 1); string(msg.payload) != "4660" {
+		t.Errorf("frame published as %q, want %q", msg.payload, "4660")
+	}
+
+	// MQTT -> CAN
+	client.deliver(t, "test/gear", "-3")
+	frame := board.next(t)
+	if frame.ID != 0x101 || !bytes.Equal(frame.Payload(), []byte{0xFD}) {
+		t.Errorf("message sent as %s, want ID: 257 [1] FD", frame)
+	}
+}
+
+// a bridge can be run again after its context was cancelled
+func TestBridgeRunAgain(t *testing.T) {
+	vbus := NewVirtualBus()
+	board := newTestNode(t, vbus)
+	file := writeFile(t, "can2mqtt.csv", "0x100,uint162ascii,test/speed\n")
+	client := newFakeClient()
+	b := NewBridge(Config{MappingFile: file, CANBackend: vbus.Node(), MQTTClient: client})
+	for run := 1; run <= 2; run++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- b.Run(ctx) }()
+		client.waitFor(t, "the subscriptions of the run", func() bool { return client.subs == run })
+
+		if err := board.Publish(Frame{ID: 0x100, Length: 2, Data: [64]byte{byte(run), 0}}); err != nil {
+			t.Fatal(err)
+		}
+		if msg := client.waitPublished(t, "test/speed", run); string(msg.payload) != fmt.Sprint(run) {
+			t.Errorf("run %d: frame published as %q", run, msg.payload)
+		}
+		client.deliver(t, "test/speed", "4660")
+		if f := board.next(t); f.ID != 0x100 || !bytes.Equal(f.Payload()[:2], []byte{0x34, 0x12}) {
+			t.Errorf("run %d: message sent as %s", run, f)
+		}
+
+		cancel()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("run %d: %s", run, err)
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("run %d didn't return after cancel", run)
+		}
+	}
+}
+
+// two bridges in one process don't share their mappings, buses or
+// brokers, even with the same topics
+func TestTwoBridges(t *testing.T) {
+	var boards [2]*testNode
+	var clients [2]*fakeClient
+	for i := range boards {
+		vbus := NewVirtualBus()
+		boards[i] = newTestNode(t, vbus)
+		file := writeFile(t, "can2mqtt.csv", fmt.Sprintf("0x10%d,uint82ascii,test/value\n", i))
+		_, clients[i] = startBridge(t, Config{MappingFile: file, CANBackend: vbus.Node()})
+		clients[i].waitSubscribed(t, "test/value")
+	}
+	for i, board := range boards {
+		// the ID of the other bridge isn't mapped here
+		for id := uint32(0x100); id <= 0x101; id++ {
+			if err := board.Publish(Frame{ID: id, Length: 1, Data: [64]byte{byte(10*i + int(id-0x100))}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if msg := clients[i].waitPublished(t, "test/value", 1); string(msg.payload) != fmt.Sprint(11*i) {
+			t.Errorf("bridge %d published %q, want %d", i, msg.payload, 11*i)
+		}
+	}
+	for i, client := range clients {
+		client.deliver(t, "test/value", fmt.Sprint(i+1))
+		if f := boards[i].next(t); f.ID != uint32(0x100+i) || f.Data[0] != byte(i+1) {
+			t.Errorf("bridge %d sent %s", i, f)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	for i, client := range clients {
+		if got := client.published("test/value"); len(got) != 1 {
+			t.Errorf("bridge %d published %q", i, got)
+		}
+		boards[i].expectNothing(t)
+	}
+}
+
+// TestBridgeDirections runs a bridge in each global direction with a
+// bidirectional mapping and one for each direction
+func TestBridgeDirections(t *testing.T) {
+	file := writeFile(t, "can2mqtt.yaml", `
+mappings:
+  - {id: 0x100, mode: uint82ascii, topic: test/a}
+  - {id: 0x101, mode: uint82ascii, topic: test/r, direction: can2mqtt}
+  - {id: 0x102, mode: uint82ascii, topic: test/w, direction: mqtt2can}
+`)
+	tests := []struct {
+		mode       DirMode
+		subscribed []string
+		published  []string
+		sent       []uint32
+	}{
+		{DirBidirectional, []string{"test/a", "test/w"}, []string{"test/a", "test/r"}, []uint32{0x100, 0x102}},
+		{DirCAN2MQTT, nil, []string{"test/a", "test/r"}, nil},
+		{DirMQTT2CAN, []string{"test/a", "test/w"}, nil, []uint32{0x100, 0x102}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode.String(), func(t *testing.T) {
+			vbus := NewVirtualBus()
+			board := newTestNode(t, vbus)
+			b, client := startBridge(t, Config{MappingFile: file, CANBackend: vbus.Node(), DirMode: tt.mode})
+			for deadline := time.Now().Add(testTimeout); b.pairByTopic("test/w") == nil; time.Sleep(time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatal("the mappings weren't loaded")
+				}
+			}
+			for _, topic := range tt.subscribed {
+				client.waitSubscribed(t, topic)
+			}
+			client.mu.Lock()
+			if len(client.handlers) != len(tt.subscribed) {
+				t.Errorf("subscribed %d topics, want %v", len(client.handlers), tt.subscribed)
+			}
+			client.mu.Unlock()
+
+			// MQTT -> CAN, straight to the handler as the broker
+			// doesn't send unsubscribed topics
+			for _, topic := range []string{"test/a", "test/r", "test/w"} {
+				b.handleMQTT(client, fakeMsg{topic: topic, payload: []byte("5")})
+			}
+			for _, id := range tt.sent {
+				if f := board.next(t); f.ID != id || f.Data[0] != 5 {
+					t.Errorf("sent %s, want ID %d", f, id)
+				}
+			}
+			board.expectNothing(t)
+
+			// CAN -> MQTT
+			for _, id := range []uint32{0x100, 0x101, 0x102} {
+				if err := board.Publish(Frame{ID: id, Length: 1, Data: [64]byte{7}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, topic := range tt.published {
+				if msg := client.waitPublished(t, topic, 1); string(msg.payload) != "7" {
+					t.Errorf("%s: published %q, want \"7\"", topic, msg.payload)
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+			for _, topic := range []string{"test/a", "test/r", "test/w"} {
+				want := 0
+				for _, p := range tt.published {
+					if p == topic {
+						want = 1
+					}
+				}
+				if got := client.published(topic); len(got) != want {
+					t.Errorf("%s: published %q", topic, got)
+				}
+			}
+		})
+	}
+}
+
+func TestParseDirMode(t *testing.T) {
+	tests := []struct {
+		arg  string
+		mode DirMode
+		ok   bool
+	}{
+		{"0", DirBidirectional, true},
+		{"both", DirBidirectional, true},
+		{"1", DirCAN2MQTT, true},
+		{"can2mqtt", DirCAN2MQTT, true},
+		{"2", DirMQTT2CAN, true},
+		{"mqtt2can", DirMQTT2CAN, true},
+		{"3", 0, false},
+		{"sideways", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		mode, err := ParseDirMode(tt.arg)
+		if tt.ok && (err != nil || mode != tt.mode) {
+			t.Errorf("%q: got %v, %v, want %v", tt.arg, mode, err, tt.mode)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%q: got %v, want an error", tt.arg, mode)
+		}
+	}
+}
+
+func TestParseCANID(t *testing.T) {
+	tests := []struct {
+		s  string
+		id int64
+		ok bool
+	}{
+		{"100", 100, true},
+		{" 0x100 ", 0x100, true},
+		{"0X7ff", 0x7FF, true},
+		{"0x18FF0001", 0x18FF0001, true},
+		{"0100", 100, true}, // decimal, not octal
+		{"100h", 0, false},
+		{"7FF", 0, false},
+		{"0x", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		id, err := parseCANID(tt.s)
+		if (err == nil) != tt.ok || id != tt.id {
+			t.Errorf("%q parsed as %d, %v", tt.s, id, err)
+		}
+	}
+}
+
+func TestParseFrameFormat(t *testing.T) {
+	tests := []struct {
+		s        string
+		extended bool
+		ok       bool
+	}{
+		{"std", false, true},
+		{"Standard", false, true},
+		{" ext", true, true},
+		{"EXTENDED", true, true},
+		{"x", false, false},
+		{"", false, false},
+	}
+	for _, tt := range tests {
+		extended, err := parseFrameFormat(tt.s)
+		if (err == nil) != tt.ok || extended != tt.extended {
+			t.Errorf("%q parsed as %t, %v", tt.s, extended, err)
+		}
+	}
+}
+
+// the frame format of the fourth column of a can2mqtt.csv, without it
+// the ID decides
+func TestCSVFrameFormat(t *testing.T) {
+	file := writeFile(t, "can2mqtt.csv", `0x100,uint82ascii,test/std
+0x100,uint82ascii,test/ext,ext
+0x800,uint82ascii,test/big
+0x1FFFFFFF,uint82ascii,test/max
+0x7FF,uint82ascii,test/small,extended
+0x7FF,uint82ascii,test/small_std,std
+`)
+	pairs, err := readMappings(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint32{0x100, 0x100 | can.MaskEff, 0x800 | can.MaskEff, 0x1FFFFFFF | can.MaskEff, 0x7FF | can.MaskEff, 0x7FF}
+	if len(pairs) != len(want) {
+		t.Fatalf("%d mappings, want %d", len(pairs), len(want))
+	}
+	for i, c2mp := range pairs {
+		if c2mp.frameID() != want[i] {
+			t.Errorf("%s: frame ID %X, want %X", c2mp.mqttTopic[0], c2mp.frameID(), want[i])
+		}
+	}
+
+	tests := []struct {
+		line    string
+		problem string
+	}{
+		{"0x800,uint82ascii,test/a,std", "out of the 11 bit range"},
+		{"0x20000000,uint82ascii,test/a", "out of the 29 bit range"},
+		{"0x100,uint82ascii,test/a,fd", `invalid frame format "fd"`},
+		{"0x10G,uint82ascii,test/a", "neither a decimal nor a 0x-prefixed hexadecimal number"},
+		{"-1,uint82ascii,test/a", "out of the 29 bit range"},
+	}
+	for _, tt := range tests {
+		_, err := readMappings(writeFile(t, "can2mqtt.csv", tt.line+"\n"))
+		if err == nil || !strings.Contains(err.Error(), tt.problem) {
+			t.Errorf("%s: got %v, want %q", tt.line, err, tt.problem)
+		}
+	}
+}
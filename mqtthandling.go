@@ -3,18 +3,17 @@ package can2mqtt_tuc
 import (
 	"fmt"
 	"strings"
-
-	"strings"
+	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 )
 
-var client MQTT.Client
-var user, pw string
-
 // uses the connectString to establish a connection to the MQTT
 // broker
-func mqttStart(suppliedString string) {
+func (b *Bridge) mqttStart(suppliedString string) error {
+	if b.conf.MQTTClient != nil {
+		return b.mqttConnect("the broker of Config.MQTTClient")
+	}
 	connectString := suppliedString
 	if strings.Contains(suppliedString, "@") {
 		// looks like authentication is required for this server
@@ -25,7 +24,7 @@ func mqttStart(suppliedString string) {
 			fmt.Println("suppliedString: ", suppliedString)
 			fmt.Println("userpwhost: ", userpwhost)
 		}
-		user, pw, found = strings.Cut(userpw, ":")
+		b.user, b.pw, found = strings.Cut(userpw, ":")
 		if !found {
 			fmt.Println("Whoops, there is an issue with your MQTT-connectString:")
 			fmt.Println("suppliedString: ", suppliedString)
@@ -34,62 +33,169 @@ func mqttStart(suppliedString string) {
 		connectString = "tcp://" + host
 	}
 	clientsettings := MQTT.NewClientOptions().AddBroker(connectString)
-	clientsettings.SetClientID("CAN2MQTT")
-	clientsettings.SetDefaultPublishHandler(handleMQTT)
+	clientsettings.SetClientID(b.conf.MQTTClientID)
+	clientsettings.SetDefaultPublishHandler(b.handleMQTT)
 	if strings.Contains(suppliedString, "@") {
-		clientsettings.SetCredentialsProvider(userPwCredProv)
+		clientsettings.SetCredentialsProvider(b.userPwCredProv)
 	}
-	client = MQTT.NewClient(clientsettings)
-	if dbg {
+	b.client = MQTT.NewClient(clientsettings)
+	return b.mqttConnect(connectString)
+}
+
+// connects the client, a client of Config.MQTTClient may already be
+// connected
+func (b *Bridge) mqttConnect(connectString string) error {
+	if b.client.IsConnected() {
+		return nil
+	}
+	if b.conf.Debug {
 		fmt.Printf("mqtthandler: starting connection to: %s\n", connectString)
 	}
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
+	if token := b.client.Connect(); token.Wait() && token.Error() != nil {
 		fmt.Println("mqttHandler: Oh no an error occurred...")
-		panic(token.Error())
+		return token.Error()
 	}
-	if dbg {
+	if b.conf.Debug {
 		fmt.Printf("mqttHandler: connection established!\n")
 	}
+	return nil
+}
+
+// disconnects from the MQTT broker
+func (b *Bridge) mqttStop() {
+	b.client.Disconnect(250)
+	if b.conf.Debug {
+		fmt.Printf("mqttHandler: connection closed!\n")
+	}
 }
 
 // credentialsProvider
-func userPwCredProv() (username, password string) {
-	return user, pw
+func (b *Bridge) userPwCredProv() (username, password string) {
+	return b.user, b.pw
 }
 
-// subscribe to a new topic
-func mqttSubscribe(topic string) {
-	if token := client.Subscribe(topic, 0, nil); token.Wait() && token.Error() != nil {
-		fmt.Printf("mqtthandler: error while subscribing: %s\n", topic)
+// subscribe to a new topic, only the echoes of subscribed topics are
+// waited for
+func (b *Bridge) mqttSubscribe(topic string, qos byte) {
+	if token := b.client.Subscribe(topic, qos, b.handleMQTT); token.Wait() && token.Error() != nil {
+		fmt.Printf("mqtthandler: error while subscribing: %s: %s\n", topic, token.Error())
+		return
+	}
+	b.echoLock.Lock()
+	if b.echoes == nil {
+		b.echoes = make(map[string]*echoState)
 	}
-	if dbg {
+	b.echoes[topic] = &echoState{}
+	b.echoLock.Unlock()
+	if b.conf.Debug {
 		fmt.Printf("mqtthandler: successfully subscribed: %s\n", topic)
 	}
 }
 
 // unsubscribe a topic
-func mqttUnsubscribe(topic string) {
-	if token := client.Unsubscribe(topic); token.Wait() && token.Error() != nil {
+func (b *Bridge) mqttUnsubscribe(topic string) {
+	b.echoLock.Lock()
+	delete(b.echoes, topic)
+	b.echoLock.Unlock()
+	if token := b.client.Unsubscribe(topic); token.Wait() && token.Error() != nil {
 		fmt.Printf("mqtthandler: Error while unsuscribing :%s\n", topic)
 	}
-	if dbg {
+	if b.conf.Debug {
 		fmt.Printf("mqtthandler: successfully unsubscribed %s\n", topic)
 	}
 }
 
 // publish a new message
-func mqttPublish(topic_arr []string, payload []string) {
+func (b *Bridge) mqttPublish(topic_arr []string, payload []string, qos byte, retain bool) {
 	for index, topic := range topic_arr {
-
-		if dbg {
+		if index >= len(payload) {
+			break
+		}
+		if b.conf.Debug {
 			fmt.Printf("mqtthandler: sending message: \"%s\" to topic: \"%s\"\n", payload[index], topic)
 		}
-		mqttUnsubscribe(topic)
-		token := client.Publish(topic, 0, false, payload[index])
+		// the broker sends our own message back on subscribed topics
+		b.expectEcho(topic, payload[index])
+		token := b.client.Publish(topic, qos, retain, payload[index])
 		token.Wait()
-		if dbg {
+		if b.conf.Debug {
 			fmt.Printf("mqtthandler: message was transmitted successfully!.\n")
 		}
-		mqttSubscribe(topic)
 	}
 }
+
+// how long the echo of an own message is waited for
+const echoTimeout = 5 * time.Second
+
+// how many own messages of a topic wait for their echo at most
+const maxEchoes = 32
+
+// sentMsg is an own message on a subscribed topic
+type sentMsg struct {
+	payload string
+	sent    time.Time
+}
+
+// echoState keeps the own messages of a subscribed topic until the
+// broker sends them back
+type echoState struct {
+	pending []sentMsg
+	echoed  bool // the broker sent an own message back
+	silent  bool // it didn't, e.g. no permission to read the topic
+}
+
+// expire drops the messages that weren't sent back in time. If the
+// broker never sent one back, it won't send the next ones either.
+func (e *echoState) expire(now time.Time) {
+	n := 0
+	for n < len(e.pending) && now.Sub(e.pending[n].sent) > echoTimeout {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	e.pending = e.pending[n:]
+	if !e.echoed {
+		e.silent = true
+		e.pending = nil
+	}
+}
+
+// expectEcho remembers an own message on a subscribed topic, so that
+// isEcho drops it when the broker sends it back
+func (b *Bridge) expectEcho(topic, payload string) {
+	b.echoLock.Lock()
+	defer b.echoLock.Unlock()
+	e := b.echoes[topic]
+	if e == nil {
+		return
+	}
+	e.expire(time.Now())
+	if e.silent {
+		return
+	}
+	if len(e.pending) == maxEchoes {
+		e.pending = e.pending[1:]
+	}
+	e.pending = append(e.pending, sentMsg{payload, time.Now()})
+}
+
+// isEcho tells whether a received message is one of our own, each own
+// message is dropped once
+func (b *Bridge) isEcho(topic, payload string) bool {
+	b.echoLock.Lock()
+	defer b.echoLock.Unlock()
+	e := b.echoes[topic]
+	if e == nil {
+		return false
+	}
+	e.expire(time.Now())
+	for i, m := range e.pending {
+		if m.payload == payload {
+			e.pending = append(e.pending[:i:i], e.pending[i+1:]...)
+			e.echoed = true
+			return true
+		}
+	}
+	return false
+}
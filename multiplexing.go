@@ -0,0 +1,173 @@
+package can2mqtt_tuc
+
+import (
+	"fmt"
+	"math/big"
+
+	"gopkg.in/yaml.v3"
+)
+
+// multiplexer selects the layout of a multiplexed frame: one CAN-ID
+// with a field (the multiplexer) that tells how the other bytes are
+// used. Each value of the multiplexer is a mapping of its own, with
+// its own topics.
+type multiplexer struct {
+	sig   *signal // the multiplexer field, shared by the mappings of an ID
+	size  int     // data bytes needed to read it
+	value int64   // value of the multiplexer for this mapping
+}
+
+// muxConfig is the layout of one value of the multiplexer of a
+// mapping in a YAML configuration file
+type muxConfig struct {
+	Value    int64    `yaml:"value"`
+	Topic    string   `yaml:"topic"`
+	Topics   []string `yaml:"topics"`
+	CmdTopic string   `yaml:"command_topic"`
+	Fields   []Field  `yaml:"fields"`
+	Format   string   `yaml:"format"`
+	Names    []string `yaml:"names"`
+
+	line int
+}
+
+// UnmarshalYAML remembers the line of a multiplexer value for error
+// messages.
+func (mx *muxConfig) UnmarshalYAML(node *yaml.Node) error {
+	type plain muxConfig // without this method
+	if err := node.Decode((*plain)(mx)); err != nil {
+		return err
+	}
+	mx.line = node.Line
+	return nil
+}
+
+// pairKey identifies a mapping: its frame ID and, for multiplexed
+// frames, the value of the multiplexer
+type pairKey struct {
+	id    uint32
+	muxed bool
+	mux   int64
+}
+
+func (c2mp *can2mqtt) key() pairKey {
+	if c2mp.mux == nil {
+		return pairKey{id: c2mp.frameID()}
+	}
+	return pairKey{id: c2mp.frameID(), muxed: true, mux: c2mp.mux.value}
+}
+
+// toPairs converts a mapping of the configuration file into mappings
+// of the bridge, a multiplexed mapping becomes one mapping for each
+// value of the multiplexer
+func (mc mappingConfig) toPairs(file string, ps *problems) []*can2mqtt {
+	if mc.Multiplexer == nil && len(mc.Multiplexed) == 0 {
+		if c2mp := mc.toPair(file, ps); c2mp != nil {
+			return []*can2mqtt{c2mp}
+		}
+		return nil
+	}
+	if mc.Multiplexer == nil || len(mc.Multiplexed) == 0 {
+		ps.add(file, mc.line, "multiplexer and multiplexed are only used together")
+		return nil
+	}
+	if mc.ISOTP != nil {
+		ps.add(file, mc.line, "multiplexed frames can't use isotp")
+		return nil
+	}
+	if (mc.Mode != "" && mc.Mode != "layout") || len(mc.Fields) > 0 || mc.Topic != "" || len(mc.Topics) > 0 ||
+		mc.CmdTopic != "" || mc.Format != "" || len(mc.Names) > 0 {
+		ps.add(file, mc.line, "a multiplexed mapping has its fields, topics and format per multiplexer value")
+		return nil
+	}
+	mf := *mc.Multiplexer
+	if mf.Name == "" {
+		mf.Name = "multiplexer"
+	}
+	sig, err := mf.signal(0)
+	if err != nil {
+		ps.add(file, mc.line, "%s", err)
+		return nil
+	}
+	if sig.float || sig.factor != 1 || sig.offset != 0 {
+		ps.add(file, mc.line, "the multiplexer must be a plain integer")
+		return nil
+	}
+	size := 0
+	for _, p := range sig.bitPositions() {
+		if p/8+1 > size {
+			size = p/8 + 1
+		}
+	}
+	min, limit := sig.rawRange()
+	var pairs []*can2mqtt
+	for _, mx := range mc.Multiplexed {
+		if v := big.NewInt(mx.Value); v.Cmp(min) < 0 || v.Cmp(limit) >= 0 {
+			ps.add(file, mx.line, "multiplexer value %d doesn't fit into the multiplexer", mx.Value)
+			continue
+		}
+		sub := mc
+		sub.Multiplexer, sub.Multiplexed = nil, nil
+		sub.Mode = "layout"
+		sub.Topic, sub.Topics, sub.CmdTopic = mx.Topic, mx.Topics, mx.CmdTopic
+		sub.Fields, sub.Format, sub.Names = mx.Fields, mx.Format, mx.Names
+		sub.line = mx.line
+		c2mp := sub.toPair(file, ps)
+		if c2mp == nil {
+			continue
+		}
+		c2mp.mux = &multiplexer{sig: sig, size: size, value: mx.Value}
+		pairs = append(pairs, c2mp)
+	}
+	return pairs
+}
+
+// resolveMux makes sure that the fields of a multiplexed mapping don't
+// use the bits of the multiplexer
+func resolveMux(c2mp *can2mqtt) error {
+	if c2mp.mux == nil {
+		return nil
+	}
+	layout, ok := c2mp.conv.(*layoutConverter)
+	if !ok {
+		return fmt.Errorf("multiplexed frames need a layout")
+	}
+	used := make(map[int]bool)
+	for _, p := range c2mp.mux.sig.bitPositions() {
+		used[p] = true
+	}
+	for _, sig := range layout.signals {
+		for _, p := range sig.bitPositions() {
+			if used[p] {
+				return fmt.Errorf("field %s overlaps the multiplexer", sig.name)
+			}
+		}
+	}
+	return nil
+}
+
+// pick returns the mapping of the multiplexer value in data
+func (m *multiplexer) pick(pairs []*can2mqtt, data []byte) (*can2mqtt, error) {
+	if len(data) < m.size {
+		return nil, fmt.Errorf("frame has %d data bytes, the multiplexer needs %d", len(data), m.size)
+	}
+	value := m.sig.raw(data)
+	for _, c2mp := range pairs {
+		if c2mp.mux.value == value {
+			return c2mp, nil
+		}
+	}
+	return nil, fmt.Errorf("no layout for multiplexer value %d", value)
+}
+
+// set writes the multiplexer value of the mapping into encoded data
+func (m *multiplexer) set(data []byte) []byte {
+	if m == nil {
+		return data
+	}
+	if len(data) < m.size {
+		data = append(data, make([]byte, m.size-len(data))...)
+	}
+	m.sig.setRaw(data, m.value)
+	return data
+}
@@ -0,0 +1,141 @@
+package can2mqtt_tuc
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const muxYAML = `
+mappings:
+  - id: 0x1A0
+    multiplexer:
+      byte: 0
+      length: 4
+    multiplexed:
+      - value: 1
+        fields:
+          - {topic: test/bha/temp, byte: 1, length: 16, type: signed, scale: 0.1}
+      - value: 2
+        topic: test/bha/vibration
+        format: json
+        fields:
+          - {name: x, byte: 1, length: 16}
+          - {name: y, byte: 3, length: 16}
+      - value: 15
+        fields:
+          - {topic: test/bha/state, byte: 0, bit: 4, length: 4}
+`
+
+// muxBridge returns a bridge with the mappings of muxYAML, it is not
+// running
+func muxBridge(t *testing.T) *Bridge {
+	t.Helper()
+	file := writeFile(t, "mux.yaml", muxYAML)
+	b := NewBridge(Config{MappingFile: file, CANBackend: NewVirtualBus().Node(), MQTTClient: newFakeClient()})
+	if err := b.readC2MPFromFile(file); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestMuxSelection(t *testing.T) {
+	b := muxBridge(t)
+	tests := []struct {
+		data   []byte
+		topic  string // "": no layout
+		values string
+		reason string
+	}{
+		{[]byte{0x01, 0xD7, 0x00}, "test/bha/temp", "21.5", ""},
+		{[]byte{0xF1, 0x2C, 0xFF}, "test/bha/temp", "-21.2", ""}, // the upper nibble is no part of the multiplexer
+		{[]byte{0x02, 1, 0, 2, 0}, "test/bha/vibration", `{"x":1,"y":2}`, ""},
+		{[]byte{0x3F}, "test/bha/state", "3", ""},
+		{[]byte{0x03, 1, 2, 3, 4}, "", "", "no layout for multiplexer value 3"},
+		{[]byte{0x00}, "", "", "no layout for multiplexer value 0"},
+		{[]byte{}, "", "", "the multiplexer needs 1"},
+	}
+	for _, tt := range tests {
+		frame := Frame{ID: 0x1A0, Length: uint8(len(tt.data))}
+		copy(frame.Data[:], tt.data)
+		c2mp, err := b.pairByFrame(frame)
+		if tt.topic == "" {
+			if err == nil || !strings.Contains(err.Error(), tt.reason) {
+				t.Errorf("% X: got error %v, want %q", tt.data, err, tt.reason)
+			}
+			if c2mp == nil {
+				t.Errorf("% X: the error needs a mapping to be reported", tt.data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("% X: %s", tt.data, err)
+			continue
+		}
+		if c2mp.mqttTopic[0] != tt.topic {
+			t.Errorf("% X: selected %s, want %s", tt.data, c2mp.mqttTopic[0], tt.topic)
+			continue
+		}
+		values, err := b.convert2MQTT(c2mp, frame.Payload())
+		if err != nil {
+			t.Errorf("% X: %s", tt.data, err)
+		} else if strings.Join(values, " ") != tt.values {
+			t.Errorf("% X: decoded as %q, want %s", tt.data, values, tt.values)
+		}
+	}
+}
+
+// MQTT->CAN the topic selects the layout and its multiplexer value is
+// written into the frame
+func TestMuxEncode(t *testing.T) {
+	b := muxBridge(t)
+	tests := []struct {
+		topic   string
+		payload string
+		data    []byte
+	}{
+		{"test/bha/temp", "21.5", []byte{0x01, 0xD7, 0x00}},
+		{"test/bha/vibration", `{"x":1,"y":2}`, []byte{0x02, 1, 0, 2, 0}},
+		{"test/bha/state", "3", []byte{0x3F}},
+	}
+	for _, tt := range tests {
+		c2mp := b.pairByTopic(tt.topic)
+		if c2mp == nil {
+			t.Fatalf("%s is not mapped", tt.topic)
+		}
+		frame, err := b.convert2CAN(c2mp, tt.payload)
+		if err != nil {
+			t.Errorf("%s: %s", tt.topic, err)
+			continue
+		}
+		if frame.ID != 0x1A0 || !bytes.Equal(frame.Payload(), tt.data) {
+			t.Errorf("%s: %q sent as %s, want % X", tt.topic, tt.payload, frame, tt.data)
+		}
+	}
+}
+
+func TestMuxConfigErrors(t *testing.T) {
+	tests := []struct {
+		mapping string
+		problem string
+	}{
+		{`{id: 0x1A0, multiplexer: {byte: 0, length: 2}, multiplexed: [{value: 4, topic: a, fields: [{byte: 1}]}]}`,
+			"multiplexer value 4 doesn't fit"},
+		{`{id: 0x1A0, multiplexer: {byte: 0, length: 2, type: signed}, multiplexed: [{value: -3, topic: a, fields: [{byte: 1}]}]}`,
+			"multiplexer value -3 doesn't fit"},
+		{`{id: 0x1A0, multiplexer: {byte: 0}, multiplexed: [{value: 1, topic: a, fields: [{byte: 0, bit: 4, length: 4}]}]}`,
+			"overlaps the multiplexer"},
+		{`{id: 0x1A0, multiplexer: {byte: 0, scale: 2}, multiplexed: [{value: 1, topic: a, fields: [{byte: 1}]}]}`,
+			"must be a plain integer"},
+		{`{id: 0x1A0, multiplexer: {byte: 0}}`, "only used together"},
+		{`{id: 0x1A0, topic: a, multiplexer: {byte: 0}, multiplexed: [{value: 1, topic: b, fields: [{byte: 1}]}]}`,
+			"per multiplexer value"},
+	}
+	for _, tt := range tests {
+		file := writeFile(t, "mux.yaml", "mappings:\n  - "+tt.mapping+"\n")
+		_, err := readMappings(file)
+		if err == nil || !strings.Contains(err.Error(), tt.problem) {
+			t.Errorf("%s: got %v, want %q", tt.mapping, err, tt.problem)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package can2mqtt_tuc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy selects what happens to a received frame when the
+// queue of its worker is full, because MQTT is slower than the bus.
+type OverflowPolicy int
+
+const (
+	OverflowBlock      OverflowPolicy = iota // wait, the bus is not read meanwhile (backpressure)
+	OverflowDropNewest                       // drop the frame
+	OverflowDropOldest                       // drop the oldest frame of the queue to make room
+)
+
+// ParseOverflowPolicy parses the value of the -o commandline parameter
+// or overflow in a YAML configuration file: block, drop-newest or
+// drop-oldest.
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch s {
+	case "block":
+		return OverflowBlock, nil
+	case "drop-newest":
+		return OverflowDropNewest, nil
+	case "drop-oldest":
+		return OverflowDropOldest, nil
+	}
+	return OverflowBlock, fmt.Errorf("error: got invalid overflow policy (%s). Valid values are block, drop-newest or drop-oldest", s)
+}
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowDropNewest:
+		return "drop-newest"
+	case OverflowDropOldest:
+		return "drop-oldest"
+	}
+	return "block"
+}
+
+// defaults of the pipeline settings of Config
+const (
+	defaultWorkers   = 4
+	defaultQueueSize = 256
+	dropReportEvery  = 10 * time.Second
+)
+
+// pipeline hands the received frames to a fixed number of workers
+// that convert and publish them. All frames of one ID go to the same
+// worker, so they are published in the order they were received.
+// Before start and after stop the jobs run in the caller.
+type pipeline struct {
+	mu      sync.RWMutex // protects queues and quit, not their content
+	queues  []chan func()
+	quit    chan struct{}
+	policy  OverflowPolicy
+	wg      sync.WaitGroup
+	dropped uint64 // atomic, frames dropped since the bridge was created
+}
+
+// start runs workers goroutines with a queue of size jobs each
+func (p *pipeline) start(workers, size int, policy OverflowPolicy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.queues = make([]chan func(), workers)
+	p.quit = make(chan struct{})
+	p.policy = policy
+	for i := range p.queues {
+		q := make(chan func(), size)
+		p.queues[i] = q
+		p.wg.Add(1)
+		go p.work(q, p.quit)
+	}
+}
+
+func (p *pipeline) work(q chan func(), quit chan struct{}) {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-quit:
+			return
+		case job := <-q:
+			job()
+		}
+	}
+}
+
+// stop ends the workers after their current job, waiting jobs are
+// dropped without counting them
+func (p *pipeline) stop() {
+	p.mu.RLock()
+	quit := p.quit
+	p.mu.RUnlock()
+	if quit == nil {
+		return
+	}
+	close(quit) // makes blocked submits return, so the lock is free
+	p.wg.Wait()
+	p.mu.Lock()
+	p.queues, p.quit = nil, nil
+	p.mu.Unlock()
+}
+
+// submit queues a job for the worker of the frame ID id. It returns
+// false if the job was dropped because the queue was full.
+func (p *pipeline) submit(id uint32, job func()) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.queues == nil {
+		job()
+		return true
+	}
+	q := p.queues[id%uint32(len(p.queues))]
+	switch p.policy {
+	case OverflowDropNewest:
+		select {
+		case q <- job:
+			return true
+		default:
+			atomic.AddUint64(&p.dropped, 1)
+			return false
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case q <- job:
+				return true
+			default:
+			}
+			select {
+			case <-q:
+				atomic.AddUint64(&p.dropped, 1)
+			default: // a worker was faster
+			}
+		}
+	}
+	select {
+	case q <- job:
+	case <-p.quit:
+	}
+	return true
+}
+
+// Dropped returns how many received frames were dropped because MQTT
+// was too slow, see Config.Overflow.
+func (b *Bridge) Dropped() uint64 {
+	return atomic.LoadUint64(&b.work.dropped)
+}
+
+// dropReport is published as JSON to the error topic when frames were
+// dropped since the last report
+type dropReport struct {
+	Dropped uint64 `json:"dropped"` // since the last report
+	Total   uint64 `json:"total"`
+	Policy  string `json:"policy"`
+	Reason  string `json:"reason"`
+}
+
+// reportDrops tells the error topic every dropReportEvery how many
+// frames were dropped, if any
+func (b *Bridge) reportDrops(ctx context.Context) {
+	last := b.Dropped()
+	ticker := time.NewTicker(dropReportEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			total := b.Dropped()
+			if total == last {
+				continue
+			}
+			dr := dropReport{
+				Dropped: total - last,
+				Total:   total,
+				Policy:  b.conf.Overflow.String(),
+				Reason:  "queue full, MQTT is too slow",
+			}
+			last = total
+			fmt.Printf("canbushandler: %d frames dropped in the last %s (%d in total), MQTT is too slow\n", dr.Dropped, dropReportEvery, dr.Total)
+			b.publishError(dr)
+		}
+	}
+}
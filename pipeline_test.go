@@ -0,0 +1,154 @@
+package can2mqtt_tuc
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// jobs of several IDs, interleaved, run in the order they were
+// submitted per ID, whatever worker takes them
+func TestPipelineOrderPerID(t *testing.T) {
+	var p pipeline
+	p.start(3, 4, OverflowBlock)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	got := make(map[uint32][]int)
+	for i := 0; i < 50; i++ {
+		for id := uint32(0x100); id < 0x105; id++ {
+			id, i := id, i
+			wg.Add(1)
+			p.submit(id, func() {
+				time.Sleep(time.Duration(i%3) * 100 * time.Microsecond)
+				mu.Lock()
+				got[id] = append(got[id], i)
+				mu.Unlock()
+				wg.Done()
+			})
+		}
+	}
+	wg.Wait()
+	p.stop()
+	for id := uint32(0x100); id < 0x105; id++ {
+		if len(got[id]) != 50 {
+			t.Fatalf("%X: %d of 50 jobs ran", id, len(got[id]))
+		}
+		for i, n := range got[id] {
+			if n != i {
+				t.Errorf("%X: job %d ran as the %d.", id, n, i)
+				break
+			}
+		}
+	}
+}
+
+// one worker with a queue of two jobs, the worker is busy with job 0
+// while the jobs 1 to 5 are submitted
+func TestPipelineOverflow(t *testing.T) {
+	tests := []struct {
+		policy  OverflowPolicy
+		ran     []int
+		dropped uint64
+	}{
+		{OverflowBlock, []int{0, 1, 2, 3, 4, 5}, 0},
+		{OverflowDropNewest, []int{0, 1, 2}, 3},
+		{OverflowDropOldest, []int{0, 4, 5}, 3},
+	}
+	for _, tt := range tests {
+		b := NewBridge(Config{CANBackend: NewVirtualBus().Node()})
+		b.work.start(1, 2, tt.policy)
+		ran := make(chan int, 6)
+		started, gate := make(chan struct{}), make(chan struct{})
+		b.work.submit(0x100, func() {
+			close(started)
+			<-gate
+			ran <- 0
+		})
+		<-started
+		submitted := make(chan struct{})
+		go func() {
+			for i := 1; i <= 5; i++ {
+				i := i
+				b.work.submit(uint32(0x100+i), func() { ran <- i })
+			}
+			close(submitted)
+		}()
+		select {
+		case <-submitted:
+			if tt.policy == OverflowBlock {
+				t.Errorf("%s: the queue is full, submit must block", tt.policy)
+			}
+		case <-time.After(50 * time.Millisecond):
+			if tt.policy != OverflowBlock {
+				t.Errorf("%s: submit blocked", tt.policy)
+			}
+		}
+		close(gate)
+		<-submitted
+		var got []int
+		for len(got) < len(tt.ran) {
+			select {
+			case i := <-ran:
+				got = append(got, i)
+			case <-time.After(testTimeout):
+				t.Fatalf("%s: only %v ran", tt.policy, got)
+			}
+		}
+		b.work.stop()
+		if !reflect.DeepEqual(got, tt.ran) {
+			t.Errorf("%s: ran %v, want %v", tt.policy, got, tt.ran)
+		}
+		if len(ran) != 0 {
+			t.Errorf("%s: more jobs ran than %v", tt.policy, got)
+		}
+		if d := b.Dropped(); d != tt.dropped {
+			t.Errorf("%s: dropped %d, want %d", tt.policy, d, tt.dropped)
+		}
+	}
+}
+
+// stop must not hang while a submit waits for room
+func TestPipelineStopWhileBlocked(t *testing.T) {
+	var p pipeline
+	p.start(1, 1, OverflowBlock)
+	gate := make(chan struct{})
+	p.submit(1, func() { <-gate })
+	p.submit(1, func() {})
+	submitted := make(chan struct{})
+	go func() {
+		p.submit(1, func() {})
+		close(submitted)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	stopped := make(chan struct{})
+	go func() {
+		p.stop()
+		close(stopped)
+	}()
+	close(gate)
+	for _, c := range []chan struct{}{submitted, stopped} {
+		select {
+		case <-c:
+		case <-time.After(testTimeout):
+			t.Fatal("stop hangs")
+		}
+	}
+	// after stop the jobs run in the caller
+	ran := false
+	p.submit(1, func() { ran = true })
+	if !ran {
+		t.Error("job didn't run after stop")
+	}
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	for _, p := range []OverflowPolicy{OverflowBlock, OverflowDropNewest, OverflowDropOldest} {
+		if got, err := ParseOverflowPolicy(p.String()); err != nil || got != p {
+			t.Errorf("%s parsed as %s, %v", p, got, err)
+		}
+	}
+	if _, err := ParseOverflowPolicy("drop"); err == nil {
+		t.Error("drop must be rejected")
+	}
+}
@@ -3,6 +3,7 @@ package can2mqtt_tuc
 import (
 	"fmt"
 
+	"github.com/brutella/can"
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 )
 
@@ -10,31 +11,104 @@ import (
 // and does the following:
 // 1. calling standard convert function: convert2MQTT
 // 2. sending the message
-func handleCAN(cf can.Frame) {
-	if dbg {
-		fmt.Printf("receivehandler: received CANFrame: ID: %d, len: %d, payload %s\n", cf.ID, cf.Length, cf.Data)
+func (b *Bridge) handleCAN(cf Frame) {
+	if b.conf.Debug {
+		fmt.Printf("receivehandler: received CANFrame: %s\n", cf)
 	}
-	mqttPayload := convert2MQTT(int(cf.ID), int(cf.Length), cf.Data)
-	if dbg {
-		fmt.Printf("receivehandler: converted String: %s\n", mqttPayload[0])
+	c2mp, err := b.pairByFrame(cf)
+	if c2mp == nil {
+		// removed by a reload in the meantime
+		return
 	}
-	topic := getTopic(int(cf.ID))
-	mqttPublish(topic, mqttPayload)
-	fmt.Printf("ID: %d len: %d data: %X -> topic: \"%s\" message: \"%s\"\n", cf.ID, cf.Len, cf.Data, topic, mqttPayload)
+	if err == nil && int(cf.Length) > len(cf.Data) {
+		err = fmt.Errorf("invalid DLC %d", cf.Length)
+	}
+	if err != nil {
+		b.reportFrameError(c2mp, cf, err)
+		return
+	}
+	b.publishCAN(c2mp, cf, cf.Payload())
+}
+
+// publishCAN converts the data of a frame, or of an ISO-TP message
+// that started with the frame, and publishes it to MQTT
+func (b *Bridge) publishCAN(c2mp *can2mqtt, cf Frame, data []byte) {
+	mqttPayload, err := b.convert2MQTT(c2mp, data)
+	if err != nil {
+		b.reportFrameError(c2mp, cf, err)
+		return
+	}
+	if b.conf.Debug {
+		fmt.Printf("receivehandler: converted String: %s\n", mqttPayload)
+	}
+	topic := c2mp.mqttTopic
+	b.mqttPublish(topic, mqttPayload, b.qosOf(c2mp), b.retainOf(c2mp))
+	fmt.Printf("ID: %d len: %d data: %X -> topic: \"%s\" message: \"%s\"\n", cf.ID&can.MaskIDEff, len(data), data, topic, mqttPayload)
 }
 
 // handleMQTT is the standard receive handler for MQTT
 // messages and does the following:
 // 1. calling the standard convert function: convert2CAN
 // 2. sending the message
-func handleMQTT(_ MQTT.Client, msg MQTT.Message) {
-	if dbg {
+func (b *Bridge) handleMQTT(_ MQTT.Client, msg MQTT.Message) {
+	if b.conf.Debug {
 		fmt.Printf("receivehandler: received message: topic: %s, msg: %s\n", msg.Topic(), msg.Payload())
 	}
-	cf := convert2CAN(msg.Topic(), string(msg.Payload()))
+	c2mp := b.pairByTopic(msg.Topic())
+	if c2mp == nil || !b.forwardsToCAN(c2mp) {
+		// not subscribed by us, e.g. left over from a persistent session
+		if b.conf.Debug {
+			fmt.Printf("receivehandler: topic %s is not mapped for mqtt2can, ignoring the message\n", msg.Topic())
+		}
+		return
+	}
+	if msg.Retained() && c2mp.cmdTopic == "" && b.forwardsToMQTT(c2mp) && b.retainOf(c2mp) {
+		// the broker hands out our own retained value of the topic
+		// again when it is subscribed after publishing
+		if b.conf.Debug {
+			fmt.Printf("receivehandler: ignoring retained message on topic %s\n", msg.Topic())
+		}
+		return
+	}
+	if b.isEcho(msg.Topic(), string(msg.Payload())) {
+		// what we just published from CAN, not a command
+		if b.conf.Debug {
+			fmt.Printf("receivehandler: ignoring our own message on topic %s\n", msg.Topic())
+		}
+		return
+	}
+	if c2mp.isotp != nil {
+		b.sendISOTP(c2mp, msg)
+		return
+	}
+	cf, err := b.convert2CAN(c2mp, string(msg.Payload()))
+	if err != nil {
+		b.reportRejection(c2mp, msg.Topic(), string(msg.Payload()), err)
+		return
+	}
+	if err := b.canPublish(cf); err != nil {
+		b.reportRejection(c2mp, msg.Topic(), string(msg.Payload()), err)
+		return
+	}
+	fmt.Printf("ID: %d len: %d data: %X <- topic: \"%s\" message: \"%s\"\n", cf.ID&can.MaskIDEff, cf.Length, cf.Payload(), msg.Topic(), msg.Payload())
+}
 
-	if dirMode != 1 {
-		canPublish(cf)
-		fmt.Printf("ID: %d len: %d data: %X <- topic: \"%s\" message: \"%s\"\n", cf.ID, cf.Length, cf.Data, msg.Topic(), msg.Payload())
+// sendISOTP converts a message for a mapping with ISO-TP and sends it
+// in the background, the flow control of the receiver may take a while
+func (b *Bridge) sendISOTP(c2mp *can2mqtt, msg MQTT.Message) {
+	data, err := b.encodePayload(c2mp, string(msg.Payload()))
+	if err == nil && len(data) > isotpMaxSize {
+		err = fmt.Errorf("convertfunctions: %s: %d data bytes don't fit into an ISO-TP message", c2mp.convMethod, len(data))
+	}
+	if err != nil {
+		b.reportRejection(c2mp, msg.Topic(), string(msg.Payload()), err)
+		return
 	}
+	go func() {
+		if err := b.isotpSend(c2mp, data); err != nil {
+			b.reportRejection(c2mp, msg.Topic(), string(msg.Payload()), err)
+			return
+		}
+		fmt.Printf("ID: %d len: %d data: %X <- topic: \"%s\" message: \"%s\"\n", c2mp.isotp.txID&can.MaskIDEff, len(data), data, msg.Topic(), msg.Payload())
+	}()
 }
@@ -0,0 +1,324 @@
+package can2mqtt_tuc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// the benchmarks measure the cost of one frame or message from the
+// lookup of its mapping to the (fake) MQTT client or CAN backend, with
+// as many mappings as a big installation has
+
+const benchMappings = 1000
+
+// benchBridge returns a bridge with benchMappings uint16 mappings on
+// the IDs 0x100.. and the mappings in extra, connected to a fake MQTT
+// client and a virtual bus
+func benchBridge(b *testing.B, extra string) *Bridge {
+	var sb strings.Builder
+	sb.WriteString("mappings:\n")
+	for i := 0; i < benchMappings; i++ {
+		fmt.Fprintf(&sb, "  - {id: %d, mode: uint162ascii, topic: bench/sensor%d}\n", 0x100+i, i)
+	}
+	sb.WriteString(extra)
+	file := filepath.Join(b.TempDir(), "bench.yaml")
+	if err := os.WriteFile(file, []byte(sb.String()), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	br := NewBridge(Config{MappingFile: file, CANBackend: NewVirtualBus().Node()})
+	br.client = &benchClient{}
+	if err := br.bus.Open(); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { br.bus.Close() })
+	if err := br.readC2MPFromFile(file); err != nil {
+		b.Fatal(err)
+	}
+	// every frame is printed, that is not what we measure
+	stdout := os.Stdout
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		b.Fatal(err)
+	}
+	os.Stdout = null
+	b.Cleanup(func() {
+		os.Stdout = stdout
+		null.Close()
+	})
+	return br
+}
+
+const benchExtra = `
+  - id: 0x50
+    fields:
+      - {topic: bench/pump/pressure, byte: 0, length: 16, scale: 0.01}
+      - {topic: bench/pump/temp, byte: 2, length: 16, type: signed, scale: 0.1}
+      - {topic: bench/pump/state, byte: 4, values: {0: OFF, 1: ON}}
+  - id: 0x51
+    mode: 4int162ascii
+    topic: bench/motor
+    format: json
+    names: [a, b, c, d]
+  - id: 0x52
+    fd: true
+    mode: array
+    topic: bench/fd
+    params: {type: int16, count: "32"}
+`
+
+func BenchmarkHandleCAN(b *testing.B) {
+	br := benchBridge(b, benchExtra)
+	frames := map[string]Frame{
+		"uint162ascii": {ID: 0x100 + benchMappings/2, Length: 2, Data: [64]byte{0x34, 0x12}},
+		"layout":       {ID: 0x50, Length: 5, Data: [64]byte{0x10, 0x27, 0xF6, 0xFF, 1}},
+		"json":         {ID: 0x51, Length: 8, Data: [64]byte{1, 0, 2, 0, 3, 0, 4, 0}},
+		"fd64":         {ID: 0x52, Length: 64, Flags: FrameFD},
+	}
+	for _, name := range []string{"uint162ascii", "layout", "json", "fd64"} {
+		frame := frames[name]
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				br.handleCAN(frame)
+			}
+		})
+	}
+}
+
+// the check every frame on the bus goes through, mapped or not
+func BenchmarkDispatch(b *testing.B) {
+	br := benchBridge(b, "")
+	for name, id := range map[string]uint32{"subscribed": 0x100 + benchMappings - 1, "unsubscribed": 0x7FF} {
+		frame := Frame{ID: id, Length: 2}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if br.canSubscribed(frame.ID) {
+					br.pairByFrame(frame)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkHandleMQTT(b *testing.B) {
+	br := benchBridge(b, benchExtra)
+	msgs := map[string]benchMsg{
+		"uint162ascii": {topic: fmt.Sprintf("bench/sensor%d", benchMappings/2), payload: []byte("4660")},
+		"json":         {topic: "bench/motor", payload: []byte(`{"a":1,"b":2,"c":3,"d":4}`)},
+	}
+	for _, name := range []string{"uint162ascii", "json"} {
+		msg := msgs[name]
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				br.handleMQTT(nil, msg)
+			}
+		})
+	}
+}
+
+// benchClient is a MQTT client that accepts everything and keeps
+// nothing
+type benchClient struct {
+	mu   sync.Mutex
+	pubs int
+}
+
+func (c *benchClient) IsConnected() bool      { return true }
+func (c *benchClient) IsConnectionOpen() bool { return true }
+func (c *benchClient) Connect() MQTT.Token    { return fakeToken{} }
+func (c *benchClient) Disconnect(uint)        {}
+func (c *benchClient) Publish(string, byte, bool, interface{}) MQTT.Token {
+	c.mu.Lock()
+	c.pubs++
+	c.mu.Unlock()
+	return fakeToken{}
+}
+func (c *benchClient) Subscribe(string, byte, MQTT.MessageHandler) MQTT.Token {
+	return fakeToken{}
+}
+func (c *benchClient) SubscribeMultiple(map[string]byte, MQTT.MessageHandler) MQTT.Token {
+	return fakeToken{}
+}
+func (c *benchClient) Unsubscribe(...string) MQTT.Token        { return fakeToken{} }
+func (c *benchClient) AddRoute(string, MQTT.MessageHandler)    {}
+func (c *benchClient) OptionsReader() MQTT.ClientOptionsReader { return MQTT.ClientOptionsReader{} }
+
+// benchMsg is a message from the broker
+type benchMsg struct {
+	topic   string
+	payload []byte
+}
+
+func (m benchMsg) Duplicate() bool   { return false }
+func (m benchMsg) Qos() byte         { return 0 }
+func (m benchMsg) Retained() bool    { return false }
+func (m benchMsg) Topic() string     { return m.topic }
+func (m benchMsg) MessageID() uint16 { return 0 }
+func (m benchMsg) Payload() []byte   { return m.payload }
+func (m benchMsg) Ack()              {}
+
+// values published from CAN to a bidirectional topic come back from
+// the broker, they must not be sent to the bus again, but commands on
+// the topic must
+func TestOwnMessagesAreNotSentBack(t *testing.T) {
+	vbus := NewVirtualBus()
+	board := newTestNode(t, vbus)
+	file := writeFile(t, "can2mqtt.csv", "0x100,uint162ascii,test/setpoint\n")
+	b, client := startBridge(t, Config{MappingFile: file, CANBackend: vbus.Node()})
+	client.waitSubscribed(t, "test/setpoint")
+	client.mu.Lock()
+	client.echo = true
+	client.mu.Unlock()
+
+	for i, data := range [][]byte{{0x34, 0x12}, {0x35, 0x12}} {
+		frame := Frame{ID: 0x100, Length: 2}
+		copy(frame.Data[:], data)
+		if err := board.Publish(frame); err != nil {
+			t.Fatal(err)
+		}
+		client.waitPublished(t, "test/setpoint", i+1)
+	}
+	for deadline := time.Now().Add(testTimeout); ; time.Sleep(time.Millisecond) {
+		if pendingEchoes(b, "test/setpoint") == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the echoes didn't arrive")
+		}
+	}
+	// a command with the value of an echo is sent as well
+	client.deliver(t, "test/setpoint", "4661")
+	if frame := board.next(t); !bytes.Equal(frame.Payload()[:2], []byte{0x35, 0x12}) {
+		t.Errorf("command sent as %s", frame)
+	}
+	board.expectNothing(t)
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.unsubs != 0 {
+		t.Errorf("the topic was unsubscribed %d times while publishing", client.unsubs)
+	}
+}
+
+// pendingEchoes returns how many own messages on topic wait for their
+// echo
+func pendingEchoes(b *Bridge, topic string) int {
+	b.echoLock.Lock()
+	defer b.echoLock.Unlock()
+	if e := b.echoes[topic]; e != nil {
+		return len(e.pending)
+	}
+	return 0
+}
+
+// a broker that never sends own messages back, e.g. without the
+// permission to read the topic: the own messages are forgotten and a
+// command with the last value is still sent to the bus
+func TestBrokerWithoutEchoes(t *testing.T) {
+	vbus := NewVirtualBus()
+	board := newTestNode(t, vbus)
+	file := writeFile(t, "can2mqtt.csv", "0x100,uint162ascii,test/setpoint\n")
+	b, client := startBridge(t, Config{MappingFile: file, CANBackend: vbus.Node()})
+	client.waitSubscribed(t, "test/setpoint")
+
+	for i := 0; i < 2*maxEchoes; i++ {
+		if err := board.Publish(Frame{ID: 0x100, Length: 2, Data: [64]byte{byte(i)}}); err != nil {
+			t.Fatal(err)
+		}
+		client.waitPublished(t, "test/setpoint", i+1)
+	}
+	if n := pendingEchoes(b, "test/setpoint"); n != maxEchoes {
+		t.Errorf("%d own messages wait for their echo, want %d", n, maxEchoes)
+	}
+	// as if the echo timeout passed
+	b.echoLock.Lock()
+	for i := range b.echoes["test/setpoint"].pending {
+		b.echoes["test/setpoint"].pending[i].sent = time.Now().Add(-2 * echoTimeout)
+	}
+	b.echoLock.Unlock()
+	if err := board.Publish(Frame{ID: 0x100, Length: 2, Data: [64]byte{0x34, 0x12}}); err != nil {
+		t.Fatal(err)
+	}
+	client.waitPublished(t, "test/setpoint", 2*maxEchoes+1)
+	if n := pendingEchoes(b, "test/setpoint"); n != 0 {
+		t.Errorf("%d own messages wait for an echo that never comes", n)
+	}
+	client.deliver(t, "test/setpoint", "4660")
+	if frame := board.next(t); !bytes.Equal(frame.Payload()[:2], []byte{0x34, 0x12}) {
+		t.Errorf("command sent as %s", frame)
+	}
+}
+
+// own messages are only waited for on topics that were subscribed
+func TestFailedSubscriptionNoEchoes(t *testing.T) {
+	vbus := NewVirtualBus()
+	board := newTestNode(t, vbus)
+	file := writeFile(t, "can2mqtt.csv", "0x100,uint162ascii,test/setpoint\n")
+	client := newFakeClient()
+	client.subErr = errors.New("not authorized")
+	b, _ := startBridge(t, Config{MappingFile: file, CANBackend: vbus.Node(), MQTTClient: client})
+	client.waitFor(t, "the subscription", func() bool { return client.subs > 0 })
+
+	for i := 0; i < 3; i++ {
+		if err := board.Publish(Frame{ID: 0x100, Length: 2, Data: [64]byte{byte(i)}}); err != nil {
+			t.Fatal(err)
+		}
+		client.waitPublished(t, "test/setpoint", i+1)
+	}
+	b.echoLock.Lock()
+	defer b.echoLock.Unlock()
+	if len(b.echoes) != 0 {
+		t.Errorf("waiting for the echoes of %d topics", len(b.echoes))
+	}
+}
+
+// a rejected message never reaches the bus, the error topic tells why
+func TestRejectedMessages(t *testing.T) {
+	vbus := NewVirtualBus()
+	board := newTestNode(t, vbus)
+	file := writeFile(t, "can2mqtt.csv", `0x100,uint162ascii,test/speed
+0x101,setup2motor,test/setup
+0x102,none,test/raw
+`)
+	_, client := startBridge(t, Config{MappingFile: file, CANBackend: vbus.Node(), ErrorTopic: "test/errors"})
+	tests := []struct {
+		topic   string
+		payload string
+		reason  string
+	}{
+		{"test/speed", "70000", "70000 is out of the range of uint16"},
+		{"test/speed", "1O0", `"1O0" is not a valid uint16`},
+		{"test/setup", "1 2", "expected 3 numbers separated by \" \", got 2"},
+		{"test/raw", "123456789", "9 data bytes don't fit into a CAN-frame"},
+		{"test/speed", "", `"" is not a valid uint16`},
+	}
+	for i, tt := range tests {
+		client.waitSubscribed(t, tt.topic)
+		client.deliver(t, tt.topic, tt.payload)
+		board.expectNothing(t)
+		msg := client.waitPublished(t, "test/errors", i+1)
+		var rj rejection
+		if err := json.Unmarshal(msg.payload, &rj); err != nil {
+			t.Fatal(err)
+		}
+		if rj.Topic != tt.topic || rj.Payload != tt.payload || !strings.Contains(rj.Reason, tt.reason) {
+			t.Errorf("%s %q: rejected as %+v, want the reason %s", tt.topic, tt.payload, rj, tt.reason)
+		}
+	}
+	// the mapping still works
+	client.deliver(t, "test/speed", "100")
+	if frame := board.next(t); frame.ID != 0x100 || frame.Payload()[0] != 100 {
+		t.Errorf("message sent as %s", frame)
+	}
+}
@@ -0,0 +1,195 @@
+package can2mqtt_tuc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+)
+
+// ErrNotRunning is returned by Reload if the bridge is not running.
+var ErrNotRunning = errors.New("main: the bridge is not running")
+
+// Reload reads the mapping file again and applies the differences to
+// the running bridge: MQTT-topics and CAN-IDs of removed or changed
+// mappings are unsubscribed, new ones are subscribed and unchanged
+// mappings are left alone. If the new file can not be read or is
+// invalid the error is returned and the old mappings stay in place.
+func (b *Bridge) Reload() error {
+	b.pairLock.RLock()
+	running := b.pairFromID != nil
+	b.pairLock.RUnlock()
+	if !running {
+		return ErrNotRunning
+	}
+	fmt.Printf("main: reloading %s\n", b.conf.MappingFile)
+	return b.loadMappings(b.conf.MappingFile)
+}
+
+// loadMappings reads the mapping file and makes the bridge use the
+// mappings found in it
+func (b *Bridge) loadMappings(filename string) error {
+	b.reloadLock.Lock()
+	defer b.reloadLock.Unlock()
+	pairs, err := readMappings(filename)
+	if err != nil {
+		return err
+	}
+	if _, _, err := indexMappings(pairs); err != nil {
+		return err
+	}
+
+	b.pairLock.Lock()
+	old := make(map[pairKey]*can2mqtt)
+	for _, list := range b.pairFromID {
+		for _, c2mp := range list {
+			old[c2mp.key()] = c2mp
+		}
+	}
+	var added, removed []*can2mqtt
+	for i, c2mp := range pairs {
+		o, ok := old[c2mp.key()]
+		delete(old, c2mp.key())
+		if ok && o.equal(c2mp) {
+			// keep the old one, it may carry state (see dbcMessage)
+			pairs[i] = o
+			continue
+		}
+		if ok {
+			removed = append(removed, o)
+		}
+		added = append(added, c2mp)
+	}
+	for _, o := range old {
+		removed = append(removed, o)
+	}
+	fromID, fromTopic, _ := indexMappings(pairs)
+	b.pairFromID = fromID
+	b.pairFromTopic = fromTopic
+	b.pairLock.Unlock()
+
+	// unsubscribe first, a changed mapping may keep its topic or ID
+	// read-only mappings never get their topic subscribed and the IDs of
+	// write-only mappings are never subscribed on the CAN side
+	for _, c2mp := range removed {
+		if b.forwardsToCAN(c2mp) {
+			b.mqttUnsubscribe(c2mp.subTopic())
+		}
+		if b.forwardsToMQTT(c2mp) {
+			b.canUnsubscribe(c2mp.frameID())
+		}
+	}
+	for _, c2mp := range added {
+		if b.forwardsToCAN(c2mp) {
+			b.mqttSubscribe(c2mp.subTopic(), b.qosOf(c2mp))
+		}
+		if b.forwardsToMQTT(c2mp) {
+			b.canSubscribe(c2mp.frameID())
+		}
+	}
+	if b.conf.Debug {
+		fmt.Printf("main: %d mappings loaded, %d added, %d removed\n", len(pairs), len(added), len(removed))
+		fmt.Printf("main: the following CAN-MQTT pairs have been extracted:\n")
+		fmt.Printf("main: CAN-ID\t\t conversion mode\t\tdirection\tMQTT-topic\n")
+		for _, c2mp := range pairs {
+			fmt.Printf("main: %d\t\t%s\t\t%s\t%s %s\n", c2mp.canId, c2mp.convMethod, c2mp.direction, c2mp.mqttTopic, c2mp.unit)
+		}
+	}
+	return nil
+}
+
+// indexMappings builds the lookup maps for a list of mappings and
+// makes sure that each ID and each topic is only used once, except for
+// the IDs of multiplexed frames with one mapping per multiplexer value
+func indexMappings(pairs []*can2mqtt) (map[uint32][]*can2mqtt, map[string]*can2mqtt, error) {
+	fromID := make(map[uint32][]*can2mqtt)
+	fromTopic := make(map[string]*can2mqtt)
+	keys := make(map[pairKey]bool)
+	topics := make(map[string]bool)
+	for _, c2mp := range pairs {
+		if first := fromID[c2mp.frameID()]; keys[c2mp.key()] || (len(first) > 0 && !sameMultiplexer(first[0], c2mp)) {
+			return nil, nil, fmt.Errorf("main: each ID and each topic is only allowed once! (ID %d)", c2mp.canId)
+		}
+		for _, topic := range c2mp.topics() {
+			if topics[topic] {
+				return nil, nil, fmt.Errorf("main: each ID and each topic is only allowed once! (ID %d, topic %s)", c2mp.canId, topic)
+			}
+			topics[topic] = true
+		}
+		keys[c2mp.key()] = true
+		fromID[c2mp.frameID()] = append(fromID[c2mp.frameID()], c2mp)
+		fromTopic[c2mp.subTopic()] = c2mp
+	}
+	return fromID, fromTopic, nil
+}
+
+// sameMultiplexer tells whether two mappings are values of the same
+// multiplexer and may share their ID
+func sameMultiplexer(a, b *can2mqtt) bool {
+	return a.mux != nil && b.mux != nil && reflect.DeepEqual(a.mux.sig, b.mux.sig)
+}
+
+// equal tells whether two mappings are configured the same way
+func (c2mp *can2mqtt) equal(o *can2mqtt) bool {
+	if c2mp.canId != o.canId || c2mp.convMethod != o.convMethod ||
+		c2mp.cmdTopic != o.cmdTopic || c2mp.direction != o.direction ||
+		!sameOpt(c2mp.qos, o.qos) || !sameOpt(c2mp.retain, o.retain) ||
+		c2mp.extended != o.extended || c2mp.fd != o.fd || c2mp.brs != o.brs || c2mp.description != o.description ||
+		c2mp.unit != o.unit || !sameOpt(c2mp.scaling, o.scaling) || c2mp.format != o.format {
+		return false
+	}
+	if !reflect.DeepEqual(c2mp.mqttTopic, o.mqttTopic) || !reflect.DeepEqual(c2mp.fields, o.fields) ||
+		!reflect.DeepEqual(c2mp.names, o.names) || !reflect.DeepEqual(c2mp.table, o.table) ||
+		!reflect.DeepEqual(c2mp.mux, o.mux) || !reflect.DeepEqual(c2mp.isotp, o.isotp) {
+		return false
+	}
+	if len(c2mp.params) != len(o.params) || (len(c2mp.params) > 0 && !reflect.DeepEqual(c2mp.params, o.params)) {
+		return false
+	}
+	if (c2mp.dbc == nil) != (o.dbc == nil) {
+		return false
+	}
+	if c2mp.dbc != nil {
+		return c2mp.dbc.name == o.dbc.name && c2mp.dbc.dlc == o.dbc.dlc &&
+			c2mp.dbc.writable == o.dbc.writable &&
+			reflect.DeepEqual(c2mp.dbc.signals, o.dbc.signals)
+	}
+	return true
+}
+
+// sameOpt compares two optional settings
+func sameOpt[T comparable](a, b *T) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// watchMappingFile polls the mapping file every interval and reloads
+// it when its size or modification time changed
+func (b *Bridge) watchMappingFile(ctx context.Context, interval time.Duration) {
+	last, _ := os.Stat(b.conf.MappingFile)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		fi, err := os.Stat(b.conf.MappingFile)
+		if err != nil {
+			// probably the editor is just replacing the file
+			continue
+		}
+		if last != nil && fi.ModTime().Equal(last.ModTime()) && fi.Size() == last.Size() {
+			continue
+		}
+		last = fi
+		if err := b.Reload(); err != nil {
+			fmt.Printf("main: reload of %s failed, keeping the old mappings: %s\n", b.conf.MappingFile, err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package can2mqtt_tuc
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+const reloadYAML = `
+mappings:
+  - {id: 0x100, mode: uint82ascii, topic: test/a}
+  - {id: 0x101, mode: uint82ascii, topic: test/b}
+  - {id: 0x102, mode: uint82ascii, topic: test/c}
+  - {id: 0x103, mode: uint82ascii, topic: test/r, direction: can2mqtt}
+  - id: 0x1A0
+    multiplexer: {byte: 0}
+    multiplexed:
+      - {value: 1, topic: test/m1, fields: [{byte: 1}]}
+      - {value: 2, topic: test/m2, fields: [{byte: 1}]}
+`
+
+// the second version of reloadYAML: a unchanged, b with another mode,
+// c and m2 removed, d added, r becomes writable
+const reloadYAML2 = `
+mappings:
+  - {id: 0x100, mode: uint82ascii, topic: test/a}
+  - {id: 0x101, mode: uint162ascii, topic: test/b}
+  - {id: 0x104, mode: uint82ascii, topic: test/d}
+  - {id: 0x103, mode: uint82ascii, topic: test/r}
+  - id: 0x1A0
+    multiplexer: {byte: 0}
+    multiplexed:
+      - {value: 1, topic: test/m1, fields: [{byte: 1}]}
+`
+
+// subscriptions returns the subscribed topics and the subscription
+// counts of the CAN-IDs
+func subscriptions(b *Bridge, client *fakeClient) ([]string, map[uint32]int) {
+	client.mu.Lock()
+	var topics []string
+	for topic := range client.handlers {
+		topics = append(topics, topic)
+	}
+	client.mu.Unlock()
+	sort.Strings(topics)
+	b.csiLock.RLock()
+	ids := make(map[uint32]int)
+	for id, n := range b.csi {
+		ids[id] = n
+	}
+	b.csiLock.RUnlock()
+	return topics, ids
+}
+
+// rewrite replaces the content of a mapping file
+func rewrite(t *testing.T, file, content string) {
+	t.Helper()
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadMappingsDiff(t *testing.T) {
+	file := writeFile(t, "can2mqtt.yaml", reloadYAML)
+	client := newFakeClient()
+	b := NewBridge(Config{MappingFile: file, CANBackend: NewVirtualBus().Node(), MQTTClient: client})
+	if err := b.loadMappings(file); err != nil {
+		t.Fatal(err)
+	}
+	topics, ids := subscriptions(b, client)
+	if want := []string{"test/a", "test/b", "test/c", "test/m1", "test/m2"}; !reflect.DeepEqual(topics, want) {
+		t.Errorf("subscribed %q, want %q", topics, want)
+	}
+	if want := map[uint32]int{0x100: 1, 0x101: 1, 0x102: 1, 0x103: 1, 0x1A0: 2}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("subscribed the IDs %v, want %v", ids, want)
+	}
+	a, m1 := b.pairByTopic("test/a"), b.pairByTopic("test/m1")
+
+	// the same file again changes nothing
+	if err := b.loadMappings(file); err != nil {
+		t.Fatal(err)
+	}
+	if client.subs != 5 || client.unsubs != 0 {
+		t.Errorf("%d subscribed and %d unsubscribed for the same mappings", client.subs-5, client.unsubs)
+	}
+
+	rewrite(t, file, reloadYAML2)
+	if err := b.loadMappings(file); err != nil {
+		t.Fatal(err)
+	}
+	topics, ids = subscriptions(b, client)
+	if want := []string{"test/a", "test/b", "test/d", "test/m1", "test/r"}; !reflect.DeepEqual(topics, want) {
+		t.Errorf("subscribed %q, want %q", topics, want)
+	}
+	if want := map[uint32]int{0x100: 1, 0x101: 1, 0x103: 1, 0x104: 1, 0x1A0: 1}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("subscribed the IDs %v, want %v", ids, want)
+	}
+	// b, d and r subscribed, b, c and m2 unsubscribed
+	if client.subs != 8 || client.unsubs != 3 {
+		t.Errorf("%d subscribed and %d unsubscribed, want 3 and 3", client.subs-5, client.unsubs)
+	}
+	if b.pairByTopic("test/a") != a || b.pairByTopic("test/m1") != m1 {
+		t.Error("unchanged mappings were replaced")
+	}
+	if c2mp := b.pairByTopic("test/b"); c2mp.convMethod != "uint162ascii" {
+		t.Errorf("test/b has the mode %s", c2mp.convMethod)
+	}
+	if b.pairByTopic("test/c") != nil || b.pairByTopic("test/m2") != nil {
+		t.Error("removed mappings are still there")
+	}
+	if c2mp, err := b.pairByFrame(Frame{ID: 0x1A0, Length: 2, Data: [64]byte{2}}); err == nil {
+		t.Errorf("multiplexer value 2 selects %s", c2mp.mqttTopic)
+	}
+
+	// an invalid file leaves everything as it is
+	rewrite(t, file, reloadYAML2+"  - {id: 0x100, mode: uint82ascii, topic: test/e}\n")
+	if err := b.loadMappings(file); err == nil {
+		t.Error("an ID used twice was loaded")
+	}
+	topics2, ids2 := subscriptions(b, client)
+	if !reflect.DeepEqual(topics2, topics) || !reflect.DeepEqual(ids2, ids) || b.pairByTopic("test/e") != nil {
+		t.Errorf("changed by an invalid file: %q %v", topics2, ids2)
+	}
+}
+
+func TestReloadNotRunning(t *testing.T) {
+	b := NewBridge(Config{CANBackend: NewVirtualBus().Node(), MQTTClient: newFakeClient()})
+	if err := b.Reload(); err != ErrNotRunning {
+		t.Errorf("got %v, want ErrNotRunning", err)
+	}
+}
@@ -0,0 +1,131 @@
+package can2mqtt_tuc
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// numberKind tells what kind of numbers the values of a converter are
+type numberKind int
+
+const (
+	noNumbers numberKind = iota // text, colors, ... can't be scaled
+	integers                    // scaled values are rounded on encode
+	floats
+)
+
+// numberer is implemented by converters whose values are numbers,
+// only their mappings can have a scale and offset
+type numberer interface {
+	numbers() numberKind
+}
+
+// scaling converts the raw numbers of a mapping into engineering
+// units: value = raw * scale + offset
+type scaling struct {
+	scale     float64
+	offset    float64
+	precision int  // digits after the decimal point, -1: as many as needed
+	round     bool // the raw numbers are integers
+}
+
+// newScaling checks the scale, offset and precision of a mapping, nil
+// means the mapping isn't scaled
+func newScaling(scale, offset *float64, precision *int) (*scaling, error) {
+	if scale == nil && offset == nil && precision == nil {
+		return nil, nil
+	}
+	s := &scaling{scale: 1, precision: -1}
+	if scale != nil {
+		if *scale == 0 || math.IsNaN(*scale) || math.IsInf(*scale, 0) {
+			return nil, fmt.Errorf("invalid scale %g", *scale)
+		}
+		s.scale = *scale
+	}
+	if offset != nil {
+		s.offset = *offset
+	}
+	if precision != nil {
+		if *precision < 0 || *precision > 15 {
+			return nil, fmt.Errorf("invalid precision %d, valid values are 0 to 15", *precision)
+		}
+		s.precision = *precision
+	}
+	return s, nil
+}
+
+// resolveScaling checks that the converter of a scaled mapping has
+// numbers and whether they are integers
+func resolveScaling(c2mp *can2mqtt) error {
+	if c2mp.scaling == nil {
+		return nil
+	}
+	if c2mp.convMethod == "layout" {
+		return fmt.Errorf("a layout is scaled per field")
+	}
+	n, ok := c2mp.conv.(numberer)
+	if !ok || n.numbers() == noNumbers {
+		return fmt.Errorf("convert-mode %s has no numbers to scale", c2mp.convMethod)
+	}
+	c2mp.scaling.round = n.numbers() == integers
+	return nil
+}
+
+// decode turns the raw numbers of the values into engineering units.
+// A value can hold several numbers separated by spaces.
+func (s *scaling) decode(values []string) ([]string, error) {
+	if s == nil {
+		return values, nil
+	}
+	scaled := make([]string, len(values))
+	for i, value := range values {
+		nums := strings.Fields(value)
+		for j, num := range nums {
+			raw, err := strconv.ParseFloat(num, 64)
+			if err != nil {
+				return nil, fmt.Errorf("can't scale %q, it is not a number", num)
+			}
+			nums[j] = s.format(raw*s.scale + s.offset)
+		}
+		scaled[i] = strings.Join(nums, " ")
+	}
+	return scaled, nil
+}
+
+// encode turns values in engineering units back into raw numbers
+func (s *scaling) encode(values []string) ([]string, error) {
+	if s == nil {
+		return values, nil
+	}
+	raws := make([]string, len(values))
+	for i, value := range values {
+		nums := strings.Fields(value)
+		for j, num := range nums {
+			v, err := strconv.ParseFloat(num, 64)
+			if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+				return nil, fmt.Errorf("%q is not a valid number", num)
+			}
+			raw := (v - s.offset) / s.scale
+			if s.round {
+				nums[j] = strconv.FormatFloat(math.Round(raw), 'f', 0, 64)
+			} else {
+				nums[j] = strconv.FormatFloat(raw, 'g', -1, 64)
+			}
+		}
+		raws[i] = strings.Join(nums, " ")
+	}
+	return raws, nil
+}
+
+// format prints a scaled value with the precision of the mapping.
+// Without precision the noise of the float arithmetic (21.500000000000004)
+// is cut off after 12 significant digits.
+func (s *scaling) format(v float64) string {
+	if s.precision >= 0 {
+		return strconv.FormatFloat(v, 'f', s.precision, 64)
+	}
+	v, _ = strconv.ParseFloat(strconv.FormatFloat(v, 'g', 12, 64), 64)
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
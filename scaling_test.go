@@ -0,0 +1,113 @@
+package can2mqtt_tuc
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func testScaling(t *testing.T, scale, offset float64, precision int, round bool) *scaling {
+	t.Helper()
+	var p *int
+	if precision >= 0 {
+		p = &precision
+	}
+	s, err := newScaling(&scale, &offset, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.round = round
+	return s
+}
+
+func TestScalingRoundTrip(t *testing.T) {
+	tests := []struct {
+		s     *scaling
+		raw   string
+		value string
+	}{
+		{testScaling(t, 0.1, 0, -1, true), "215", "21.5"}, // no 21.500000000000004
+		{testScaling(t, 0.1, 0, -1, true), "-3", "-0.3"},
+		{testScaling(t, 0.1, -40, -1, true), "400", "0"},
+		{testScaling(t, 0.1, -40, 2, true), "655", "25.50"},
+		{testScaling(t, 2, 0, 0, true), "7", "14"},
+		{testScaling(t, 0.01, 0, -1, true), "100 -250 3", "1 -2.5 0.03"},
+		{testScaling(t, 0.5, 1, -1, false), "1.5", "1.75"},
+		{testScaling(t, -1, 0, -1, false), "2.25", "-2.25"},
+	}
+	for _, tt := range tests {
+		values, err := tt.s.decode([]string{tt.raw})
+		if err != nil {
+			t.Errorf("%s: %s", tt.raw, err)
+			continue
+		}
+		if values[0] != tt.value {
+			t.Errorf("%s decoded as %s, want %s", tt.raw, values[0], tt.value)
+		}
+		raws, err := tt.s.encode([]string{tt.value})
+		if err != nil {
+			t.Errorf("%s: %s", tt.value, err)
+			continue
+		}
+		if raws[0] != tt.raw {
+			t.Errorf("%s encoded as %s, want %s", tt.value, raws[0], tt.raw)
+		}
+	}
+}
+
+func TestScalingEncode(t *testing.T) {
+	tenth := testScaling(t, 0.1, 0, -1, true)
+	tests := []struct {
+		s      *scaling
+		value  string
+		raw    string
+		reason string // "": no error
+	}{
+		{tenth, "21.54", "215", ""}, // rounded to the resolution
+		{tenth, "21.56", "216", ""},
+		{tenth, "-0.05", "-1", ""}, // away from zero
+		{tenth, "1e1", "100", ""},
+		{testScaling(t, 0.1, 0, -1, false), "21.54", "215.39999999999998", ""},
+		{tenth, "warm", "", `"warm" is not a valid number`},
+		{tenth, "NaN", "", "is not a valid number"},
+		{tenth, "-Inf", "", "is not a valid number"},
+	}
+	for _, tt := range tests {
+		raws, err := tt.s.encode([]string{tt.value})
+		if tt.reason != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.reason) {
+				t.Errorf("%s: got %q, %v, want the error %s", tt.value, raws, err, tt.reason)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.value, err)
+		} else if raws[0] != tt.raw {
+			t.Errorf("%s encoded as %s, want %s", tt.value, raws[0], tt.raw)
+		}
+	}
+	if _, err := tenth.decode([]string{"abc"}); err == nil {
+		t.Error("abc decoded")
+	}
+}
+
+func TestNewScaling(t *testing.T) {
+	zero, nan, precision := 0.0, math.NaN(), 16
+	tests := []struct {
+		scale     *float64
+		precision *int
+		problem   string
+	}{
+		{&zero, nil, "invalid scale 0"},
+		{&nan, nil, "invalid scale NaN"},
+		{nil, &precision, "invalid precision 16"},
+	}
+	for _, tt := range tests {
+		if _, err := newScaling(tt.scale, nil, tt.precision); err == nil || !strings.Contains(err.Error(), tt.problem) {
+			t.Errorf("got %v, want %q", err, tt.problem)
+		}
+	}
+	if s, err := newScaling(nil, nil, nil); s != nil || err != nil {
+		t.Errorf("no scaling: %v, %v", s, err)
+	}
+}
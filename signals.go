@@ -0,0 +1,325 @@
+package can2mqtt_tuc
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// signal describes a value that is packed into the bits of a
+// CAN-frame, the way DBC files describe them. Physical values are
+// raw*factor+offset.
+type signal struct {
+	name      string
+	startBit  int  // LSB (little endian) or MSB (big endian) in DBC bit numbering
+	length    int  // length in bits
+	bigEndian bool // Motorola byte order (@0 in DBC files)
+	signed    bool
+	float     bool // IEEE 754 float with 16, 32 or 64 bits
+	factor    float64
+	offset    float64
+	unit      string
+	values    map[int64]string // value table: raw value -> label
+}
+
+// bitPositions returns the positions of the bits of the signal inside
+// the frame, most significant bit first. Position p is bit p%8 of
+// byte p/8.
+func (s *signal) bitPositions() []int {
+	pos := make([]int, s.length)
+	if s.bigEndian {
+		// DBC numbering for Motorola signals: start at the MSB and walk
+		// towards bit 0 of the byte, then continue with bit 7 of the
+		// next byte
+		p := s.startBit
+		for i := 0; i < s.length; i++ {
+			pos[i] = p
+			if p%8 == 0 {
+				p += 15
+			} else {
+				p--
+			}
+		}
+		return pos
+	}
+	for i := 0; i < s.length; i++ {
+		pos[s.length-1-i] = s.startBit + i
+	}
+	return pos
+}
+
+// check makes sure that the signal fits into a frame with size bytes
+func (s *signal) check(size int) error {
+	if s.length < 1 || s.length > 64 {
+		return fmt.Errorf("signal %s: invalid length %d", s.name, s.length)
+	}
+	if s.float && s.length != 16 && s.length != 32 && s.length != 64 {
+		return fmt.Errorf("signal %s: floats have 16, 32 or 64 bits, not %d", s.name, s.length)
+	}
+	if s.factor == 0 {
+		return fmt.Errorf("signal %s: factor must not be 0", s.name)
+	}
+	for _, p := range s.bitPositions() {
+		if p < 0 || p >= size*8 {
+			return fmt.Errorf("signal %s: bit %d is outside of the %d data bytes", s.name, p, size)
+		}
+	}
+	return nil
+}
+
+// raw extracts the raw value of the signal out of the data bytes
+func (s *signal) raw(data []byte) int64 {
+	var v uint64
+	for _, p := range s.bitPositions() {
+		v <<= 1
+		if p/8 < len(data) && data[p/8]&(1<<(p%8)) != 0 {
+			v |= 1
+		}
+	}
+	if s.signed && s.length < 64 && v&(1<<(s.length-1)) != 0 {
+		v |= ^uint64(0) << s.length // sign extension
+	}
+	return int64(v)
+}
+
+// setRaw packs a raw value into the data bytes
+func (s *signal) setRaw(data []byte, raw int64) {
+	v := uint64(raw)
+	pos := s.bitPositions()
+	for i := len(pos) - 1; i >= 0; i-- {
+		p := pos[i]
+		if v&1 != 0 {
+			data[p/8] |= 1 << (p % 8)
+		} else {
+			data[p/8] &^= 1 << (p % 8)
+		}
+		v >>= 1
+	}
+}
+
+// decode returns the physical value of the signal as a string, or its
+// label if the value table has one for the raw value
+func (s *signal) decode(data []byte) string {
+	raw := s.raw(data)
+	if s.float {
+		return s.decodeFloat(raw)
+	}
+	if label, ok := s.values[raw]; ok {
+		return label
+	}
+	if s.factor == 1 && s.offset == 0 {
+		// plain integers, no detour via float64
+		if s.signed {
+			return strconv.FormatInt(raw, 10)
+		}
+		return strconv.FormatUint(uint64(raw), 10)
+	}
+	// raw*factor+offset is exact with that many bits, rounding to the
+	// decimals of factor and offset removes the noise of 0.1*671-40
+	// and keeps every step of 2^-63
+	v := new(big.Float).SetPrec(bigPrec)
+	if s.signed {
+		v.SetInt64(raw)
+	} else {
+		v.SetUint64(uint64(raw))
+	}
+	v.Mul(v, big.NewFloat(s.factor))
+	v.Add(v, big.NewFloat(s.offset))
+	digits := decimals(s.factor)
+	if d := decimals(s.offset); d > digits {
+		digits = d
+	}
+	str := v.Text('f', digits)
+	if strings.Contains(str, ".") {
+		str = strings.TrimRight(strings.TrimRight(str, "0"), ".")
+	}
+	if str == "-0" {
+		str = "0"
+	}
+	return str
+}
+
+// bigPrec is the precision of the big.Float arithmetic of scaled
+// signals, enough for a 64 bit raw value times a float64 factor
+const bigPrec = 256
+
+// decimals returns the number of decimals a physical value with the
+// factor or offset f needs. Powers of two like 2^-31 of the Qm.n types
+// get all their digits, the shortest representation of a float64 has
+// fewer.
+func decimals(f float64) int {
+	if frac, exp := math.Frexp(math.Abs(f)); frac == 0.5 {
+		if exp < 1 {
+			return 1 - exp
+		}
+		return 0
+	}
+	str := strconv.FormatFloat(f, 'f', -1, 64)
+	if i := strings.IndexByte(str, '.'); i >= 0 {
+		return len(str) - i - 1
+	}
+	return 0
+}
+
+// encode packs the physical value or label given as string into
+// the data bytes. Unscaled integers have to be integers, scaled ones
+// are rounded to the nearest raw value.
+func (s *signal) encode(data []byte, value string) error {
+	value = strings.TrimSpace(value)
+	for raw, label := range s.values {
+		if label == value {
+			s.setRaw(data, raw)
+			return nil
+		}
+	}
+	if !s.float && s.factor == 1 && s.offset == 0 {
+		// plain integers, float64 can't hold all 64 bit values
+		if s.signed {
+			raw, err := parseInt(value, s.length)
+			if err != nil {
+				return fmt.Errorf("signal %s: %s", s.name, err)
+			}
+			s.setRaw(data, raw)
+			return nil
+		}
+		raw, err := parseUint(value, s.length)
+		if err != nil {
+			return fmt.Errorf("signal %s: %s", s.name, err)
+		}
+		s.setRaw(data, int64(raw))
+		return nil
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return fmt.Errorf("signal %s: invalid value %q", s.name, value)
+	}
+	if s.float {
+		return s.encodeFloat(data, v)
+	}
+	// float64 has only 53 bits, not enough for the values of uq1.63
+	exact, _, err := big.ParseFloat(value, 10, bigPrec, big.ToNearestEven)
+	if err != nil {
+		return fmt.Errorf("signal %s: invalid value %q", s.name, value)
+	}
+	exact.Sub(exact, big.NewFloat(s.offset))
+	exact.Quo(exact, big.NewFloat(s.factor))
+	// round half away from zero, Int truncates
+	if exact.Signbit() {
+		exact.Sub(exact, big.NewFloat(0.5))
+	} else {
+		exact.Add(exact, big.NewFloat(0.5))
+	}
+	raw, _ := exact.Int(nil)
+	min, limit := s.rawRange()
+	if raw.Cmp(min) < 0 || raw.Cmp(limit) >= 0 {
+		return fmt.Errorf("signal %s: value %s is out of range", s.name, value)
+	}
+	if s.signed {
+		s.setRaw(data, raw.Int64())
+	} else {
+		s.setRaw(data, int64(raw.Uint64()))
+	}
+	return nil
+}
+
+// rawRange returns the smallest raw value of the signal and the
+// first one that is too big
+func (s *signal) rawRange() (min, limit *big.Int) {
+	if s.signed {
+		limit = new(big.Int).Lsh(big.NewInt(1), uint(s.length-1))
+		return new(big.Int).Neg(limit), limit
+	}
+	return new(big.Int), new(big.Int).Lsh(big.NewInt(1), uint(s.length))
+}
+
+// decodeFloat interprets the raw bits as float
+func (s *signal) decodeFloat(raw int64) string {
+	var v float64
+	bitSize := 64
+	switch s.length {
+	case 16:
+		v = float16frombits(uint16(raw))
+		bitSize = 32 // every half float is a float32
+	case 32:
+		v = float64(math.Float32frombits(uint32(raw)))
+		bitSize = 32
+	default:
+		v = math.Float64frombits(uint64(raw))
+	}
+	if s.factor == 1 && s.offset == 0 {
+		return strconv.FormatFloat(v, 'f', -1, bitSize)
+	}
+	return strconv.FormatFloat(v*s.factor+s.offset, 'f', -1, 64)
+}
+
+// encodeFloat packs the physical value as float
+func (s *signal) encodeFloat(data []byte, v float64) error {
+	v = (v - s.offset) / s.factor
+	switch s.length {
+	case 64:
+		s.setRaw(data, int64(math.Float64bits(v)))
+		return nil
+	case 16:
+		h, ok := float16bits(v)
+		if !ok {
+			return fmt.Errorf("signal %s: value %g is out of range", s.name, v)
+		}
+		s.setRaw(data, int64(h))
+		return nil
+	}
+	if math.Abs(v) > math.MaxFloat32 {
+		return fmt.Errorf("signal %s: value %g is out of range", s.name, v)
+	}
+	s.setRaw(data, int64(math.Float32bits(float32(v))))
+	return nil
+}
+
+// float16frombits converts an IEEE 754 half precision float
+func float16frombits(h uint16) float64 {
+	sign := 1.0
+	if h&0x8000 != 0 {
+		sign = -1
+	}
+	exp := int(h >> 10 & 0x1f)
+	frac := float64(h & 0x3ff)
+	switch exp {
+	case 0: // subnormal
+		return sign * math.Ldexp(frac, -24)
+	case 31:
+		if frac == 0 {
+			return math.Inf(int(sign))
+		}
+		return math.NaN()
+	}
+	return sign * math.Ldexp(1+frac/1024, exp-15)
+}
+
+// float16bits converts v into an IEEE 754 half precision float,
+// rounded to the nearest even. It fails if v is too big for 16 bits.
+func float16bits(v float64) (uint16, bool) {
+	var sign uint16
+	if math.Signbit(v) {
+		sign = 0x8000
+		v = -v
+	}
+	if v == 0 {
+		return sign, true
+	}
+	frac, exp := math.Frexp(v) // v = frac * 2^exp, frac in [0.5, 1)
+	e := exp - 1 + 15
+	if e <= 0 {
+		// subnormal, a mantissa of 1024 is the smallest normal number
+		return sign | uint16(math.RoundToEven(math.Ldexp(v, 24))), true
+	}
+	m := math.RoundToEven((frac*2 - 1) * 1024)
+	if m == 1024 {
+		m = 0
+		e++
+	}
+	if e >= 31 {
+		return 0, false
+	}
+	return sign | uint16(e)<<10 | uint16(m), true
+}
@@ -0,0 +1,179 @@
+package can2mqtt_tuc
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"testing"
+)
+
+// a single number of each type at its limits, encoded into the frame
+// and decoded back (and the other way round)
+func TestSignalLimitsRoundTrip(t *testing.T) {
+	maxFloat64 := strconv.FormatFloat(math.MaxFloat64, 'f', -1, 64)
+	tests := []struct {
+		typ     string
+		payload string
+		data    []byte
+	}{
+		{"int8", "-128", []byte{0x80}},
+		{"int8", "127", []byte{0x7f}},
+		{"int8", "-1", []byte{0xff}},
+		{"int64", "-9223372036854775808", []byte{0, 0, 0, 0, 0, 0, 0, 0x80}},
+		{"int64", "9223372036854775807", []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}},
+		{"int64", "-2", []byte{0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"uint64", "18446744073709551615", []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"uint64", "9007199254740993", []byte{1, 0, 0, 0, 0, 0, 0x20, 0}}, // 2^53+1, no float64 has it
+		{"uint64", "0", []byte{0, 0, 0, 0, 0, 0, 0, 0}},
+		{"float16", "65504", []byte{0xff, 0x7b}},
+		{"float16", "-0.5", []byte{0x00, 0xb8}},
+		{"float16", "1.5", []byte{0x00, 0x3e}},
+		{"float64", maxFloat64, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xef, 0x7f}},
+		{"float64", "-2.5", []byte{0, 0, 0, 0, 0, 0, 0x04, 0xc0}},
+		{"float64", "0.1", []byte{0x9a, 0x99, 0x99, 0x99, 0x99, 0x99, 0xb9, 0x3f}},
+		{"q1.15", "-1", []byte{0x00, 0x80}},
+		{"q1.15", "0.5", []byte{0x00, 0x40}},
+		{"uq8.8", "255.99609375", []byte{0xff, 0xff}},
+		{"uq8.8", "1.5", []byte{0x80, 0x01}},
+	}
+	for _, tt := range tests {
+		conv, err := newConverter(ConverterConfig{Mode: "array", Params: map[string]string{"type": tt.typ}})
+		if err != nil {
+			t.Fatalf("%s: %s", tt.typ, err)
+		}
+		data, err := conv.Encode([]string{tt.payload})
+		if err != nil {
+			t.Errorf("%s: encoding %q: %s", tt.typ, tt.payload, err)
+		} else if !bytes.Equal(data, tt.data) {
+			t.Errorf("%s: %q encoded as % X, want % X", tt.typ, tt.payload, data, tt.data)
+		}
+		values, err := conv.Decode(tt.data)
+		if err != nil {
+			t.Errorf("%s: decoding % X: %s", tt.typ, tt.data, err)
+		} else if len(values) != 1 || values[0] != tt.payload {
+			t.Errorf("%s: % X decoded as %q, want %q", tt.typ, tt.data, values, tt.payload)
+		}
+	}
+}
+
+// frames of fixed-point types with many fractional bits decoded and
+// encoded again, float64 has neither their steps nor their limits
+func TestSignalFixedPointRoundTrip(t *testing.T) {
+	tests := []struct {
+		typ     string
+		data    []byte
+		payload string
+	}{
+		{"q1.31", []byte{0xff, 0xff, 0xff, 0x7f}, "0.9999999995343387126922607421875"},
+		{"q1.31", []byte{0x00, 0x00, 0x00, 0x80}, "-1"},
+		{"q1.31", []byte{0x01, 0x00, 0x00, 0x00}, "0.0000000004656612873077392578125"},
+		{"q1.31", []byte{0x03, 0x00, 0x00, 0x00}, "0.0000000013969838619232177734375"},
+		{"q1.31", []byte{0xff, 0xff, 0xff, 0xff}, "-0.0000000004656612873077392578125"},
+		{"uq0.32", []byte{0xff, 0xff, 0xff, 0xff}, "0.99999999976716935634613037109375"},
+		{"uq0.32", []byte{0x01, 0x00, 0x00, 0x00}, "0.00000000023283064365386962890625"},
+		{"uq0.32", []byte{0x00, 0x00, 0x00, 0x00}, "0"},
+		{"uq1.63", []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+			"1.999999999999999999891579782751449556599254719913005828857421875"},
+		{"uq1.63", []byte{0x01, 0, 0, 0, 0, 0, 0, 0},
+			"0.000000000000000000108420217248550443400745280086994171142578125"},
+		{"uq1.63", []byte{0, 0, 0, 0, 0, 0, 0, 0x80}, "1"},
+	}
+	for _, tt := range tests {
+		conv, err := newConverter(ConverterConfig{Mode: "array", Params: map[string]string{"type": tt.typ}})
+		if err != nil {
+			t.Fatalf("%s: %s", tt.typ, err)
+		}
+		values, err := conv.Decode(tt.data)
+		if err != nil {
+			t.Errorf("%s: decoding % X: %s", tt.typ, tt.data, err)
+			continue
+		}
+		if len(values) != 1 || values[0] != tt.payload {
+			t.Errorf("%s: % X decoded as %q, want %q", tt.typ, tt.data, values, tt.payload)
+		}
+		data, err := conv.Encode(values)
+		if err != nil {
+			t.Errorf("%s: encoding %q: %s", tt.typ, values, err)
+		} else if !bytes.Equal(data, tt.data) {
+			t.Errorf("%s: % X came back as % X", tt.typ, tt.data, data)
+		}
+	}
+}
+
+// values out of the range of their type and fractions of unscaled
+// integers are rejected, scaled values are rounded
+func TestSignalEncodeLimits(t *testing.T) {
+	tests := []struct {
+		typ     string
+		payload string
+		data    []byte // nil: rejected
+	}{
+		{"int8", "128", nil},
+		{"int8", "-129", nil},
+		{"int8", "1.4", nil},
+		{"int64", "9223372036854775808", nil},
+		{"int64", "-9223372036854775809", nil},
+		{"int64", "1e3", nil},
+		{"uint64", "18446744073709551616", nil},
+		{"uint64", "-1", nil},
+		{"uint64", "1.5", nil},
+		{"uint16", "1.5", nil},
+		{"float16", "65520", nil},
+		{"float16", "NaN", nil},
+		{"float32", "1e39", nil},
+		{"q1.15", "1", nil},
+		{"q1.31", "1", nil},
+		{"uq1.63", "2", nil},
+		{"q1.15", "-1.00001", []byte{0x00, 0x80}}, // rounded to -1
+		{"uq8.8", "256", nil},
+		{"uq8.8", "-0.01", nil},
+		{"uq8.8", "0.001", []byte{0x00, 0x00}},
+	}
+	for _, tt := range tests {
+		conv, err := newConverter(ConverterConfig{Mode: "array", Params: map[string]string{"type": tt.typ}})
+		if err != nil {
+			t.Fatalf("%s: %s", tt.typ, err)
+		}
+		data, err := conv.Encode([]string{tt.payload})
+		switch {
+		case tt.data == nil && err == nil:
+			t.Errorf("%s: %q encoded as % X, want an error", tt.typ, tt.payload, data)
+		case tt.data != nil && err != nil:
+			t.Errorf("%s: encoding %q: %s", tt.typ, tt.payload, err)
+		case tt.data != nil && !bytes.Equal(data, tt.data):
+			t.Errorf("%s: %q encoded as % X, want % X", tt.typ, tt.payload, data, tt.data)
+		}
+	}
+	// the same rule for the modes with several numbers
+	conv, err := newConverter(ConverterConfig{Mode: "4uint162ascii"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := conv.Encode([]string{"1.5 0 0 0"}); err == nil {
+		t.Errorf("4uint162ascii: %q encoded as % X, want an error", "1.5 0 0 0", data)
+	}
+}
+
+// scaled 64 bit signals can't have all raw values, but their limits
+// must not overflow
+func TestSignalScaledLimits(t *testing.T) {
+	sig := &signal{name: "s", length: 64, factor: 2, offset: 0}
+	data := make([]byte, 8)
+	if err := sig.encode(data, "36893488147419103232"); err == nil { // 2^65
+		t.Errorf("2^65 encoded as % X, want an error", data)
+	}
+	if err := sig.encode(data, "36893488147419099136"); err != nil { // 2 * (2^64-2048)
+		t.Error(err)
+	} else if want := []byte{0, 0xf8, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}; !bytes.Equal(data, want) {
+		t.Errorf("encoded as % X, want % X", data, want)
+	}
+	sig = &signal{name: "s", length: 64, signed: true, factor: 0.5}
+	if err := sig.encode(data, "4611686018427387904"); err == nil { // 2^62 -> raw 2^63
+		t.Errorf("2^62 encoded as % X, want an error", data)
+	}
+	if err := sig.encode(data, "-4611686018427387904"); err != nil { // raw -2^63
+		t.Error(err)
+	} else if want := []byte{0, 0, 0, 0, 0, 0, 0, 0x80}; !bytes.Equal(data, want) {
+		t.Errorf("encoded as % X, want % X", data, want)
+	}
+}
@@ -0,0 +1,118 @@
+package can2mqtt_tuc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// sizes of struct can_frame and struct canfd_frame of SocketCAN
+const (
+	canMTU   = 16
+	canfdMTU = 72
+)
+
+// options of CAN_RAW sockets, missing in x/sys/unix
+const (
+	solCANRaw      = unix.SOL_CAN_BASE + unix.CAN_RAW
+	canRawFDFrames = 5
+)
+
+// canSocket is a raw SocketCAN socket. It receives classic and CAN FD
+// frames, CAN FD frames can only be sent if the interface is in CAN FD
+// mode (MTU 72).
+type canSocket struct {
+	iface string
+	file  *os.File
+	fd    bool // interface and kernel support CAN FD
+}
+
+// openCANSocket opens a raw socket on the interface with the given name
+func openCANSocket(name string) (*canSocket, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	// binding works on a down interface, but nothing is received and
+	// reading fails right away with ENETDOWN
+	if iface.Flags&net.FlagUp == 0 {
+		return nil, fmt.Errorf("canbackend: interface %s is down", name)
+	}
+	s, err := unix.Socket(unix.AF_CAN, unix.SOCK_RAW, unix.CAN_RAW)
+	if err != nil {
+		return nil, fmt.Errorf("canbackend: socket for %s: %w", name, err)
+	}
+	// old kernels don't know CAN FD, classic frames still work there
+	fd := iface.MTU == canfdMTU && unix.SetsockoptInt(s, solCANRaw, canRawFDFrames, 1) == nil
+	if err := unix.Bind(s, &unix.SockaddrCAN{Ifindex: iface.Index}); err != nil {
+		unix.Close(s)
+		return nil, fmt.Errorf("canbackend: bind to %s: %w", name, err)
+	}
+	// non-blocking, so Close makes a pending read return
+	if err := unix.SetNonblock(s, true); err != nil {
+		unix.Close(s)
+		return nil, err
+	}
+	return &canSocket{iface: name, file: os.NewFile(uintptr(s), name), fd: fd}, nil
+}
+
+// readFrame reads the next frame, io.EOF is returned after close
+func (s *canSocket) readFrame(f *Frame) error {
+	var b [canfdMTU]byte
+	n, err := s.file.Read(b[:])
+	if errors.Is(err, os.ErrClosed) {
+		return io.EOF
+	}
+	if err != nil {
+		return err
+	}
+	*f = Frame{ID: binary.LittleEndian.Uint32(b[0:4]), Length: b[4]}
+	switch n {
+	case canMTU:
+		if f.Length > 8 {
+			f.Length = 8
+		}
+	case canfdMTU:
+		f.Flags = b[5]&(FrameBRS|FrameESI) | FrameFD
+		if !validLength(int(f.Length), true) {
+			f.Length = uint8(DLCToLength(LengthToDLC(int(f.Length)), true))
+		}
+	default:
+		return fmt.Errorf("canbackend: read %d bytes from %s, not a CAN-frame", n, s.iface)
+	}
+	copy(f.Data[:f.Length], b[8:])
+	return nil
+}
+
+// writeFrame sends a frame
+func (s *canSocket) writeFrame(f Frame) error {
+	if err := f.check(); err != nil {
+		return err
+	}
+	var b [canfdMTU]byte
+	binary.LittleEndian.PutUint32(b[0:4], f.ID)
+	b[4] = f.Length
+	copy(b[8:], f.Payload())
+	size := canMTU
+	if f.IsFD() {
+		if !s.fd {
+			return fmt.Errorf("canbackend: %s is not a CAN FD interface", s.iface)
+		}
+		b[5] = f.Flags & (FrameBRS | FrameESI)
+		size = canfdMTU
+	}
+	_, err := s.file.Write(b[:size])
+	if errors.Is(err, os.ErrClosed) {
+		return ErrCANClosed
+	}
+	return err
+}
+
+func (s *canSocket) close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package can2mqtt_tuc
+
+import "fmt"
+
+// canSocket is only available on Linux
+type canSocket struct{}
+
+func openCANSocket(name string) (*canSocket, error) {
+	return nil, fmt.Errorf("canbackend: SocketCAN interface %s: SocketCAN is only available on Linux", name)
+}
+
+func (s *canSocket) readFrame(f *Frame) error { return ErrCANClosed }
+
+func (s *canSocket) writeFrame(f Frame) error { return ErrCANClosed }
+
+func (s *canSocket) close() error { return nil }
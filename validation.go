@@ -0,0 +1,181 @@
+package can2mqtt_tuc
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/brutella/can"
+)
+
+// Problem is one issue found in a mapping file.
+type Problem struct {
+	File string
+	Line int // 0 if the problem has no specific line
+	Msg  string
+}
+
+func (p Problem) String() string {
+	if p.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", p.File, p.Line, p.Msg)
+	}
+	return fmt.Sprintf("%s: %s", p.File, p.Msg)
+}
+
+// ValidationError is returned for mapping files that contain problems.
+// It lists all of them, not just the first one.
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, 0, len(e.Problems)+1)
+	lines = append(lines, fmt.Sprintf("main: found %d problem(s) in the mappings:", len(e.Problems)))
+	for _, p := range e.Problems {
+		lines = append(lines, "  "+p.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// problems collects the problems found while reading a mapping file
+type problems []Problem
+
+func (ps *problems) add(file string, line int, format string, a ...interface{}) {
+	*ps = append(*ps, Problem{File: file, Line: line, Msg: fmt.Sprintf(format, a...)})
+}
+
+// err returns a *ValidationError with the problems sorted by file and
+// line if there are problems, nil otherwise
+func (ps problems) err() error {
+	if len(ps) == 0 {
+		return nil
+	}
+	sort.SliceStable(ps, func(i, j int) bool {
+		if ps[i].File != ps[j].File {
+			return ps[i].File < ps[j].File
+		}
+		return ps[i].Line < ps[j].Line
+	})
+	return &ValidationError{Problems: ps}
+}
+
+// CheckMappingFile reads a can2mqtt.csv, YAML configuration file or
+// DBC file and reports every problem found in it, with file and line.
+// The settings of a YAML configuration file are checked like
+// LoadConfig does. It returns nil if the file can be used by the
+// bridge.
+func CheckMappingFile(filename string) error {
+	_, err := readMappings(filename)
+	if !IsYAMLFile(filename) {
+		return err
+	}
+	var ps problems
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		ps = verr.Problems
+	} else if err != nil {
+		return err
+	}
+	// a file that can't be read is already a problem
+	if cf, err := readConfigFile(filename); err == nil {
+		if err := cf.settings(&Config{}); err != nil {
+			ps.add(filename, 0, "%s", err)
+		}
+	}
+	return ps.err()
+}
+
+// validateMappings checks the mappings for problems that can not be
+// detected while parsing a single line: IDs out of range, bad topics
+// and IDs, topics or ISO-TP flow control IDs that are used twice.
+// Convert-modes are checked by resolveConverters.
+func validateMappings(pairs []*can2mqtt, ps *problems) {
+	ids := make(map[uint32]*can2mqtt)
+	muxValues := make(map[pairKey]*can2mqtt)
+	topics := make(map[string]*can2mqtt)
+	for _, c2mp := range pairs {
+		if c2mp.canId < 0 || (c2mp.extended && c2mp.canId > can.MaskIDEff) {
+			ps.add(c2mp.file, c2mp.line, "CAN-ID %s is out of the 29 bit range", c2mp.idString())
+		} else if !c2mp.extended && c2mp.canId > can.MaskIDSff {
+			ps.add(c2mp.file, c2mp.line, "CAN-ID %s is out of the 11 bit range of the standard frame format", c2mp.idString())
+		}
+		for _, topic := range c2mp.mqttTopic {
+			if msg := checkTopic(topic); msg != "" {
+				ps.add(c2mp.file, c2mp.line, "topic %q: %s", topic, msg)
+			}
+		}
+		if first, ok := ids[c2mp.frameID()]; ok && !sameMultiplexer(first, c2mp) {
+			ps.add(c2mp.file, c2mp.line, "CAN-ID %s is already used in %s", c2mp.idString(), first.position())
+		} else if first, ok := muxValues[c2mp.key()]; ok {
+			ps.add(c2mp.file, c2mp.line, "multiplexer value %d of CAN-ID %s is already used in %s", c2mp.mux.value, c2mp.idString(), first.position())
+		} else {
+			if _, ok := ids[c2mp.frameID()]; !ok {
+				ids[c2mp.frameID()] = c2mp
+			}
+			muxValues[c2mp.key()] = c2mp
+		}
+		if c2mp.cmdTopic != "" {
+			if msg := checkTopic(c2mp.cmdTopic); msg != "" {
+				ps.add(c2mp.file, c2mp.line, "topic %q: %s", c2mp.cmdTopic, msg)
+			}
+		}
+		// every topic, not just the subscribed one: the /set topic of a
+		// mapping must not be the topic another one publishes to
+		for _, topic := range c2mp.topics() {
+			if first, ok := topics[topic]; ok {
+				ps.add(c2mp.file, c2mp.line, "topic %q is already used in %s", topic, first.position())
+			} else {
+				topics[topic] = c2mp
+			}
+		}
+	}
+	// the frames ISO-TP sends need an ID of their own
+	txIDs := make(map[uint32]*can2mqtt)
+	for _, c2mp := range pairs {
+		if c2mp.isotp == nil {
+			continue
+		}
+		if other, ok := ids[c2mp.isotp.txID]; ok {
+			ps.add(c2mp.file, c2mp.line, "isotp: tx_id is the CAN-ID of %s", other.position())
+		} else if other, ok := txIDs[c2mp.isotp.txID]; ok {
+			ps.add(c2mp.file, c2mp.line, "isotp: tx_id is already used in %s", other.position())
+		} else {
+			txIDs[c2mp.isotp.txID] = c2mp
+		}
+	}
+}
+
+// checkTopic returns what is wrong with a topic to publish to, or an
+// empty string if it is fine
+func checkTopic(topic string) string {
+	switch {
+	case topic == "":
+		return "topic is empty"
+	case len(topic) > 65535:
+		return "topic is longer than 65535 bytes"
+	case strings.ContainsAny(topic, "+#"):
+		return "wildcards (+, #) are not allowed"
+	case strings.ContainsRune(topic, 0):
+		return "NUL character is not allowed"
+	case strings.TrimSpace(topic) != topic:
+		return "leading or trailing whitespace"
+	}
+	return ""
+}
+
+// idString formats the ID of a mapping for messages
+func (c2mp *can2mqtt) idString() string {
+	if c2mp.extended {
+		return fmt.Sprintf("%d (0x%X, extended)", c2mp.canId, c2mp.canId)
+	}
+	return fmt.Sprintf("%d (0x%X)", c2mp.canId, c2mp.canId)
+}
+
+// position describes where a mapping was defined
+func (c2mp *can2mqtt) position() string {
+	if c2mp.line > 0 {
+		return fmt.Sprintf("%s:%d", c2mp.file, c2mp.line)
+	}
+	return c2mp.file
+}
@@ -0,0 +1,154 @@
+package can2mqtt_tuc
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCheckMappingFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string // problems after the file name, FILE: the file name
+	}{
+		{"can2mqtt.csv", `CAN-ID,mode,topic
+0x100,uint82ascii,test/a
+0x100,uint82ascii,test/b
+0x101,nosuchmode,test/c
+0x102,uint82ascii,test/a
+0x800,uint82ascii,test/d,std
+0x103,uint82ascii,test/+/e
+0x104,uint82ascii
+0x105,uint82ascii, test/f
+`, []string{
+			`:3: CAN-ID 256 (0x100) is already used in FILE:2`,
+			`:4: unknown convert-mode "nosuchmode"`,
+			`:5: topic "test/a" is already used in FILE:2`,
+			`:6: CAN-ID 2048 (0x800) is out of the 11 bit range of the standard frame format`,
+			`:7: topic "test/+/e": wildcards (+, #) are not allowed`,
+			`:8: expected 3 or 4 columns (CAN-ID, convert-mode, MQTT-topic[, std|ext]), got 2`,
+		}},
+		{"quotes.csv", "0x100,uint82ascii,test/a\n0x101,uint82ascii,\"test/b\n", []string{
+			`:2: extraneous or missing " in quoted-field`,
+		}},
+		{"can2mqtt.yaml", `mappings:
+  - {id: 0x100, mode: uint82ascii, topic: test/a}
+  - id: 0x101
+    mode: uint82ascii
+    topic: test/a
+  - {id: 0x102, mode: uint82ascii}
+  - {id: 0x103, mode: uint82ascii, topic: test/b, qos: 3}
+  - {id: 0x104, mode: layout, topic: test/c, fields: [{byte: 0}], format: xml}
+  - {id: 0x105, mode: none, topic: test/t, isotp: {tx_id: 0x100}}
+  - {id: 0x106, mode: uint82ascii, topic: test/d, scale: 0}
+  - {id: 0x1FFFFFFF, extended: false, mode: uint82ascii, topic: test/e}
+  - {id: x, mode: uint82ascii, topic: test/h}
+  - {id: 0x107, mode: uint162ascii, topics: [test/f, test/g]}
+`, []string{
+			`:3: topic "test/a" is already used in FILE:2`,
+			`:6: no MQTT-topic given for ID 0x102`,
+			`:7: invalid qos 3, valid values are 0, 1 and 2`,
+			`:8: invalid format "xml", valid formats are text and json`,
+			`:9: isotp: tx_id is the CAN-ID of FILE:2`,
+			`:10: invalid scale 0`,
+			`:11: CAN-ID 536870911 (0x1FFFFFFF) is out of the 11 bit range of the standard frame format`,
+			`:12: CAN-ID "x" is neither a decimal nor a 0x-prefixed hexadecimal number`,
+			`:13: convert-mode uint162ascii needs 1 topic(s), got 2`,
+		}},
+	}
+	for _, tt := range tests {
+		file := writeFile(t, tt.name, tt.content)
+		err := CheckMappingFile(file)
+		var verr *ValidationError
+		if !errors.As(err, &verr) {
+			t.Errorf("%s: got %v, want a ValidationError", tt.name, err)
+			continue
+		}
+		if len(verr.Problems) != len(tt.want) {
+			t.Errorf("%s: got %s", tt.name, err)
+			continue
+		}
+		for i, p := range verr.Problems {
+			want := file + strings.ReplaceAll(tt.want[i], "FILE", file)
+			if p.String() != want {
+				t.Errorf("%s: got %s, want %s", tt.name, p, want)
+			}
+		}
+	}
+}
+
+// the published topics and command topics of all mappings share one
+// namespace, not only the subscribed ones
+func TestDuplicateTopics(t *testing.T) {
+	file := writeFile(t, "can2mqtt.yaml", `mappings:
+  - {id: 0x100, mode: uint82ascii, topic: test/a, command_topic: test/a/set}
+  - {id: 0x101, mode: uint82ascii, topic: test/a/set}
+  - {id: 0x102, mode: layout, fields: [{topic: test/b, byte: 0}, {topic: test/c, byte: 1}]}
+  - {id: 0x103, mode: uint82ascii, topic: test/d, command_topic: test/c}
+  - {id: 0x104, mode: layout, fields: [{topic: test/e, byte: 0}, {topic: test/b, byte: 1}], direction: can2mqtt}
+`)
+	want := []string{
+		`:3: topic "test/a/set" is already used in FILE:2`,
+		`:5: topic "test/c" is already used in FILE:4`,
+		`:6: topic "test/b" is already used in FILE:4`,
+	}
+	err := CheckMappingFile(file)
+	var verr *ValidationError
+	if !errors.As(err, &verr) || len(verr.Problems) != len(want) {
+		t.Fatalf("got %v", err)
+	}
+	for i, p := range verr.Problems {
+		if w := file + strings.ReplaceAll(want[i], "FILE", file); p.String() != w {
+			t.Errorf("got %s, want %s", p, w)
+		}
+	}
+
+	// the bridge refuses them even without the checks of the file
+	pairs := []*can2mqtt{
+		{canId: 0x100, mqttTopic: []string{"test/a"}, cmdTopic: "test/a/set"},
+		{canId: 0x101, mqttTopic: []string{"test/b", "test/a/set"}},
+	}
+	if _, _, err := indexMappings(pairs); err == nil {
+		t.Error("test/a/set used twice was indexed")
+	}
+}
+
+// check reports the settings LoadConfig rejects and unknown keys,
+// which LoadConfig rejects as well
+func TestCheckMappingFileSettings(t *testing.T) {
+	const mapping = "mappings:\n  - {id: 0x100, mode: uint82ascii, topic: test/a}\n"
+	tests := []struct {
+		content string
+		want    string // problem after the file name
+	}{
+		{"mqtt: {qos: 7}\n" + mapping, ": invalid qos 7, valid values are 0, 1 and 2"},
+		{"direction: sideways\n" + mapping, ": error: got invalid direction (sideways)"},
+		{"pipeline: {overflow: drop}\n" + mapping, ": error: got invalid overflow policy (drop)"},
+		{"watch: often\n" + mapping, ": invalid watch interval"},
+		{"mqt: {qos: 1}\n" + mapping, `:1: unknown key "mqt"`},
+		{"mappings:\n  - {id: 0x100, mode: uint82ascii, topic: test/a, retian: true}\n", `:2: unknown key "retian"`},
+		{"mappings:\n  - id: 0x100\n    mode: uint82ascii\n    topic: test/a\n    directon: can2mqtt\n", `:5: unknown key "directon"`},
+		{"mappings:\n  - {id: 0x100, mode: layout, topic: test/a, fields: [{byte: 0, lenght: 8}]}\n", `:2: unknown key "lenght"`},
+		{"mappings:\n  - {id: 0x100, mode: uint82ascii, topic: test/a, qos: x}\n", ":2: cannot unmarshal"},
+	}
+	for _, tt := range tests {
+		file := writeFile(t, "can2mqtt.yaml", tt.content)
+		err := CheckMappingFile(file)
+		var verr *ValidationError
+		if !errors.As(err, &verr) || len(verr.Problems) != 1 || !strings.HasPrefix(verr.Problems[0].String(), file+tt.want) {
+			t.Errorf("%q: got %v, want %s", tt.content, err, tt.want)
+		}
+		if _, err := LoadConfig(file); err == nil {
+			t.Errorf("%q: accepted by LoadConfig", tt.content)
+		}
+	}
+}
+
+func TestCheckMappingFileOK(t *testing.T) {
+	for _, file := range []string{"examples/drillbotics.yaml", "examples/c3re.csv", "examples/drillbotics.dbc"} {
+		if err := CheckMappingFile(file); err != nil {
+			t.Errorf("%s: %s", file, err)
+		}
+	}
+}
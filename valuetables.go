@@ -0,0 +1,194 @@
+package can2mqtt_tuc
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// valueTable translates the raw integers of a mapping into labels,
+// either one label per value (enumerations like states) or the names
+// of the set bits (flags like fault codes)
+type valueTable struct {
+	labels map[int64]string // raw value -> label
+	flags  map[int]string   // bit -> name
+	bits   []int            // bits of flags, in ascending order
+}
+
+// newValueTable checks the values or flags of a mapping, nil means the
+// mapping has neither
+func newValueTable(values map[int64]string, flags map[int]string) (*valueTable, error) {
+	if len(values) == 0 && len(flags) == 0 {
+		return nil, nil
+	}
+	if len(values) > 0 && len(flags) > 0 {
+		return nil, fmt.Errorf("values and flags can't be used together")
+	}
+	seen := make(map[string]bool)
+	checkLabel := func(label string) error {
+		if label == "" || strings.ContainsAny(label, " \t|") || seen[label] {
+			return fmt.Errorf("label %q must not be empty, contain spaces or | or be used twice", label)
+		}
+		if _, err := strconv.ParseFloat(label, 64); err == nil {
+			return fmt.Errorf("label %q must not be a number", label)
+		}
+		seen[label] = true
+		return nil
+	}
+	t := &valueTable{labels: values, flags: flags}
+	for _, label := range values {
+		if err := checkLabel(label); err != nil {
+			return nil, err
+		}
+	}
+	for bit, name := range flags {
+		if bit < 0 || bit > 63 {
+			return nil, fmt.Errorf("flag %s: invalid bit %d", name, bit)
+		}
+		if err := checkLabel(name); err != nil {
+			return nil, err
+		}
+		if _, err := strconv.Atoi(strings.TrimPrefix(name, "bit")); err == nil && strings.HasPrefix(name, "bit") {
+			return nil, fmt.Errorf("flag %s: bit<n> is used for bits without name", name)
+		}
+		t.bits = append(t.bits, bit)
+	}
+	sort.Ints(t.bits)
+	return t, nil
+}
+
+// resolveValueTable checks that the converter of a mapping with a
+// value table has integers
+func resolveValueTable(c2mp *can2mqtt) error {
+	if c2mp.table == nil {
+		return nil
+	}
+	if c2mp.convMethod == "layout" {
+		return fmt.Errorf("a layout has values per field")
+	}
+	if c2mp.scaling != nil {
+		return fmt.Errorf("values and flags can't be scaled")
+	}
+	n, ok := c2mp.conv.(numberer)
+	if !ok || n.numbers() != integers {
+		return fmt.Errorf("convert-mode %s has no integers for values and flags", c2mp.convMethod)
+	}
+	return nil
+}
+
+// decode replaces the raw numbers of the values by their labels.
+// Numbers without label stay numbers, set bits without name are
+// called bit<n>, no set bit at all is 0.
+func (t *valueTable) decode(values []string) ([]string, error) {
+	if t == nil {
+		return values, nil
+	}
+	labeled := make([]string, len(values))
+	for i, value := range values {
+		nums := strings.Fields(value)
+		for j, num := range nums {
+			raw, err := strconv.ParseInt(num, 10, 64)
+			if err != nil {
+				u, uerr := strconv.ParseUint(num, 10, 64)
+				if uerr != nil {
+					return nil, fmt.Errorf("%q is not an integer", num)
+				}
+				raw = int64(u)
+			}
+			if t.flags == nil {
+				if label, ok := t.labels[raw]; ok {
+					nums[j] = label
+				}
+				continue
+			}
+			nums[j] = t.flagNames(uint64(raw))
+		}
+		labeled[i] = strings.Join(nums, " ")
+	}
+	return labeled, nil
+}
+
+// flagNames returns the names of the set bits separated by |
+func (t *valueTable) flagNames(raw uint64) string {
+	if raw == 0 {
+		return "0"
+	}
+	var names []string
+	for _, bit := range t.bits {
+		if raw&(1<<bit) != 0 {
+			names = append(names, t.flags[bit])
+			raw &^= 1 << bit
+		}
+	}
+	for bit := 0; raw != 0; bit++ {
+		if raw&1 != 0 {
+			names = append(names, "bit"+strconv.Itoa(bit))
+		}
+		raw >>= 1
+	}
+	return strings.Join(names, "|")
+}
+
+// encode replaces labels by their raw numbers, numbers are taken as
+// they are. Flags are names, bit<n> or numbers separated by |.
+func (t *valueTable) encode(values []string) ([]string, error) {
+	if t == nil {
+		return values, nil
+	}
+	raws := make([]string, len(values))
+	for i, value := range values {
+		nums := strings.Fields(value)
+		for j, num := range nums {
+			var err error
+			if t.flags == nil {
+				nums[j], err = t.enumValue(num)
+			} else {
+				nums[j], err = t.flagsValue(num)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		raws[i] = strings.Join(nums, " ")
+	}
+	return raws, nil
+}
+
+func (t *valueTable) enumValue(label string) (string, error) {
+	if _, err := strconv.ParseFloat(label, 64); err == nil {
+		return label, nil
+	}
+	for raw, l := range t.labels {
+		if l == label {
+			return strconv.FormatInt(raw, 10), nil
+		}
+	}
+	return "", fmt.Errorf("unknown value %q", label)
+}
+
+func (t *valueTable) flagsValue(flags string) (string, error) {
+	var raw uint64
+	for _, name := range strings.Split(flags, "|") {
+		if n, err := strconv.ParseUint(name, 10, 64); err == nil {
+			raw |= n
+			continue
+		}
+		if bit, err := strconv.Atoi(strings.TrimPrefix(name, "bit")); err == nil && strings.HasPrefix(name, "bit") && bit >= 0 && bit < 64 {
+			raw |= 1 << bit
+			continue
+		}
+		found := false
+		for bit, n := range t.flags {
+			if n == name {
+				raw |= 1 << bit
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("unknown flag %q", name)
+		}
+	}
+	return strconv.FormatUint(raw, 10), nil
+}
@@ -0,0 +1,117 @@
+package can2mqtt_tuc
+
+import (
+	"strings"
+	"testing"
+)
+
+func testValueTable(t *testing.T, values map[int64]string, flags map[int]string) *valueTable {
+	t.Helper()
+	table, err := newValueTable(values, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return table
+}
+
+func TestValueTableRoundTrip(t *testing.T) {
+	states := testValueTable(t, map[int64]string{0: "off", 1: "on", -1: "error"}, nil)
+	faults := testValueTable(t, nil, map[int]string{0: "overheat", 3: "undervoltage", 63: "fatal"})
+	tests := []struct {
+		table *valueTable
+		raw   string
+		label string
+	}{
+		{states, "0", "off"},
+		{states, "1", "on"},
+		{states, "-1", "error"},
+		{states, "7", "7"}, // no label, stays a number
+		{states, "1 0 2", "on off 2"},
+		{faults, "0", "0"},
+		{faults, "1", "overheat"},
+		{faults, "9", "overheat|undervoltage"},
+		{faults, "13", "overheat|undervoltage|bit2"},
+		{faults, "9223372036854775808", "fatal"},
+	}
+	for _, tt := range tests {
+		labels, err := tt.table.decode([]string{tt.raw})
+		if err != nil {
+			t.Errorf("%s: %s", tt.raw, err)
+			continue
+		}
+		if labels[0] != tt.label {
+			t.Errorf("%s decoded as %s, want %s", tt.raw, labels[0], tt.label)
+		}
+		raws, err := tt.table.encode([]string{tt.label})
+		if err != nil {
+			t.Errorf("%s: %s", tt.label, err)
+			continue
+		}
+		if raws[0] != tt.raw {
+			t.Errorf("%s encoded as %s, want %s", tt.label, raws[0], tt.raw)
+		}
+	}
+}
+
+func TestValueTableEncode(t *testing.T) {
+	states := testValueTable(t, map[int64]string{0: "off", 1: "on"}, nil)
+	faults := testValueTable(t, nil, map[int]string{0: "overheat", 3: "undervoltage"})
+	tests := []struct {
+		table  *valueTable
+		value  string
+		raw    string
+		reason string // "": no error
+	}{
+		{states, "5", "5", ""},
+		{states, "1.5", "1.5", ""}, // numbers are checked by the converter
+		{states, "standby", "", `unknown value "standby"`},
+		{states, "On", "", `unknown value "On"`},
+		{faults, "undervoltage|overheat", "9", ""},
+		{faults, "bit1|overheat", "3", ""},
+		{faults, "16|undervoltage", "24", ""},
+		{faults, "overheat|overheat", "1", ""},
+		{faults, "shorted", "", `unknown flag "shorted"`},
+		{faults, "overheat|", "", `unknown flag ""`},
+		{faults, "bit64", "", `unknown flag "bit64"`},
+	}
+	for _, tt := range tests {
+		raws, err := tt.table.encode([]string{tt.value})
+		if tt.reason != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.reason) {
+				t.Errorf("%s: got %q, %v, want the error %s", tt.value, raws, err, tt.reason)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.value, err)
+		} else if raws[0] != tt.raw {
+			t.Errorf("%s encoded as %s, want %s", tt.value, raws[0], tt.raw)
+		}
+	}
+}
+
+func TestNewValueTable(t *testing.T) {
+	tests := []struct {
+		values  map[int64]string
+		flags   map[int]string
+		problem string
+	}{
+		{map[int64]string{0: "off"}, map[int]string{0: "on"}, "can't be used together"},
+		{map[int64]string{0: "off", 1: "off"}, nil, "used twice"},
+		{map[int64]string{0: "stand by"}, nil, "contain spaces"},
+		{map[int64]string{0: "a|b"}, nil, "contain spaces or |"},
+		{map[int64]string{0: ""}, nil, "must not be empty"},
+		{map[int64]string{0: "1e3"}, nil, "must not be a number"},
+		{nil, map[int]string{64: "x"}, "invalid bit 64"},
+		{nil, map[int]string{1: "bit2"}, "bit<n> is used for bits without name"},
+	}
+	for _, tt := range tests {
+		_, err := newValueTable(tt.values, tt.flags)
+		if err == nil || !strings.Contains(err.Error(), tt.problem) {
+			t.Errorf("%v %v: got %v, want %q", tt.values, tt.flags, err, tt.problem)
+		}
+	}
+	if table, err := newValueTable(nil, nil); table != nil || err != nil {
+		t.Errorf("no values and flags: %v, %v", table, err)
+	}
+}